@@ -17,14 +17,54 @@ type Config struct {
 	OIDCProvider    OIDCProvider
 	Webservice      Webservice
 	MongoDB         MongoDB
+	PsidEncryption  PsidEncryption
+	Webhook         Webhook
+	ReaderLimits    ReaderLimits
+}
+
+// ReaderLimits protects the unauthenticated reader endpoints. PerIP and
+// PerToken requests are allowed per Window; an IP sending LockoutFailures
+// invalid links within LockoutDuration is locked out for LockoutDuration.
+// ScansPerSerial caps the OCR scans of one serial in one request. Zero
+// disables a limit. The rate limits, the lockout and the rejection counters
+// are kept in memory by each instance, so they reset on restart and replicas
+// behind a load balancer each apply them on their own.
+type ReaderLimits struct {
+	PerIP           int
+	PerToken        int
+	Window          time.Duration
+	ScansPerSerial  int
+	LockoutFailures int
+	LockoutDuration time.Duration
+}
+
+// Webhook configures delivery of webhook events. A delivery is retried with
+// exponential backoff until it succeeds or MaxAttempts is reached, after which
+// it is kept as dead for manual redelivery. Deliveries to loopback, private
+// and link-local addresses are refused unless AllowPrivateTargets is set.
+type Webhook struct {
+	MaxAttempts         int
+	PollInterval        time.Duration
+	Timeout             time.Duration
+	AllowPrivateTargets bool
+}
+
+// PsidEncryption configures encryption of PSIDs at rest. Keys is a list of
+// id:hexkey pairs; old keys stay listed until `psid rotate` has moved every
+// record to ActiveKey. IndexKey must never change once data is written.
+type PsidEncryption struct {
+	Keys      string
+	ActiveKey string
+	IndexKey  string
 }
 
 type MongoDB struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	Database string
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	Database    string
+	AutoMigrate bool
 }
 
 type ServerConfig struct {
@@ -34,6 +74,18 @@ type ServerConfig struct {
 	BaseUrl   string
 	SecretKey string
 	ProxyScan bool
+	// ReaderTokenKeys are "id:hexkey" pairs for encrypted reader links; new
+	// links use ReaderTokenActiveKey, or SECRET_KEY when it is empty.
+	ReaderTokenKeys      string
+	ReaderTokenActiveKey string
+	// ReaderPath is where the reader page is served below BaseUrl; links and
+	// QR codes point to BaseUrl + ReaderPath + "/" + link.
+	ReaderPath string
+	// TrustedProxies are the IPs and CIDR ranges of the reverse proxies whose
+	// X-Forwarded-For header is believed; with none the connection's address
+	// is the client IP. Deployments behind a proxy must list it when they
+	// upgrade, otherwise the reader limits apply to the proxy as a whole.
+	TrustedProxies []string
 }
 
 type AuthConfig struct {
@@ -62,9 +114,14 @@ type OIDCProvider struct {
 }
 
 type Webservice struct {
-	HeaderKey  string
-	ApiKey     string
+	HeaderKey   string
+	ApiKey      string
+	AdminApiKey string
+	// PsidApiKey is accepted like ApiKey and additionally reveals PSIDs.
+	PsidApiKey string
 	AllowedIPs []string
+	// PsidLinkTTL is how long a PSID reader link stays valid by default.
+	PsidLinkTTL time.Duration
 }
 
 var (
@@ -76,6 +133,18 @@ func InitConfig() *Config {
 	once.Do(func() {
 		viper.SetConfigFile(".env")
 		viper.AutomaticEnv()
+		viper.SetDefault("MONGODB_AUTO_MIGRATE", true)
+		viper.SetDefault("PSID_LINK_TTL", "72h")
+		viper.SetDefault("READER_PATH", "/reader")
+		viper.SetDefault("WEBHOOK_MAX_ATTEMPTS", 10)
+		viper.SetDefault("WEBHOOK_POLL_INTERVAL", "10s")
+		viper.SetDefault("WEBHOOK_TIMEOUT", "10s")
+		viper.SetDefault("READER_RATE_PER_IP", 120)
+		viper.SetDefault("READER_RATE_PER_TOKEN", 60)
+		viper.SetDefault("READER_RATE_WINDOW", "1m")
+		viper.SetDefault("READER_MAX_SCANS_PER_SERIAL", 10)
+		viper.SetDefault("READER_LOCKOUT_FAILURES", 10)
+		viper.SetDefault("READER_LOCKOUT_DURATION", "15m")
 
 		if err := viper.ReadInConfig(); err != nil {
 			log.Printf("Error reading config file: %v", err)
@@ -88,14 +157,26 @@ func InitConfig() *Config {
 			BaseUrl:   viper.GetString("BASE_URL"),
 			SecretKey: viper.GetString("SECRET_KEY"),
 			ProxyScan: viper.GetBool("PROXY_SCAN"),
+
+			ReaderTokenKeys:      viper.GetString("READER_TOKEN_KEYS"),
+			ReaderTokenActiveKey: viper.GetString("READER_TOKEN_ACTIVE_KEY"),
+			ReaderPath:           viper.GetString("READER_PATH"),
+			TrustedProxies:       viper.GetStringSlice("TRUSTED_PROXIES"),
 		}
 
 		mongoDB := &MongoDB{
-			Host:     viper.GetString("MONGODB_HOST"),
-			Port:     viper.GetInt("MONGODB_PORT"),
-			Username: viper.GetString("MONGODB_USERNAME"),
-			Password: viper.GetString("MONGODB_PASSWORD"),
-			Database: viper.GetString("MONGODB_DATABASE"),
+			Host:        viper.GetString("MONGODB_HOST"),
+			Port:        viper.GetInt("MONGODB_PORT"),
+			Username:    viper.GetString("MONGODB_USERNAME"),
+			Password:    viper.GetString("MONGODB_PASSWORD"),
+			Database:    viper.GetString("MONGODB_DATABASE"),
+			AutoMigrate: viper.GetBool("MONGODB_AUTO_MIGRATE"),
+		}
+
+		psidEncryption := &PsidEncryption{
+			Keys:      viper.GetString("PSID_KEYS"),
+			ActiveKey: viper.GetString("PSID_ACTIVE_KEY"),
+			IndexKey:  viper.GetString("PSID_INDEX_KEY"),
 		}
 
 		auth := &AuthConfig{
@@ -124,9 +205,28 @@ func InitConfig() *Config {
 		}
 
 		Webservice := &Webservice{
-			HeaderKey:  viper.GetString("WEBSERVICE_HEADER_KEY"),
-			ApiKey:     viper.GetString("WEBSERVICE_API_KEY"),
-			AllowedIPs: viper.GetStringSlice("WEBSERVICE_ALLOWED_IPS"),
+			HeaderKey:   viper.GetString("WEBSERVICE_HEADER_KEY"),
+			ApiKey:      viper.GetString("WEBSERVICE_API_KEY"),
+			AdminApiKey: viper.GetString("WEBSERVICE_ADMIN_API_KEY"),
+			PsidApiKey:  viper.GetString("WEBSERVICE_PSID_API_KEY"),
+			PsidLinkTTL: viper.GetDuration("PSID_LINK_TTL"),
+			AllowedIPs:  viper.GetStringSlice("WEBSERVICE_ALLOWED_IPS"),
+		}
+
+		webhook := &Webhook{
+			MaxAttempts:         viper.GetInt("WEBHOOK_MAX_ATTEMPTS"),
+			PollInterval:        viper.GetDuration("WEBHOOK_POLL_INTERVAL"),
+			Timeout:             viper.GetDuration("WEBHOOK_TIMEOUT"),
+			AllowPrivateTargets: viper.GetBool("WEBHOOK_ALLOW_PRIVATE_TARGETS"),
+		}
+
+		readerLimits := &ReaderLimits{
+			PerIP:           viper.GetInt("READER_RATE_PER_IP"),
+			PerToken:        viper.GetInt("READER_RATE_PER_TOKEN"),
+			Window:          viper.GetDuration("READER_RATE_WINDOW"),
+			ScansPerSerial:  viper.GetInt("READER_MAX_SCANS_PER_SERIAL"),
+			LockoutFailures: viper.GetInt("READER_LOCKOUT_FAILURES"),
+			LockoutDuration: viper.GetDuration("READER_LOCKOUT_DURATION"),
 		}
 
 		cfg = &Config{
@@ -137,6 +237,9 @@ func InitConfig() *Config {
 			OIDCProvider:    *oidc,
 			Webservice:      *Webservice,
 			MongoDB:         *mongoDB,
+			PsidEncryption:  *psidEncryption,
+			Webhook:         *webhook,
+			ReaderLimits:    *readerLimits,
 		}
 
 		fmt.Println("Config initialized successfully")
@@ -0,0 +1,253 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"scanner/config"
+	"scanner/databases"
+	"scanner/internal/migrations"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	Usage string
+	Run   func(ctx context.Context, cfg *config.Config, args []string) error
+}
+
+var commands = map[string]command{
+	"migrate": {
+		Usage: "migrate [status | release <version>]  apply pending migrations and indexes, list their state, or drop the claim of a crashed run",
+		Run:   migrate,
+	},
+	"duplicates": {
+		Usage: "duplicates [--fuzzy] | duplicates merge <id> <id>...  list duplicate hard clusters or merge records",
+		Run:   duplicates,
+	},
+	"psid": {
+		Usage: "psid rotate | psid reindex  re-encrypt every PSID with PSID_ACTIVE_KEY, including plaintext ones, or recompute the blind indexes after PSID_INDEX_KEY changed",
+		Run:   psid,
+	},
+	"reader-token": {
+		Usage: "reader-token decode <token> | reader-token encode <serial>...  check a reader link, e.g. one from php/main.php, or issue one",
+		Run:   readerToken,
+	},
+	"wipe-log": {
+		Usage: "wipe-log verify | wipe-log repair  recompute the wipe event hash chain and report any break, or log transitions missing from it",
+		Run:   wipeLog,
+	},
+}
+
+// Run executes a one-off maintenance command instead of starting the server,
+// e.g. `./scanner migrate`.
+func Run(ctx context.Context, cfg *config.Config, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage())
+	}
+
+	return cmd.Run(ctx, cfg, args[1:])
+}
+
+func usage() string {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Available commands:"}
+	for _, name := range names {
+		lines = append(lines, "  "+commands[name].Usage)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func migrate(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) > 0 && args[0] == "status" {
+		applied, err := migrations.Status(ctx, databases.DB)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range applied {
+			fmt.Printf("%4d  %-45s %-8s %s\n", migration.Version, migration.Name, migration.Status, migration.AppliedAt.Format("2006-01-02 15:04:05"))
+		}
+
+		return nil
+	}
+
+	if len(args) > 0 && args[0] == "release" {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: migrate release <version>")
+		}
+
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+
+		if err := migrations.Release(ctx, databases.DB, version); err != nil {
+			return err
+		}
+
+		fmt.Printf("Released migration %d, it will be applied on the next run\n", version)
+		return nil
+	}
+
+	if err := migrations.Run(ctx, databases.DB); err != nil {
+		return err
+	}
+
+	fmt.Println("Migrations applied successfully")
+	return nil
+}
+
+func duplicates(ctx context.Context, cfg *config.Config, args []string) error {
+	duplicateService := services.NewDuplicateService()
+	if len(args) > 0 && args[0] == "merge" {
+		hard, err := duplicateService.Merge(ctx, args[1:], "cli")
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Merged %d records into %s\n", len(args)-1, hard.ID.Hex())
+		return nil
+	}
+
+	fuzzy := len(args) > 0 && args[0] == "--fuzzy"
+	clusters, err := duplicateService.FindClusters(ctx, fuzzy, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range clusters {
+		fmt.Printf("%s (%d records)\n", cluster.Key, len(cluster.Hards))
+		for _, hard := range cluster.Hards {
+			marker := " "
+			if hard.ID == cluster.Proposal.WinnerID {
+				marker = "*"
+			}
+
+			fmt.Printf("  %s %s  serial=%s psid=%s wipe_accepted=%t user_edited=%t images=%d\n",
+				marker, hard.ID.Hex(), hard.SerialNumber, hard.Psid, hard.WipeAccepted, hard.UserEdited, len(hard.Images))
+		}
+	}
+
+	fmt.Printf("%d duplicate clusters found\n", len(clusters))
+	return nil
+}
+
+func wipeLog(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) > 0 && args[0] == "repair" {
+		anchored, repaired, err := services.NewScanService().RepairWipeLog(ctx)
+		if err != nil {
+			return fmt.Errorf("repaired %d hard(s) before failing: %w", repaired, err)
+		}
+
+		if anchored > 0 {
+			fmt.Printf("Anchored the head at event %d\n", anchored)
+		}
+
+		fmt.Printf("Appended missing transitions of %d hard(s)\n", repaired)
+		return nil
+	}
+
+	if len(args) == 0 || args[0] != "verify" {
+		return fmt.Errorf("usage: wipe-log verify | wipe-log repair")
+	}
+
+	report, err := services.NewScanService().VerifyWipeLog(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, chainBreak := range report.Breaks {
+		fmt.Printf("seq %d: %s\n", chainBreak.Seq, chainBreak.Reason)
+	}
+
+	for _, mismatch := range report.Mismatches {
+		fmt.Printf("hard %s (%s): %s\n", mismatch.HardID.Hex(), mismatch.SerialNumber, mismatch.Reason)
+	}
+
+	if !report.Valid {
+		return fmt.Errorf("wipe log is broken: %d problem(s) in %d event(s), %d hard(s) disagreeing with it", len(report.Breaks), report.Events, len(report.Mismatches))
+	}
+
+	fmt.Printf("Wipe log intact: %d event(s), head %s\n", report.Events, report.Head)
+	return nil
+}
+
+func psid(ctx context.Context, cfg *config.Config, args []string) error {
+	if len(args) > 0 && args[0] == "reindex" {
+		reindexed, err := repositories.NewHardRepository().ReindexPsids(ctx)
+		if err != nil {
+			return fmt.Errorf("reindexed %d record(s) before failing: %w", reindexed, err)
+		}
+
+		if err := repositories.NewPsidIndexRepository().Record(ctx); err != nil {
+			return err
+		}
+
+		// reader scans keep the OCR PSID only masked, so theirs can't be
+		// recomputed; the pending ones report a mismatch until they expire
+		fmt.Printf("Recomputed the blind index of %d PSID(s)\n", reindexed)
+		return nil
+	}
+
+	if len(args) == 0 || args[0] != "rotate" {
+		return fmt.Errorf("usage: psid rotate | psid reindex")
+	}
+
+	rotated, err := repositories.NewHardRepository().RotatePsidKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("rotated %d record(s) before failing: %w", rotated, err)
+	}
+
+	fmt.Printf("Re-encrypted %d PSID(s) with key %s\n", rotated, cfg.PsidEncryption.ActiveKey)
+	return nil
+}
+
+func readerToken(ctx context.Context, cfg *config.Config, args []string) error {
+	tokens, err := services.NewKeyedDecryptService(cfg.ServerConfig.SecretKey, cfg.ServerConfig.ReaderTokenKeys, cfg.ServerConfig.ReaderTokenActiveKey)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 2 && args[0] == "decode":
+		token, err := tokens.DecodeReaderToken(args[1])
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("inventory_id=%s nonce=%s expires=%s serials=%s\n",
+			token.InventoryID, token.Nonce, token.Expiry().Format(time.RFC3339), strings.Join(token.Serials(), ","))
+		return nil
+	case len(args) > 1 && args[0] == "encode":
+		nonce, err := services.NewReaderTokenNonce()
+		if err != nil {
+			return err
+		}
+
+		// the link is tracked from its first use like any externally issued token
+		token, err := tokens.EncodeReaderToken(services.ReaderToken{
+			SerialNumbers: args[1:],
+			ExpiresAt:     time.Now().Add(cfg.Webservice.PsidLinkTTL).Unix(),
+			Nonce:         nonce,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(token)
+		return nil
+	default:
+		return fmt.Errorf("usage: reader-token decode <token> | reader-token encode <serial>...")
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"scanner/internal/utils"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type CertificateHandler struct {
+	CertificateService *services.CertificateService
+}
+
+func NewCertificateHandler(certificateService *services.CertificateService) *CertificateHandler {
+	return &CertificateHandler{
+		CertificateService: certificateService,
+	}
+}
+
+func sendCertificate(c *fiber.Ctx, certificate *repositories.Certificate, pdf []byte) error {
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.pdf"`, certificate.Number))
+	c.Set("X-Certificate-Number", certificate.Number)
+	c.Set("X-Certificate-Hash", certificate.Hash)
+	return c.Send(pdf)
+}
+
+func certificateError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrHardNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	case errors.Is(err, services.ErrNotCertifiable):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to issue certificate: %v", err),
+		})
+	}
+}
+
+// IssueForHard issues a new certificate for a wiped drive and returns the PDF.
+func (h *CertificateHandler) IssueForHard(c *fiber.Ctx) error {
+	certificate, pdf, err := h.CertificateService.IssueForHard(c.Context(), c.Params("id"), utils.GetActor(c))
+	if err != nil {
+		return certificateError(c, err)
+	}
+
+	return sendCertificate(c, certificate, pdf)
+}
+
+// IssueForInventory issues one certificate covering every wiped drive of an
+// inventory batch. Drives that aren't wiped yet are listed in X-Skipped-Serials.
+func (h *CertificateHandler) IssueForInventory(c *fiber.Ctx) error {
+	certificate, pdf, skipped, err := h.CertificateService.IssueForInventory(c.Context(), c.Params("inventory_id"), utils.GetActor(c))
+	if errors.Is(err, services.ErrNotCertifiable) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":   err.Error(),
+			"skipped": skipped,
+		})
+	}
+
+	if err != nil {
+		return certificateError(c, err)
+	}
+
+	c.Set("X-Skipped-Count", strconv.Itoa(len(skipped)))
+	return sendCertificate(c, certificate, pdf)
+}
+
+func (h *CertificateHandler) ListForHard(c *fiber.Ctx) error {
+	certificates, err := h.CertificateService.ListForHard(c.Context(), c.Params("id"))
+	if err != nil {
+		return certificateError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      certificates,
+		"timestamp": time.Now(),
+	})
+}
+
+// Verify is public: anyone holding a certificate can check the printed hash.
+func (h *CertificateHandler) Verify(c *fiber.Ctx) error {
+	certificate, valid, err := h.CertificateService.Verify(c.Context(), c.Params("hash"))
+	if errors.Is(err, services.ErrCertificateNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Certificate not found",
+			"valid": false,
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to verify certificate: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"valid":     valid,
+		"data":      certificate,
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"scanner/internal/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type DuplicateHandler struct {
+	DuplicateService  *services.DuplicateService
+	PsidAccessService *services.PsidAccessService
+}
+
+func NewDuplicateHandler(duplicateService *services.DuplicateService) *DuplicateHandler {
+	return &DuplicateHandler{
+		DuplicateService:  duplicateService,
+		PsidAccessService: services.NewPsidAccessService(),
+	}
+}
+
+type DuplicateQuery struct {
+	Fuzzy bool `query:"fuzzy"`
+	Limit int  `query:"limit"`
+}
+
+func (h *DuplicateHandler) List(c *fiber.Ctx) error {
+	var req DuplicateQuery
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
+		})
+	}
+
+	if req.Limit <= 0 {
+		req.Limit = 100
+	}
+
+	clusters, err := h.DuplicateService.FindClusters(c.Context(), req.Fuzzy, req.Limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to find duplicates: %v", err),
+		})
+	}
+
+	for idx := range clusters {
+		for i := range clusters[idx].Hards {
+			clusters[idx].Hards[i].Images = imageUrls(clusters[idx].Hards[i].Images)
+		}
+
+		if clusters[idx].Proposal != nil {
+			clusters[idx].Proposal.Merged.Images = imageUrls(clusters[idx].Proposal.Merged.Images)
+		}
+	}
+
+	shown := []*repositories.Hard{}
+	for idx := range clusters {
+		shown = append(shown, hardPointers(clusters[idx].Hards)...)
+		if clusters[idx].Proposal != nil {
+			shown = append(shown, &clusters[idx].Proposal.Merged)
+		}
+	}
+
+	presentPsids(c, h.PsidAccessService, shown...)
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      clusters,
+		"timestamp": time.Now(),
+	})
+}
+
+type MergeRequest struct {
+	IDs    []string `json:"ids" form:"ids"`
+	DryRun bool     `json:"dry_run" form:"dry_run"`
+}
+
+func (h *DuplicateHandler) Merge(c *fiber.Ctx) error {
+	var req MergeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+	}
+
+	if req.DryRun {
+		proposal, err := h.DuplicateService.ProposeMerge(c.Context(), req.IDs)
+		if errors.Is(err, services.ErrMergeWipeHistory) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		proposal.Merged.Images = imageUrls(proposal.Merged.Images)
+		presentPsids(c, h.PsidAccessService, &proposal.Merged)
+		return c.JSON(fiber.Map{
+			"status":    "success",
+			"data":      proposal,
+			"timestamp": time.Now(),
+		})
+	}
+
+	hard, err := h.DuplicateService.Merge(c.Context(), req.IDs, utils.GetActor(c))
+	if errors.Is(err, services.ErrMergeWipeHistory) || errors.Is(err, repositories.ErrVersionConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to merge hards: %v", err),
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to merge hards: %v", err),
+		})
+	}
+
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"fmt"
+	"scanner/internal/repositories"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func hardETag(hard *repositories.Hard) string {
+	return fmt.Sprintf(`"%d"`, hard.Version)
+}
+
+// etagMatches reports whether an If-Match / If-None-Match header names the
+// current version of hard. An absent header always matches: the clients that
+// predate versioning send neither If-Match nor a version and must keep
+// working, so concurrency checks are opt-in. Such blind writes are still
+// applied atomically to the version they were read with, but may overwrite
+// an edit made since the client last fetched the record.
+func etagMatches(header string, hard *repositories.Hard) bool {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		version, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+		if err == nil && version == hard.Version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// versionConflict answers a stale write with the current state of the record
+// so the client can merge and retry.
+func (h *WebServiceHandler) versionConflict(c *fiber.Ctx, current *repositories.Hard) error {
+	current.Images = imageUrls(current.Images)
+	presentPsids(c, h.PsidAccessService, current)
+	c.Set(fiber.HeaderETag, hardETag(current))
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error":     "Hard was modified by someone else, reload and retry",
+		"data":      current,
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"scanner/internal/utils"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func (h *WebServiceHandler) AddImages(c *fiber.Ctx) error {
+	contentType := c.Get("Content-Type")
+	if contentType == "" || !strings.HasPrefix(strings.ToLower(contentType), "multipart/form-data") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":    "Content-Type must be multipart/form-data",
+			"received": contentType,
+		})
+	}
+
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if !etagMatches(c.Get(fiber.HeaderIfMatch), hard) {
+		return h.versionConflict(c, hard)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse multipart form: %v", err),
+		})
+	}
+
+	files := form.File["images"]
+	if len(files) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No images provided",
+		})
+	}
+
+	images := []string{}
+	for _, file := range files {
+		fileName := uuid.New().String() + filepath.Ext(file.Filename)
+		savePath := fmt.Sprintf("./uploads/%s", fileName)
+		if err := c.SaveFile(file, savePath); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save file: %v", err),
+			})
+		}
+
+		images = append(images, fileName)
+	}
+
+	err = h.ScanService.AddImages(c.Context(), hard, images, utils.GetActor(c))
+	if errors.Is(err, repositories.ErrVersionConflict) {
+		return h.currentVersionConflict(c)
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to add images: %v", err),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) DeleteImage(c *fiber.Ctx) error {
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if !etagMatches(c.Get(fiber.HeaderIfMatch), hard) {
+		return h.versionConflict(c, hard)
+	}
+
+	err = h.ScanService.RemoveImage(c.Context(), hard, c.Params("filename"), utils.GetActor(c))
+	if errors.Is(err, services.ErrImageNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Image not found",
+		})
+	}
+
+	if errors.Is(err, repositories.ErrVersionConflict) {
+		return h.currentVersionConflict(c)
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to remove image: %v", err),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+type ReorderImagesRequest struct {
+	Images []string `json:"images" form:"images"`
+}
+
+func (h *WebServiceHandler) ReorderImages(c *fiber.Ctx) error {
+	var req ReorderImagesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+	}
+
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if !etagMatches(c.Get(fiber.HeaderIfMatch), hard) {
+		return h.versionConflict(c, hard)
+	}
+
+	err = h.ScanService.ReorderImages(c.Context(), hard, req.Images, utils.GetActor(c))
+	if errors.Is(err, services.ErrImageNotFound) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if errors.Is(err, repositories.ErrVersionConflict) {
+		return h.currentVersionConflict(c)
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to reorder images: %v", err),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+// currentVersionConflict reloads the hard named in the path after a write lost
+// the race against a concurrent one.
+func (h *WebServiceHandler) currentVersionConflict(c *fiber.Ctx) error {
+	current, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	return h.versionConflict(c, current)
+}
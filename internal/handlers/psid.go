@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"scanner/internal/utils"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// presentPsids prepares hards for a response: PSIDs are masked unless the
+// caller holds psid:read, in which case the disclosure is written to the
+// access log first. If it can't be logged the PSIDs are masked anyway.
+func presentPsids(c *fiber.Ctx, access *services.PsidAccessService, hards ...*repositories.Hard) {
+	via := utils.GrantedBy(c, utils.PermissionPsidRead)
+	if via != "" {
+		ids := []primitive.ObjectID{}
+		for _, hard := range hards {
+			if hard.Psid != "" && !slices.Contains(ids, hard.ID) {
+				ids = append(ids, hard.ID)
+			}
+		}
+
+		if len(ids) == 0 {
+			return
+		}
+
+		err := access.Record(c.Context(), repositories.PsidAccess{
+			Actor:   utils.GetActor(c),
+			Via:     via,
+			Method:  c.Method(),
+			Path:    c.OriginalURL(),
+			IP:      utils.ClientIP(c),
+			HardIDs: ids,
+		})
+		if err == nil {
+			return
+		}
+
+		log.Printf("Failed to record PSID access, masking the response: %v", err)
+	}
+
+	for _, hard := range hards {
+		hard.Psid = utils.MaskPsid(hard.Psid)
+	}
+}
+
+func hardPointers(hards []repositories.Hard) []*repositories.Hard {
+	pointers := make([]*repositories.Hard, len(hards))
+	for i := range hards {
+		pointers[i] = &hards[i]
+	}
+
+	return pointers
+}
+
+type PsidAccessQuery struct {
+	HardID string `query:"hard_id"`
+	Limit  int64  `query:"limit"`
+}
+
+// PsidAccessLog lists unmasked PSID disclosures, newest first.
+func (h *WebServiceHandler) PsidAccessLog(c *fiber.Ctx) error {
+	var req PsidAccessQuery
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
+		})
+	}
+
+	accesses, err := h.PsidAccessService.List(c.Context(), req.HardID, req.Limit)
+	if errors.Is(err, services.ErrHardNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to load PSID access log: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      accesses,
+		"timestamp": time.Now(),
+	})
+}
@@ -2,67 +2,115 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
-	"scanner/config"
 	"scanner/internal/repositories"
 	"scanner/internal/services"
+	"scanner/internal/utils"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type ReaderHandler struct {
-	decodeService  *services.DecryptService
 	scanService    *services.ScanService
 	requestService *services.RequestService
 }
 
 func NewReaderHandler(scanService *services.ScanService, requestService *services.RequestService) *ReaderHandler {
-	cfg := config.GetConfig()
 	return &ReaderHandler{
-		decodeService:  services.NewDecryptService(cfg.ServerConfig.SecretKey),
 		scanService:    scanService,
 		requestService: requestService,
 	}
 }
 
-func validate(ctx context.Context, requestService *services.RequestService, token string) ([]string, error) {
-	serials, err := requestService.GetRequestByID(ctx, token)
-	if err != nil {
-		return nil, fmt.Errorf("invalid token")
-	}
+// validate accepts a request UUID or an encrypted reader token and returns the
+// id its progress is stored under along with the serials still open.
+func validate(ctx context.Context, requestService *services.RequestService, token string) (string, []string, error) {
+	return requestService.ResolveLink(ctx, token)
+}
 
-	if len(serials) == 0 {
-		return nil, fmt.Errorf("invalid token")
+// invalidLink tells the reader why its link can't be used. Expired, revoked
+// and completed links get their own code so the page can show a meaningful
+// message; only unknown links count towards the reader lockout.
+func invalidLink(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrRequestExpired):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Link has expired",
+			"code":  "link_expired",
+		})
+	case errors.Is(err, services.ErrRequestRevoked):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Link has been revoked",
+			"code":  "link_revoked",
+		})
+	case errors.Is(err, services.ErrRequestCompleted):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Link has been completed",
+			"code":  "link_completed",
+		})
+	case errors.Is(err, services.ErrRequestNotFound):
+		utils.CountReaderRejection(utils.RejectedInvalidLink)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Invalid token",
+			"code":  "invalid_token",
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to validate token",
+		})
 	}
-
-	return serials, nil
 }
 
+// Validate lists the serials still waiting for a PSID and, under completed,
+// those stored already, which the technician may correct while the link is
+// usable.
 func (h *ReaderHandler) Validate(c *fiber.Ctx) error {
-	token := c.Params("token")
-	serials, err := validate(c.Context(), h.requestService, token)
+	link, err := h.requestService.ResolveReaderLink(c.Context(), c.Params("token"))
 	if err != nil {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Invalid token",
-		})
+		return invalidLink(c, err)
+	}
+
+	completed := []fiber.Map{}
+	for _, condition := range link.Stored {
+		entry := fiber.Map{
+			"serial_number": condition.SerialNumber,
+			"hard_id":       condition.HardID,
+			"stored_at":     condition.StoredAt,
+		}
+
+		if n := len(condition.Attempts); n > 0 {
+			entry["psid"] = condition.Attempts[n-1].Psid
+			entry["psid_mismatch"] = condition.Attempts[n-1].PsidMismatch
+			entry["attempts"] = n
+		}
+
+		completed = append(completed, entry)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"serial_numbers": serials,
+		"serial_numbers": link.Pending,
+		"completed":      completed,
 	})
 }
 
+// Scan reads the PSID off a drive photo. Stored serials may be scanned again
+// to correct their PSID.
 func (h *ReaderHandler) Scan(c *fiber.Ctx) error {
-	token := c.Params("token")
-	serials, err := validate(c.Context(), h.requestService, token)
+	link, err := h.requestService.ResolveReaderLink(c.Context(), c.Params("token"))
 	if err != nil {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Invalid token",
-		})
+		return invalidLink(c, err)
+	}
+
+	serials := link.Pending
+	for _, condition := range link.Stored {
+		serials = append(serials, condition.SerialNumber)
 	}
 
 	contentType := c.Get("Content-Type")
@@ -98,6 +146,21 @@ func (h *ReaderHandler) Scan(c *fiber.Ctx) error {
 		})
 	}
 
+	// OCR calls are paid for, so each serial only gets a few
+	if err := h.requestService.ReserveScan(c.Context(), link.RequestID, serialNumber); err != nil {
+		if errors.Is(err, services.ErrScanLimitReached) {
+			utils.CountReaderRejection(utils.RejectedScanLimit)
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+				"code":  "scan_limit",
+			})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to record scan: %v", err),
+		})
+	}
+
 	ImageType := "hard"
 	ocrResponse, err := h.scanService.ScanFile(ImageType, files, "", "")
 	if err != nil {
@@ -106,36 +169,48 @@ func (h *ReaderHandler) Scan(c *fiber.Ctx) error {
 		})
 	}
 
-	file := files[0]
+	images := []string{}
+	for _, file := range files {
+		fileName := uuid.New().String() + filepath.Ext(file.Filename)
+		if err := c.SaveFile(file, fmt.Sprintf("./uploads/%s", fileName)); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to save file: %v", err),
+			})
+		}
+
+		images = append(images, fileName)
+	}
 
-	fileName := uuid.New().String() + filepath.Ext(file.Filename)
-	// Save the file to disk (you can choose your own path)
-	savePath := fmt.Sprintf("./uploads/%s", fileName)
-	if err := c.SaveFile(file, savePath); err != nil {
+	psid, _ := ocrResponse.Data["psid"].(string)
+	scan, err := h.requestService.RecordScan(c.Context(), link, serialNumber, images, psid)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Failed to save file: %v", err),
+			"error": fmt.Sprintf("Failed to record scan: %v", err),
 		})
 	}
 
 	return c.JSON(fiber.Map{
-		"psid":  ocrResponse.Data["psid"],
-		"image": fileName,
+		"scan_id": scan.ScanID,
+		"psid":    psid,
+		"images":  images,
+		// image is kept for readers that only show the first photo
+		"image": images[0],
 	})
 }
 
+// StoreRequest stores the PSID read from the scan ScanID, as confirmed or
+// typed in by the technician.
 type StoreRequest struct {
+	ScanID       string `json:"scan_id"`
 	Psid         string `json:"psid"`
-	Image        string `json:"image"`
 	SerialNumber string `json:"serial_number"`
 }
 
 func (h *ReaderHandler) Store(c *fiber.Ctx) error {
 	token := c.Params("token")
-	serials, err := validate(c.Context(), h.requestService, token)
+	requestID, serials, err := validate(c.Context(), h.requestService, token)
 	if err != nil {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Invalid token",
-		})
+		return invalidLink(c, err)
 	}
 
 	var requestData StoreRequest
@@ -152,41 +227,193 @@ func (h *ReaderHandler) Store(c *fiber.Ctx) error {
 		})
 	}
 
+	scan, err := h.requestService.TakeScan(c.Context(), requestData.ScanID, requestID, requestData.SerialNumber)
+	if err != nil {
+		return invalidScan(c, err)
+	}
+
+	stored := false
+	defer func() {
+		if !stored {
+			h.requestService.ReleaseScan(c.Context(), scan)
+		}
+	}()
+
 	hard, err := h.scanService.GetHardInfoByPsid(c.Context(), repositories.AddHardFilter{
 		SerialNumber: requestData.SerialNumber,
 		Psid:         requestData.Psid,
 	})
 
 	if err == nil && hard != nil {
+		if err := h.requestService.MarkConflict(c.Context(), requestID, requestData.SerialNumber, hard.ID); err != nil {
+			log.Printf("Failed to record conflict of %s for request %s: %v", requestData.SerialNumber, requestID, err)
+		}
+
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Hard with the same PSID and Serial Number already exists",
+		})
+	}
+
+	mismatch := services.PsidMismatch(scan, requestData.Psid)
+	hardData := services.AddHardResponse{
+		SerialNumber: requestData.SerialNumber,
+		Psid:         requestData.Psid,
+		PsidMismatch: mismatch,
+	}
+
+	hard, err = h.scanService.AddHard(c.Context(), hardData, scan.Images)
+	if errors.Is(err, repositories.ErrHardExists) {
+		if err := h.requestService.MarkConflict(c.Context(), requestID, requestData.SerialNumber, hard.ID); err != nil {
+			log.Printf("Failed to record conflict of %s for request %s: %v", requestData.SerialNumber, requestID, err)
+		}
+
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
 			"error": "Hard with the same PSID and Serial Number already exists",
 		})
 	}
 
-	err = h.requestService.UpdatePsidStore(c.Context(), token, requestData.SerialNumber)
 	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to store hard data: %v", err),
+		})
+	}
+
+	// the serial only counts as stored once its hard exists
+	completed, err := h.requestService.UpdatePsidStore(c.Context(), requestID, requestData.SerialNumber)
+	if err != nil {
+		if err := h.scanService.DiscardHard(c.Context(), hard); err != nil {
+			log.Printf("Failed to remove hard %s after storing %s for request %s failed: %v", hard.ID.Hex(), requestData.SerialNumber, requestID, err)
+		}
+
+		// the link may have been revoked or expired since it was validated
+		if _, _, err := validate(c.Context(), h.requestService, token); err != nil {
+			return invalidLink(c, err)
+		}
+
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to store psid",
 		})
 	}
 
-	// check psid exit in requestData
-	psid := requestData.Psid
-	image := requestData.Image
+	stored = true
+	if err := h.requestService.MarkStored(c.Context(), scan, requestData.Psid, hard.ID); err != nil {
+		log.Printf("Failed to link hard %s to request %s: %v", hard.ID.Hex(), requestID, err)
+	}
 
-	hardData := services.AddHardResponse{
-		SerialNumber: requestData.SerialNumber,
-		Psid:         psid,
+	if completed {
+		h.requestService.NotifyCompleted(c.Context(), requestID)
+	}
+
+	return c.JSON(fiber.Map{
+		"message":       "Hard data stored successfully",
+		"psid_mismatch": mismatch,
+	})
+}
+
+// invalidScan tells the reader the scan_id it sent can't be stored, usually
+// because it was used already; the drive has to be scanned again.
+func invalidScan(c *fiber.Ctx, err error) error {
+	if errors.Is(err, services.ErrScanNotFound) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Scan not found or already used, scan the drive again",
+			"code":  "invalid_scan",
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": fmt.Sprintf("Failed to look up scan: %v", err),
+	})
+}
+
+// Correct replaces the PSID stored for a serial of the link. The hard stored
+// first is kept, marked as having an incorrect PSID.
+func (h *ReaderHandler) Correct(c *fiber.Ctx) error {
+	link, err := h.requestService.ResolveReaderLink(c.Context(), c.Params("token"))
+	if err != nil {
+		return invalidLink(c, err)
+	}
+
+	var requestData StoreRequest
+	if err := c.BodyParser(&requestData); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+	}
+
+	if strings.TrimSpace(requestData.Psid) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "psid is required",
+		})
+	}
+
+	idx := slices.IndexFunc(link.Stored, func(condition repositories.SerialCondition) bool {
+		return condition.SerialNumber == requestData.SerialNumber
+	})
+	if idx < 0 || link.Stored[idx].HardID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Serial number has no stored PSID in this link",
+		})
 	}
 
-	_, err = h.scanService.AddHard(c.Context(), hardData, []string{image})
+	scan, err := h.requestService.TakeScan(c.Context(), requestData.ScanID, link.RequestID, requestData.SerialNumber)
 	if err != nil {
+		return invalidScan(c, err)
+	}
+
+	stored := false
+	defer func() {
+		if !stored {
+			h.requestService.ReleaseScan(c.Context(), scan)
+		}
+	}()
+
+	mismatch := services.PsidMismatch(scan, requestData.Psid)
+	hard, err := h.scanService.CorrectPsid(c.Context(), link.Stored[idx].HardID.Hex(), requestData.Psid, mismatch, scan.Images, "reader:"+link.RequestID)
+	switch {
+	case errors.Is(err, services.ErrPsidUnchanged):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, repositories.ErrHardExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Hard with the same PSID and Serial Number already exists",
+		})
+	case errors.Is(err, services.ErrHardNotFound):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The stored hard no longer exists",
+		})
+	case errors.Is(err, services.ErrWipeStarted):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, repositories.ErrVersionConflict):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The stored hard changed meanwhile, try again",
+		})
+	case err != nil:
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Failed to store hard data: %v", err),
+			"error": fmt.Sprintf("Failed to correct psid: %v", err),
 		})
 	}
 
+	stored = true
+	if err := h.requestService.MarkCorrected(c.Context(), scan, requestData.Psid, hard.ID); err != nil {
+		log.Printf("Failed to link hard %s to request %s: %v", hard.ID.Hex(), link.RequestID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message":       "Psid corrected successfully",
+		"hard_id":       hard.ID,
+		"psid_mismatch": mismatch,
+	})
+}
+
+// Metrics reports how many reader requests were rejected, by reason, since
+// the server started.
+func (h *ReaderHandler) Metrics(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
-		"message": "Hard data stored successfully",
+		"status":    "success",
+		"data":      fiber.Map{"rejections": utils.ReaderRejectionCounts()},
+		"timestamp": time.Now(),
 	})
 }
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"scanner/config"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// presentRequest reports the effective status and per-serial progress of a
+// request, with image file names turned into URLs.
+func presentRequest(request *repositories.Request) {
+	baseUrl := config.GetConfig().ServerConfig.BaseUrl
+	request.Status = request.EffectiveStatus()
+	for i := range request.SerialNumbers {
+		condition := &request.SerialNumbers[i]
+		condition.State = condition.Progress()
+
+		images := make([]string, 0, len(condition.Images))
+		for _, image := range condition.Images {
+			images = append(images, baseUrl+"/image/"+image)
+		}
+
+		condition.Images = images
+	}
+}
+
+// GetRequest reports the reader progress of a PSID link to the issuing system.
+func (h *WebServiceHandler) GetRequest(c *fiber.Ctx) error {
+	request, err := h.RequestService.GetRequest(c.Context(), c.Params("id"))
+	if errors.Is(err, services.ErrRequestNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Request not found",
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to load request: %v", err),
+		})
+	}
+
+	presentRequest(request)
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      request,
+		"timestamp": time.Now(),
+	})
+}
+
+type RequestListQuery struct {
+	Status string `query:"status"`
+	Limit  int64  `query:"limit"`
+}
+
+// ListRequests lists PSID links, newest first, optionally filtered by status
+// (active, expired, completed or revoked).
+func (h *WebServiceHandler) ListRequests(c *fiber.Ctx) error {
+	var req RequestListQuery
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
+		})
+	}
+
+	requests, err := h.RequestService.ListRequests(c.Context(), req.Status, req.Limit)
+	if errors.Is(err, services.ErrInvalidRequestStatus) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to list requests: %v", err),
+		})
+	}
+
+	for i := range requests {
+		presentRequest(&requests[i])
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      requests,
+		"timestamp": time.Now(),
+	})
+}
+
+type QRSheetRequest struct {
+	// Links are request UUIDs or encrypted reader tokens.
+	Links []string `json:"links"`
+}
+
+// QRSheet returns a printable PDF with a QR code for each reader link.
+func (h *WebServiceHandler) QRSheet(c *fiber.Ctx) error {
+	var req QRSheetRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+	}
+
+	if len(req.Links) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "links is required",
+		})
+	}
+
+	pdf, err := h.RequestService.QRSheet(c.Context(), req.Links)
+	switch {
+	case errors.Is(err, services.ErrRequestNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, services.ErrRequestExpired), errors.Is(err, services.ErrRequestRevoked), errors.Is(err, services.ErrRequestCompleted):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to render QR sheet: %v", err),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="reader-links.pdf"`)
+	return c.Send(pdf)
+}
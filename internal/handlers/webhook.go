@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"scanner/internal/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type WebhookHandler struct {
+	WebhookService *services.WebhookService
+}
+
+func NewWebhookHandler(webhookService *services.WebhookService) *WebhookHandler {
+	return &WebhookHandler{
+		WebhookService: webhookService,
+	}
+}
+
+type WebhookRequest struct {
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	RequestID string   `json:"request_id"`
+}
+
+// Subscribe registers a webhook. The response holds the signing secret, which
+// can't be retrieved later; subscribing the same URL again answers 200 with
+// the existing webhook and no secret.
+func (h *WebhookHandler) Subscribe(c *fiber.Ctx) error {
+	var req WebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+	}
+
+	subscription, created, err := h.WebhookService.Subscribe(c.Context(), req.URL, req.Events, req.RequestID, utils.GetActor(c))
+	if errors.Is(err, services.ErrInvalidWebhook) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to create webhook: %v", err),
+		})
+	}
+
+	status := fiber.StatusOK
+	if created {
+		status = fiber.StatusCreated
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"status":    "success",
+		"data":      subscription,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebhookHandler) List(c *fiber.Ctx) error {
+	subscriptions, err := h.WebhookService.Subscriptions(c.Context(), c.Query("request_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to list webhooks: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      subscriptions,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebhookHandler) Unsubscribe(c *fiber.Ctx) error {
+	err := h.WebhookService.Unsubscribe(c.Context(), c.Params("id"))
+	if errors.Is(err, services.ErrWebhookNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to delete webhook: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"timestamp": time.Now(),
+	})
+}
+
+type WebhookDeliveryQuery struct {
+	Status string `query:"status"`
+	Limit  int64  `query:"limit"`
+}
+
+// Deliveries lists webhook deliveries, newest first. status=dead is the
+// dead-letter list of deliveries that ran out of attempts.
+func (h *WebhookHandler) Deliveries(c *fiber.Ctx) error {
+	var req WebhookDeliveryQuery
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
+		})
+	}
+
+	switch req.Status {
+	case "", repositories.DeliveryPending, repositories.DeliveryDelivered, repositories.DeliveryDead:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "status must be pending, delivered or dead",
+		})
+	}
+
+	deliveries, err := h.WebhookService.Deliveries(c.Context(), req.Status, req.Limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to list webhook deliveries: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      deliveries,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebhookHandler) Redeliver(c *fiber.Ctx) error {
+	delivery, err := h.WebhookService.Redeliver(c.Context(), c.Params("id"))
+	if errors.Is(err, services.ErrWebhookDeliveryNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook delivery not found",
+		})
+	}
+
+	if errors.Is(err, repositories.ErrDeliveryDelivered) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to redeliver webhook: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      delivery,
+		"timestamp": time.Now(),
+	})
+}
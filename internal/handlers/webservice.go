@@ -7,14 +7,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"scanner/config"
 	"scanner/internal/repositories"
 	"scanner/internal/services"
+	"scanner/internal/utils"
 	"strings"
 	"time"
 
@@ -23,14 +26,18 @@ import (
 )
 
 type WebServiceHandler struct {
-	ScanService    *services.ScanService
-	RequestService *services.RequestService
+	ScanService       *services.ScanService
+	RequestService    *services.RequestService
+	PsidAccessService *services.PsidAccessService
+	WebhookService    *services.WebhookService
 }
 
 func NewWebServiceHandler(scanService *services.ScanService, requestService *services.RequestService) *WebServiceHandler {
 	return &WebServiceHandler{
-		ScanService:    scanService,
-		RequestService: requestService,
+		ScanService:       scanService,
+		RequestService:    requestService,
+		PsidAccessService: services.NewPsidAccessService(),
+		WebhookService:    services.NewWebhookService(),
 	}
 }
 
@@ -164,6 +171,7 @@ func (h *WebServiceHandler) Scan(c *fiber.Ctx) error {
 		hard.Images[index] = cfg.ServerConfig.BaseUrl + "/images/" + image
 	}
 
+	presentPsids(c, h.PsidAccessService, hard)
 	return c.JSON(fiber.Map{
 		"staus":     "success",
 		"data":      hard,
@@ -240,6 +248,7 @@ func (h *WebServiceHandler) ScanFile(c *fiber.Ctx) error {
 		hard.Images[index] = cfg.ServerConfig.BaseUrl + "/image/" + image
 	}
 
+	presentPsids(c, h.PsidAccessService, hard)
 	return c.JSON(fiber.Map{
 		"staus":     "success",
 		"data":      hard,
@@ -247,6 +256,17 @@ func (h *WebServiceHandler) ScanFile(c *fiber.Ctx) error {
 	})
 }
 
+// imageUrls turns stored image file names into public URLs.
+func imageUrls(images []string) []string {
+	cfg := config.GetConfig()
+	urls := []string{}
+	for _, image := range images {
+		urls = append(urls, cfg.ServerConfig.BaseUrl+"/image/"+image)
+	}
+
+	return urls
+}
+
 func (h *WebServiceHandler) GetImage(c *fiber.Ctx) error {
 	filename := c.Params("filename")
 	filePath := fmt.Sprintf("./uploads/%s", filename)
@@ -264,19 +284,35 @@ func (h *WebServiceHandler) GetImage(c *fiber.Ctx) error {
 
 func (h *WebServiceHandler) GetInfo(c *fiber.Ctx) error {
 	var req repositories.HardFilter
-	if err := c.BodyParser(&req); err != nil {
+	if err := c.QueryParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
 		})
 	}
 
-	hards, err := h.ScanService.GetHardInfoByHardFilter(c.Context(), &req)
+	// older integrations send the filter as a body on GET
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
+			})
+		}
+	}
+
+	page, err := h.ScanService.GetHardInfoByHardFilter(c.Context(), &req)
 	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidQuery) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to get hard info: %v", err),
 		})
 	}
 
+	hards := page.Hards
 	cfg := config.GetConfig()
 	for idx, hard := range hards {
 		images := []string{}
@@ -287,9 +323,79 @@ func (h *WebServiceHandler) GetInfo(c *fiber.Ctx) error {
 		hards[idx].Images = images
 	}
 
+	presentPsids(c, h.PsidAccessService, hardPointers(hards)...)
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"data":   hards,
+		"pagination": fiber.Map{
+			"total":       page.Total,
+			"limit":       page.Limit,
+			"next_cursor": page.NextCursor,
+			"has_more":    page.HasMore,
+		},
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) SearchHards(c *fiber.Ctx) error {
+	var req repositories.HardSearch
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse query parameters: %v", err),
+		})
+	}
+
+	// only callers that may read PSIDs may look records up by them
+	req.IncludePsid = utils.HasPermission(c, utils.PermissionPsidRead)
+
+	results, err := h.ScanService.SearchHards(c.Context(), &req)
+	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidQuery) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to search hards: %v", err),
+		})
+	}
+
+	found := []*repositories.Hard{}
+	for idx := range results {
+		results[idx].Hard.Images = imageUrls(results[idx].Hard.Images)
+		found = append(found, &results[idx].Hard)
+	}
+
+	presentPsids(c, h.PsidAccessService, found...)
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      results,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) ExtraFieldSchemas(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status":    "success",
-		"data":      hards,
+		"data":      services.ExtraFieldSchemas(),
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) ExtraFieldSchema(c *fiber.Ctx) error {
+	hardType, err := url.PathUnescape(c.Params("type"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid hard type",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      services.ExtraFieldSchema(hardType),
 		"timestamp": time.Now(),
 	})
 }
@@ -312,25 +418,30 @@ func (h *WebServiceHandler) AddHard(c *fiber.Ctx) error {
 		})
 	}
 
-	//check if exit error
-	hard, err := h.ScanService.GetHardInfoByPsid(c.Context(), repositories.AddHardFilter{
-		Psid:         req.Psid,
-		SerialNumber: req.SerialNumber,
-	})
+	hard, err := h.ScanService.AddHard(c.Context(), req, []string{})
+	var fieldsErr *services.ExtraFieldsError
+	if errors.As(err, &fieldsErr) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  "Extra fields do not match the schema of the hard type",
+			"fields": fieldsErr.Problems,
+		})
+	}
 
-	if err == nil && hard != nil {
+	if errors.Is(err, repositories.ErrHardExists) {
+		presentPsids(c, h.PsidAccessService, hard)
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": "Hard with the same InventoryID, Make, and SerialNumber already exists",
+			"error": "Hard with the same SerialNumber and Psid already exists",
+			"data":  hard,
 		})
 	}
 
-	hard, err = h.ScanService.AddHard(c.Context(), req, []string{})
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to add hard: %v", err),
 		})
 	}
 
+	presentPsids(c, h.PsidAccessService, hard)
 	return c.JSON(fiber.Map{
 		"status":    "success",
 		"data":      hard,
@@ -338,6 +449,31 @@ func (h *WebServiceHandler) AddHard(c *fiber.Ctx) error {
 	})
 }
 
+func (h *WebServiceHandler) GetHard(c *fiber.Ctx) error {
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	if c.Get(fiber.HeaderIfNoneMatch) != "" && etagMatches(c.Get(fiber.HeaderIfNoneMatch), hard) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+// EditHard replaces the editable fields of a hard. Clients opt into lost
+// update protection by sending If-Match or the version they edited; without
+// either the write goes through, see etagMatches.
 func (h *WebServiceHandler) EditHard(c *fiber.Ctx) error {
 	hardID := c.Params("id")
 	var req services.EditHardResponse
@@ -354,14 +490,58 @@ func (h *WebServiceHandler) EditHard(c *fiber.Ctx) error {
 		})
 	}
 
+	// the expected version comes from If-Match or, for clients that can't
+	// set headers, from the version field of the body
+	if !etagMatches(c.Get(fiber.HeaderIfMatch), hard) || (req.Version != nil && *req.Version != hard.Version) {
+		return h.versionConflict(c, hard)
+	}
+
+	if req.Psid != nil && !utils.HasPermission(c, utils.PermissionPsidRead) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": services.ErrPsidForbidden.Error(),
+		})
+	}
+
 	// update
-	err = h.ScanService.UpdateHard(c.Context(), hard, req)
+	err = h.ScanService.UpdateHard(c.Context(), hard, req, utils.GetActor(c))
+	if errors.Is(err, services.ErrMaskedPsid) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var fieldsErr *services.ExtraFieldsError
+	if errors.As(err, &fieldsErr) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  "Extra fields do not match the schema of the hard type",
+			"fields": fieldsErr.Problems,
+		})
+	}
+
+	if errors.Is(err, repositories.ErrHardExists) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Hard with the same SerialNumber and Psid already exists",
+		})
+	}
+
+	if errors.Is(err, repositories.ErrVersionConflict) {
+		current, err := h.ScanService.GetHardInfo(c.Context(), hardID)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Hard not found",
+			})
+		}
+
+		return h.versionConflict(c, current)
+	}
+
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to update hard: %v", err),
 		})
 	}
 
+	c.Set(fiber.HeaderETag, hardETag(hard))
 	if len(hard.Images) > 0 {
 		cfg := config.GetConfig()
 		for index, image := range hard.Images {
@@ -369,6 +549,91 @@ func (h *WebServiceHandler) EditHard(c *fiber.Ctx) error {
 		}
 	}
 
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+// PatchHard applies an RFC 7396 merge patch (application/merge-patch+json or
+// plain application/json) or an RFC 6902 JSON Patch
+// (application/json-patch+json) to a hard.
+func (h *WebServiceHandler) PatchHard(c *fiber.Ctx) error {
+	hardID := c.Params("id")
+	var format services.PatchFormat
+	mediaType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	switch mediaType {
+	case "application/merge-patch+json", fiber.MIMEApplicationJSON:
+		format = services.MergePatch
+	case "application/json-patch+json":
+		format = services.JSONPatch
+	default:
+		c.Set("Accept-Patch", "application/merge-patch+json, application/json-patch+json")
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Unsupported patch format",
+		})
+	}
+
+	hard, err := h.ScanService.GetHardInfo(c.Context(), hardID)
+	if err != nil || hard == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if !etagMatches(c.Get(fiber.HeaderIfMatch), hard) {
+		return h.versionConflict(c, hard)
+	}
+
+	psidAccess := utils.HasPermission(c, utils.PermissionPsidRead)
+	err = h.ScanService.PatchHard(c.Context(), hard, format, c.Body(), psidAccess, utils.GetActor(c))
+	var fieldsErr *services.ExtraFieldsError
+	switch {
+	case errors.Is(err, services.ErrPsidForbidden):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, services.ErrMaskedPsid):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.As(err, &fieldsErr):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":  "Extra fields do not match the schema of the hard type",
+			"fields": fieldsErr.Problems,
+		})
+	case errors.Is(err, utils.ErrPatchTestFailed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, utils.ErrInvalidPatch):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, repositories.ErrHardExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Hard with the same SerialNumber and Psid already exists",
+		})
+	case errors.Is(err, repositories.ErrVersionConflict):
+		current, err := h.ScanService.GetHardInfo(c.Context(), hardID)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Hard not found",
+			})
+		}
+
+		return h.versionConflict(c, current)
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to update hard: %v", err),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
 	return c.JSON(fiber.Map{
 		"status":    "success",
 		"data":      hard,
@@ -389,7 +654,19 @@ func (h *WebServiceHandler) WipeAccept(c *fiber.Ctx) error {
 		})
 	}
 
-	err := h.ScanService.WipeAccept(c.Context(), req.SerialNumber, req.Psid)
+	err := h.ScanService.WipeAccept(c.Context(), req.SerialNumber, req.Psid, utils.GetActor(c))
+	if errors.Is(err, repositories.ErrInvalidWipeTransition) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if errors.Is(err, repositories.ErrVersionConflict) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Hard was modified by someone else, please retry",
+		})
+	}
+
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to process Wipe accept",
@@ -405,6 +682,21 @@ func (h *WebServiceHandler) WipeAccept(c *fiber.Ctx) error {
 
 type GeneratePsidUrlRequest struct {
 	SerialNumbers []string `json:"serial_numbers" form:"serial_numbers"`
+	// ExpiresIn is a duration such as "48h"; PSID_LINK_TTL when empty.
+	ExpiresIn string `json:"expires_in" form:"expires_in"`
+	// Format "token" issues a self-contained encrypted link instead of a
+	// request UUID.
+	Format      string `json:"format" form:"format"`
+	InventoryID string `json:"inventory_id" form:"inventory_id"`
+	// CallbackURL is subscribed to the webhook events of the link, all of
+	// them unless CallbackEvents narrows them down.
+	CallbackURL    string   `json:"callback_url" form:"callback_url"`
+	CallbackEvents []string `json:"callback_events" form:"callback_events"`
+	// QR asks for a QR code of the reader URL, "png" or "svg".
+	QR string `json:"qr" form:"qr"`
+	// Overlap decides what happens to serial numbers already pending in
+	// another link: reject (default), split or merge.
+	Overlap string `json:"overlap" form:"overlap"`
 }
 
 func (h *WebServiceHandler) GeneratePsidUrl(c *fiber.Ctx) error {
@@ -415,32 +707,158 @@ func (h *WebServiceHandler) GeneratePsidUrl(c *fiber.Ctx) error {
 		})
 	}
 
-	request, err := h.RequestService.FindExistingSerialNumbers(c.Context(), req.SerialNumbers)
-	if err != nil && err.Error() != "mongo: no documents in result" {
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "expires_in must be a positive duration such as 48h",
+			})
+		}
+	}
+
+	if req.QR != "" && req.QR != "png" && req.QR != "svg" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "qr must be png or svg",
+		})
+	}
+
+	if req.CallbackURL != "" {
+		if err := services.ValidateWebhook(req.CallbackURL, req.CallbackEvents); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	if req.Format != "" && req.Format != "uuid" && req.Format != "token" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format must be uuid or token",
+		})
+	}
+
+	result, err := h.RequestService.OpenLink(c.Context(), services.LinkOptions{
+		SerialNumbers: req.SerialNumbers,
+		TTL:           ttl,
+		Overlap:       req.Overlap,
+		Token:         req.Format == "token",
+		InventoryID:   req.InventoryID,
+		Actor:         utils.GetActor(c),
+	})
+
+	var overlap *services.OverlapError
+	switch {
+	case errors.As(err, &overlap):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":     err.Error(),
+			"conflicts": overlap.Conflicts,
+		})
+	case errors.Is(err, services.ErrInvalidLinkTTL), errors.Is(err, services.ErrNoSerialNumbers), errors.Is(err, services.ErrInvalidOverlap):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case err != nil:
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to check existing serial numbers",
+			"error": fmt.Sprintf("Failed to generate PSID URLs: %v", err),
 		})
 	}
 
-	if request != nil {
-		return c.JSON(fiber.Map{
-			"status":     "success",
-			"request_id": request.UUid,
-			"timestamp":  time.Now(),
+	return h.psidLinkResponse(c, req, result)
+}
+
+// psidLinkResponse answers GeneratePsidUrl, subscribing the callback URL to
+// the events of the link first when one was given. Assignments tell where each
+// serial number went; without a request every serial stayed in the link it
+// was already pending in, so there is no link to subscribe a callback to.
+// expires_in_ignored tells that an existing link kept its own expiry.
+func (h *WebServiceHandler) psidLinkResponse(c *fiber.Ctx, req GeneratePsidUrlRequest, result *services.LinkResult) error {
+	response := fiber.Map{
+		"status":      "success",
+		"reused":      result.Reused,
+		"assignments": result.Assignments,
+		"timestamp":   time.Now(),
+	}
+
+	if result.TTLIgnored {
+		response["expires_in_ignored"] = true
+	}
+
+	request, token := result.Request, result.Token
+	if request == nil && req.CallbackURL != "" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":       "callback_url was not subscribed: every serial number is pending in another link, subscribe to those through /api/webservice/webhooks",
+			"assignments": result.Assignments,
+		})
+	}
+
+	if request == nil {
+		return c.JSON(response)
+	}
+
+	link := request.UUid
+	if token != "" {
+		link = token
+	}
+
+	response["request_id"] = request.UUid
+	response["url"] = services.ReaderURL(link)
+	response["expires_at"] = request.ExpiresAt
+
+	if token != "" {
+		response["token"] = token
+	}
+
+	if req.QR != "" {
+		qrCode, err := services.ReaderQRCode(link, req.QR)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to render QR code: %v", err),
+			})
+		}
+
+		response["qr_code"] = qrCode
+	}
+
+	if req.CallbackURL != "" {
+		subscription, created, err := h.WebhookService.Subscribe(c.Context(), req.CallbackURL, req.CallbackEvents, request.UUid, utils.GetActor(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to subscribe callback: %v", err),
+			})
+		}
+
+		// a reused link keeps its callback, whose secret was handed out already
+		response["callback_id"] = subscription.ID
+		if created {
+			response["callback_secret"] = subscription.Secret
+		}
+	}
+
+	return c.JSON(response)
+}
+
+// RevokePsidUrl disables a reader link immediately.
+func (h *WebServiceHandler) RevokePsidUrl(c *fiber.Ctx) error {
+	request, err := h.RequestService.RevokeRequest(c.Context(), c.Params("id"), utils.GetActor(c))
+	if errors.Is(err, services.ErrRequestNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Request not found",
 		})
 	}
 
-	psidUrl, err := h.RequestService.CreateRequest(c.Context(), req.SerialNumbers)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": fmt.Sprintf("Failed to generate PSID URLs: %v", err),
+			"error": fmt.Sprintf("Failed to revoke request: %v", err),
 		})
 	}
 
+	presentRequest(request)
+
 	return c.JSON(fiber.Map{
-		"status":     "success",
-		"request_id": psidUrl.UUid,
-		"timestamp":  time.Now(),
+		"status":    "success",
+		"data":      request,
+		"timestamp": time.Now(),
 	})
 }
 
@@ -483,3 +901,100 @@ func (h *WebServiceHandler) DeletePsid(c *fiber.Ctx) error {
 	})
 
 }
+
+type DeleteHardRequest struct {
+	Reason string `json:"reason" form:"reason"`
+}
+
+func (h *WebServiceHandler) DeleteHard(c *fiber.Ctx) error {
+	var req DeleteHardRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to parse request body: %v", err),
+			})
+		}
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A reason is required to delete a hard",
+		})
+	}
+
+	hard, err := h.ScanService.DeleteHard(c.Context(), c.Params("id"), req.Reason, utils.GetActor(c))
+	if errors.Is(err, services.ErrHardNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to delete hard: %v", err),
+		})
+	}
+
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) RestoreHard(c *fiber.Ctx) error {
+	hard, err := h.ScanService.RestoreHard(c.Context(), c.Params("id"), utils.GetActor(c))
+	switch {
+	case errors.Is(err, services.ErrHardNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	case errors.Is(err, services.ErrHardNotDeleted):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Hard is not deleted",
+		})
+	case errors.Is(err, services.ErrHardRetired):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, repositories.ErrHardExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An active hard with the same SerialNumber and Psid exists",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to restore hard: %v", err),
+		})
+	}
+
+	hard.Images = imageUrls(hard.Images)
+	presentPsids(c, h.PsidAccessService, hard)
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      hard,
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) PurgeHard(c *fiber.Ctx) error {
+	err := h.ScanService.PurgeHard(c.Context(), c.Params("id"), utils.GetActor(c))
+	if errors.Is(err, services.ErrHardNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to purge hard: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"message":   "Hard purged successfully",
+		"timestamp": time.Now(),
+	})
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"scanner/internal/services"
+	"scanner/internal/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func wipeStateData(hard *repositories.Hard) fiber.Map {
+	return fiber.Map{
+		"id":          hard.ID,
+		"state":       hard.WipeState,
+		"method":      hard.WipeMethod,
+		"transitions": hard.WipeTransitions,
+		"next":        hard.WipeState.Next(),
+		"version":     hard.Version,
+	}
+}
+
+func (h *WebServiceHandler) GetWipeState(c *fiber.Ctx) error {
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      wipeStateData(hard),
+		"timestamp": time.Now(),
+	})
+}
+
+type WipeTransitionRequest struct {
+	State  string `json:"state" form:"state"`
+	Method string `json:"method" form:"method"`
+	Note   string `json:"note" form:"note"`
+}
+
+// TransitionWipe advances the wipe workflow of a hard, e.g.
+// {"state": "wiped", "method": "crypto_erase"}.
+func (h *WebServiceHandler) TransitionWipe(c *fiber.Ctx) error {
+	var req WipeTransitionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+	}
+
+	state := repositories.WipeState(req.State)
+	if !state.Valid() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":  fmt.Sprintf("Unknown wipe state %q", req.State),
+			"states": repositories.WipeStates,
+		})
+	}
+
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	if !etagMatches(c.Get(fiber.HeaderIfMatch), hard) {
+		return h.versionConflict(c, hard)
+	}
+
+	err = h.ScanService.TransitionWipe(c.Context(), hard, state, req.Method, req.Note, utils.GetActor(c))
+	switch {
+	case errors.Is(err, services.ErrInvalidWipeMethod):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, repositories.ErrInvalidWipeTransition):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+			"next":  hard.WipeState.Next(),
+		})
+	case errors.Is(err, repositories.ErrVersionConflict):
+		return h.currentVersionConflict(c)
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to update wipe state: %v", err),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, hardETag(hard))
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      wipeStateData(hard),
+		"timestamp": time.Now(),
+	})
+}
+
+func (h *WebServiceHandler) GetWipeEvents(c *fiber.Ctx) error {
+	hard, err := h.ScanService.GetHardInfo(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Hard not found",
+		})
+	}
+
+	events, err := h.ScanService.WipeEvents(c.Context(), hard)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to load wipe events: %v", err),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"data":      events,
+		"timestamp": time.Now(),
+	})
+}
+
+// VerifyWipeLog recomputes the wipe log hash chain and reports every break.
+func (h *WebServiceHandler) VerifyWipeLog(c *fiber.Ctx) error {
+	report, err := h.ScanService.VerifyWipeLog(c.Context())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to verify wipe log: %v", err),
+		})
+	}
+
+	status := fiber.StatusOK
+	if !report.Valid {
+		status = fiber.StatusConflict
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"status":    "success",
+		"data":      report,
+		"timestamp": time.Now(),
+	})
+}
@@ -1,7 +1,7 @@
 package middlewares
 
 import (
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
 	"scanner/config"
@@ -11,6 +11,10 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// WebserviceMiddleware authenticates webservice callers by API key. The key
+// decides the permissions: the admin key grants everything, the PSID key
+// grants psid:read. A bearer token may be sent alongside the key to act as
+// an OIDC user, whose permissions claim is honoured as well.
 func WebserviceMiddleware() func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		cfg := config.GetConfig()
@@ -21,46 +25,54 @@ func WebserviceMiddleware() func(*fiber.Ctx) error {
 			})
 		}
 
-		if headerAPI != cfg.Webservice.ApiKey {
+		isAdmin := cfg.Webservice.AdminApiKey != "" && headerAPI == cfg.Webservice.AdminApiKey
+		isPsidReader := cfg.Webservice.PsidApiKey != "" && headerAPI == cfg.Webservice.PsidApiKey
+		if headerAPI != cfg.Webservice.ApiKey && !isAdmin && !isPsidReader {
 			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid API key",
 			})
 		}
 
-		return c.Next()
-		ip := c.IP()
-		var ips []string
-		if strings.Contains(ip, ",") {
-			ips = strings.Split(ip, ",")
-			for i, ip := range ips {
-				ips[i] = strings.TrimSpace(ip)
-			}
-		} else {
-			ips = []string{strings.TrimSpace(ip)}
+		permissions := []string{}
+		if isAdmin || isPsidReader {
+			permissions = append(permissions, utils.PermissionPsidRead)
 		}
 
-		log.Println(ips)
-		err := checkClientIP(ips, cfg.Webservice.AllowedIPs)
-		if err != nil {
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
-				"error": err.Error(),
-			})
+		c.Locals("webservice_admin", isAdmin)
+		c.Locals("key_permissions", permissions)
+
+		if c.Get("Authorization") != "" {
+			claims, subject, err := verifyBearer(c)
+			if errors.Is(err, errTokenExpired) {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"message": "Token is expired",
+				})
+			}
+
+			if err != nil {
+				return err
+			}
+
+			c.Locals("claims", claims)
+			c.Locals("subject", subject)
 		}
 
 		return c.Next()
 	}
 }
 
-func checkClientIP(clientIps []string, allowedIPs []string) error {
-	for _, allowedIP := range allowedIPs {
-		for _, clientIp := range clientIps {
-			if clientIp == allowedIP {
-				return nil
-			}
+// WebserviceAdminMiddleware only lets through callers using the admin API key.
+// It must run after WebserviceMiddleware.
+func WebserviceAdminMiddleware() func(*fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if isAdmin, _ := c.Locals("webservice_admin").(bool); !isAdmin {
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{
+				"error": "Admin API key required",
+			})
 		}
-	}
 
-	return fmt.Errorf("invalid IP address")
+		return c.Next()
+	}
 }
 
 func OAuthMiddleware() fiber.Handler {
@@ -68,53 +80,70 @@ func OAuthMiddleware() fiber.Handler {
 		// Refresh OIDC config if needed (cached, non-blocking)
 		go utils.RefreshOIDCProviderIfNeeded(c.Context())
 
-		// Extract token from Authorization header
-		authHeader := c.Get("Authorization")
-		if authHeader == "" {
-			return fiber.NewError(fiber.StatusUnauthorized, "Missing Authorization header")
+		claims, subject, err := verifyBearer(c)
+		if errors.Is(err, errTokenExpired) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"message": "Token is expired",
+			})
 		}
 
-		// Check for Bearer token
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
-			return fiber.NewError(fiber.StatusUnauthorized, "Invalid Authorization header format")
+		if err != nil {
+			return err
 		}
 
-		tokenString := parts[1]
+		// Add claims to context for use in handlers
+		c.Locals("claims", claims)
+		c.Locals("subject", subject)
+
+		// Call the next handler
+		return c.Next()
+	}
+}
 
-		// Verify the token using go-oidc (verifies signature, expiry, issuer, etc.)
-		currentVerifier := utils.GetVerifier()
-		idToken, err := currentVerifier.Verify(c.Context(), tokenString)
-		if err != nil {
-			log.Printf("Token verification failed: %v", err)
-			if strings.Contains(err.Error(), "token is expired") {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"message": "Token is expired",
-				})
-			}
+var errTokenExpired = errors.New("token is expired")
 
-			log.Printf("Token verification failed: %v", err)
-			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
-		}
+// verifyBearer checks the bearer token of the request and returns its claims.
+// The returned error is the response to send when verification fails.
+func verifyBearer(c *fiber.Ctx) (*utils.TokenClaims, string, error) {
+	// Extract token from Authorization header
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Missing Authorization header")
+	}
 
-		// Extract custom claims (roles, permissions, etc.)
-		var claims utils.TokenClaims
-		if err := idToken.Claims(&claims); err != nil {
-			log.Printf("Failed to parse token claims: %v", err)
-			return fiber.NewError(fiber.StatusUnauthorized, "Invalid token claims")
-		}
+	// Check for Bearer token
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Invalid Authorization header format")
+	}
 
-		// Validate required scopes if configured
-		if err := utils.ValidateScopes(&claims); err != nil {
-			log.Printf("Scope validation failed: %v", err)
-			return fiber.NewError(fiber.StatusForbidden, "Insufficient scopes")
+	tokenString := parts[1]
+
+	// Verify the token using go-oidc (verifies signature, expiry, issuer, etc.)
+	currentVerifier := utils.GetVerifier()
+	idToken, err := currentVerifier.Verify(c.Context(), tokenString)
+	if err != nil {
+		log.Printf("Token verification failed: %v", err)
+		if strings.Contains(err.Error(), "token is expired") {
+			return nil, "", errTokenExpired
 		}
 
-		// Add claims to context for use in handlers
-		c.Locals("claims", &claims)
-		c.Locals("subject", idToken.Subject)
+		log.Printf("Token verification failed: %v", err)
+		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+	}
 
-		// Call the next handler
-		return c.Next()
+	// Extract custom claims (roles, permissions, etc.)
+	var claims utils.TokenClaims
+	if err := idToken.Claims(&claims); err != nil {
+		log.Printf("Failed to parse token claims: %v", err)
+		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "Invalid token claims")
 	}
+
+	// Validate required scopes if configured
+	if err := utils.ValidateScopes(&claims); err != nil {
+		log.Printf("Scope validation failed: %v", err)
+		return nil, "", fiber.NewError(fiber.StatusForbidden, "Insufficient scopes")
+	}
+
+	return &claims, idToken.Subject, nil
 }
@@ -0,0 +1,148 @@
+package middlewares
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"scanner/config"
+	"scanner/internal/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+// ReaderIPLimit limits the requests one IP makes to the reader endpoints.
+func ReaderIPLimit() fiber.Handler {
+	cfg := config.GetConfig().ReaderLimits
+	return readerLimiter(cfg.PerIP, cfg.Window, utils.RejectedRateLimitIP, func(c *fiber.Ctx) string {
+		return "reader:ip:" + utils.ClientIP(c)
+	})
+}
+
+// ReaderTokenLimit limits the requests made with one reader link, whatever IP
+// they come from. It must be attached to routes with a :token parameter. The
+// token is chosen by the caller, so it is keyed by its hash to bound the key
+// size; made up tokens only get fresh buckets, which ReaderIPLimit and
+// ReaderLockout bound.
+func ReaderTokenLimit() fiber.Handler {
+	cfg := config.GetConfig().ReaderLimits
+	return readerLimiter(cfg.PerToken, cfg.Window, utils.RejectedRateLimitToken, func(c *fiber.Ctx) string {
+		sum := sha256.Sum256([]byte(c.Params("token")))
+		return "reader:token:" + hex.EncodeToString(sum[:16])
+	})
+}
+
+func readerLimiter(max int, window time.Duration, reason string, key func(*fiber.Ctx) string) fiber.Handler {
+	if max <= 0 || window <= 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+
+	return limiter.New(limiter.Config{
+		Max:          max,
+		Expiration:   window,
+		KeyGenerator: key,
+		LimitReached: func(c *fiber.Ctx) error {
+			utils.CountReaderRejection(reason)
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Too many requests, try again later",
+				"code":  "rate_limited",
+			})
+		},
+	})
+}
+
+// ReaderLockout locks out IPs that keep sending invalid reader links, which
+// is what guessing links looks like. Expired, revoked and completed links
+// don't count.
+func ReaderLockout() fiber.Handler {
+	cfg := config.GetConfig().ReaderLimits
+	if cfg.LockoutFailures <= 0 || cfg.LockoutDuration <= 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+
+	lockout := &readerLockout{
+		maxFailures: cfg.LockoutFailures,
+		duration:    cfg.LockoutDuration,
+		entries:     map[string]*lockoutEntry{},
+	}
+
+	return func(c *fiber.Ctx) error {
+		ip := utils.ClientIP(c)
+		if wait := lockout.lockedFor(ip, time.Now()); wait > 0 {
+			utils.CountReaderRejection(utils.RejectedLockedOut)
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Too many invalid links, try again later",
+				"code":  "locked_out",
+			})
+		}
+
+		err := c.Next()
+		if err == nil && c.Response().StatusCode() == fiber.StatusForbidden {
+			lockout.fail(ip, time.Now())
+		}
+
+		return err
+	}
+}
+
+// lockoutSweepSize is the number of tracked IPs above which stale entries are
+// dropped.
+const lockoutSweepSize = 10000
+
+type lockoutEntry struct {
+	failures    int
+	since       time.Time
+	lockedUntil time.Time
+}
+
+type readerLockout struct {
+	maxFailures int
+	duration    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+func (l *readerLockout) lockedFor(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[ip]
+	if !ok || !now.Before(entry.lockedUntil) {
+		return 0
+	}
+
+	return entry.lockedUntil.Sub(now)
+}
+
+// fail counts an invalid link from ip and locks it out once maxFailures are
+// reached within duration.
+func (l *readerLockout) fail(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) > lockoutSweepSize {
+		for key, entry := range l.entries {
+			if now.Sub(entry.since) > l.duration && !now.Before(entry.lockedUntil) {
+				delete(l.entries, key)
+			}
+		}
+	}
+
+	entry, ok := l.entries[ip]
+	if !ok || now.Sub(entry.since) > l.duration {
+		entry = &lockoutEntry{since: now}
+		l.entries[ip] = entry
+	}
+
+	entry.failures++
+	if entry.failures >= l.maxFailures {
+		entry.failures = 0
+		entry.since = now
+		entry.lockedUntil = now.Add(l.duration)
+	}
+}
@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"regexp"
+	"scanner/internal/utils"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The functions below are copies of the helpers the migrations were released
+// with. A migration has to write the same thing when a fresh database replays
+// it years later, so it must not call into repositories or utils helpers that
+// may change; a behaviour change there gets a new migration instead. Only the
+// PSID cipher is used directly, as it defines the stored format itself.
+
+var frozenCapacityRe = regexp.MustCompile(`(?i)([0-9]+(?:[.,][0-9]+)?)\s*([KMGTP])?I?B?`)
+
+// frozenCapacityGB is utils.ParseCapacityGB as of migration 1.
+func frozenCapacityGB(s string) float64 {
+	match := frozenCapacityRe.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(strings.ReplaceAll(match[1], ",", "."), 64)
+	if err != nil {
+		return 0
+	}
+
+	switch strings.ToUpper(match[2]) {
+	case "K":
+		return value / 1000 / 1000
+	case "M":
+		return value / 1000
+	case "T":
+		return value * 1000
+	case "P":
+		return value * 1000 * 1000
+	default:
+		return value
+	}
+}
+
+var frozenOCRConfusions = strings.NewReplacer(
+	"O", "0",
+	"Q", "0",
+	"I", "1",
+	"L", "1",
+	"S", "5",
+	"B", "8",
+	"Z", "2",
+)
+
+// frozenFoldOCR is utils.FoldOCR as of migration 4.
+func frozenFoldOCR(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+
+	return frozenOCRConfusions.Replace(b.String())
+}
+
+// frozenSearchIndex is the search index of Hard.Derive as of migration 5:
+// the distinct folded values and their trigrams.
+func frozenSearchIndex(values []string) ([]string, []string) {
+	keys := []string{}
+	grams := []string{}
+	for _, value := range values {
+		folded := frozenFoldOCR(value)
+		if folded == "" {
+			continue
+		}
+
+		if !slices.Contains(keys, folded) {
+			keys = append(keys, folded)
+		}
+
+		for i := 0; i+3 <= len(folded); i++ {
+			if !slices.Contains(grams, folded[i:i+3]) {
+				grams = append(grams, folded[i:i+3])
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	sort.Strings(grams)
+	return keys, grams
+}
+
+// frozenBlindSearchIndex is frozenSearchIndex of the PSID with every entry
+// replaced by its blind index, as of migration 8.
+func frozenBlindSearchIndex(psidCipher *utils.PsidCipher, psid string) ([]string, []string) {
+	keys, grams := frozenSearchIndex([]string{psid})
+	for i := range keys {
+		keys[i] = psidCipher.BlindIndex(keys[i])
+	}
+
+	for i := range grams {
+		grams[i] = psidCipher.BlindIndex(grams[i])
+	}
+
+	sort.Strings(keys)
+	sort.Strings(grams)
+	return keys, grams
+}
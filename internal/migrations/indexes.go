@@ -0,0 +1,172 @@
+package migrations
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type collectionIndexes struct {
+	Collection string
+	Models     []mongo.IndexModel
+}
+
+// indexes are (re)created on every run. CreateMany is a no-op for an index that
+// already exists with the same name and options.
+var indexes = []collectionIndexes{
+	{
+		Collection: "hards",
+		Models: []mongo.IndexModel{
+			{
+				Keys: bson.D{{Key: "serial_number", Value: 1}, {Key: "psid_bidx", Value: 1}},
+				Options: options.Index().
+					SetName("serial_number_psid_bidx_unique").
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"active": true}),
+			},
+			{
+				Keys:    bson.D{{Key: "psid_bidx", Value: 1}},
+				Options: options.Index().SetName("psid_bidx"),
+			},
+			{
+				Keys:    bson.D{{Key: "serial_key", Value: 1}},
+				Options: options.Index().SetName("serial_key"),
+			},
+			{
+				Keys:    bson.D{{Key: "psid_kid", Value: 1}},
+				Options: options.Index().SetName("psid_kid").SetSparse(true),
+			},
+			{
+				Keys:    bson.D{{Key: "search_keys", Value: 1}},
+				Options: options.Index().SetName("search_keys"),
+			},
+			{
+				Keys:    bson.D{{Key: "search_grams", Value: 1}},
+				Options: options.Index().SetName("search_grams"),
+			},
+			{
+				Keys:    bson.D{{Key: "inventory_id", Value: 1}},
+				Options: options.Index().SetName("inventory_id"),
+			},
+			{
+				Keys:    bson.D{{Key: "wipe_state", Value: 1}},
+				Options: options.Index().SetName("wipe_state"),
+			},
+			{
+				Keys: bson.D{
+					{Key: "vipe_accepted", Value: -1},
+					{Key: "user_edited", Value: -1},
+					{Key: "_id", Value: 1},
+				},
+				Options: options.Index().SetName("listing_sort_legacy"),
+			},
+		},
+	},
+	{
+		Collection: "requests",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "uuid", Value: 1}},
+				Options: options.Index().SetName("uuid").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "serial_numbers.serial_number", Value: 1}},
+				Options: options.Index().SetName("serial_numbers_serial_number"),
+			},
+			{
+				Keys:    bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}},
+				Options: options.Index().SetName("status_created_at"),
+			},
+			{
+				// expired links are kept for a week so readers get "expired"
+				// rather than "invalid" before the document disappears
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(7 * 24 * 60 * 60),
+			},
+		},
+	},
+	{
+		Collection: "certificates",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "hash", Value: 1}},
+				Options: options.Index().SetName("hash").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "number", Value: 1}},
+				Options: options.Index().SetName("number").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "entries.hard_id", Value: 1}},
+				Options: options.Index().SetName("entries_hard_id"),
+			},
+		},
+	},
+	{
+		Collection: "wipe_events",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "seq", Value: 1}},
+				Options: options.Index().SetName("seq").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "hard_id", Value: 1}, {Key: "seq", Value: 1}},
+				Options: options.Index().SetName("hard_id_seq"),
+			},
+			{
+				// events appended by instances predating the field have none
+				Keys: bson.D{{Key: "hard_id", Value: 1}, {Key: "transition", Value: 1}},
+				Options: options.Index().SetName("hard_id_transition").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"transition": bson.M{"$exists": true}}),
+			},
+		},
+	},
+	{
+		Collection: "reader_scans",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "scan_id", Value: 1}},
+				Options: options.Index().SetName("scan_id").SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(7 * 24 * 60 * 60),
+			},
+		},
+	},
+	{
+		Collection: "webhook_subscriptions",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "request_id", Value: 1}},
+				Options: options.Index().SetName("request_id"),
+			},
+		},
+	},
+	{
+		Collection: "webhook_deliveries",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+				Options: options.Index().SetName("status_next_attempt_at"),
+			},
+			{
+				Keys:    bson.D{{Key: "created_at", Value: -1}},
+				Options: options.Index().SetName("created_at"),
+			},
+		},
+	},
+	{
+		Collection: "psid_access_log",
+		Models: []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "at", Value: -1}},
+				Options: options.Index().SetName("at"),
+			},
+			{
+				Keys:    bson.D{{Key: "hard_ids", Value: 1}, {Key: "at", Value: -1}},
+				Options: options.Index().SetName("hard_ids_at"),
+			},
+		},
+	},
+}
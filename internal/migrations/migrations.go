@@ -0,0 +1,521 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"scanner/config"
+	"scanner/internal/repositories"
+	"scanner/internal/utils"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations must only ever be appended to; a released version is never
+// edited or renumbered because it is recorded as applied in every database.
+// Their logic is frozen too, see frozen.go.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "backfill_hard_timestamps_and_capacity",
+		Up:      backfillHardTimestampsAndCapacity,
+	},
+	{
+		Version: 2,
+		Name:    "copy_vipe_accepted_to_wipe_accepted",
+		Up:      copyVipeAcceptedToWipeAccepted,
+	},
+	{
+		Version: 3,
+		Name:    "deactivate_duplicate_serial_psid",
+		Up:      deactivateDuplicateSerialPsid,
+	},
+	{
+		Version: 4,
+		Name:    "backfill_hard_serial_key",
+		Up:      backfillHardSerialKey,
+	},
+	{
+		Version: 5,
+		Name:    "backfill_hard_search_index",
+		Up:      backfillHardSearchIndex,
+	},
+	{
+		Version: 6,
+		Name:    "backfill_hard_version",
+		Up:      backfillHardVersion,
+	},
+	{
+		Version: 7,
+		Name:    "backfill_hard_wipe_state",
+		Up:      backfillHardWipeState,
+	},
+	{
+		Version: 8,
+		Name:    "backfill_hard_psid_blind_index",
+		Up:      backfillHardPsidBlindIndex,
+	},
+	{
+		Version: 9,
+		Name:    "backfill_request_lifecycle",
+		Up:      backfillRequestLifecycle,
+	},
+	{
+		Version: 10,
+		Name:    "drop_wipe_accepted_listing_index",
+		Up:      dropWipeAcceptedListingIndex,
+	},
+	{
+		Version: 11,
+		Name:    "anchor_wipe_log_head",
+		Up:      anchorWipeLogHead,
+	},
+	{
+		Version: 12,
+		Name:    "number_wipe_event_transitions",
+		Up:      numberWipeEventTransitions,
+	},
+	{
+		Version: 13,
+		Name:    "drop_psid_search_grams",
+		Up:      dropPsidSearchGrams,
+	},
+}
+
+func backfillHardTimestampsAndCapacity(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+
+	_, err := hards.UpdateMany(ctx, bson.M{"created_at": bson.M{"$exists": false}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"created_at": bson.M{"$toDate": "$_id"}}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = hards.UpdateMany(ctx, bson.M{"updated_at": bson.M{"$exists": false}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"updated_at": "$created_at"}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := hards.Find(ctx, bson.M{"capacity_gb": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       interface{} `bson:"_id"`
+			Capacity string      `bson:"capacity"`
+		}
+
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		_, err := hards.UpdateByID(ctx, doc.ID, bson.M{
+			"$set": bson.M{"capacity_gb": frozenCapacityGB(doc.Capacity)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// copyVipeAcceptedToWipeAccepted moves the misspelled flag to its new key. The
+// old key is kept (and still written alongside the new one) until every
+// instance reads wipe_accepted; dropping it is a separate, later migration.
+func copyVipeAcceptedToWipeAccepted(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+
+	_, err := hards.UpdateMany(ctx, bson.M{"vipe_accepted": true, "wipe_accepted": bson.M{"$ne": true}}, bson.M{
+		"$set": bson.M{"wipe_accepted": true},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = hards.UpdateMany(ctx, bson.M{"wipe_accepted": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"wipe_accepted": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the listing index used to be built on the old key
+	return dropIndexIfExists(ctx, hards, "default_listing_sort")
+}
+
+func dropIndexIfExists(ctx context.Context, collection *mongo.Collection, name string) error {
+	_, err := collection.Indexes().DropOne(ctx, name)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+
+	return err
+}
+
+// deactivateDuplicateSerialPsid prepares the unique (serial_number, psid)
+// index: every record gets the active flag, and for each group of active
+// duplicates the best record (wipe accepted, then user edited, then oldest)
+// stays active and inherits the images of the others, which are marked as
+// merged into it.
+func deactivateDuplicateSerialPsid(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+
+	_, err := hards.UpdateMany(ctx, bson.M{"active": bson.M{"$exists": false}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"active": bson.M{"$ne": bson.A{"$incorrect_psid", true}}}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := hards.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"active": true}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "wipe_accepted", Value: -1},
+			{Key: "user_edited", Value: -1},
+			{Key: "_id", Value: 1},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"serial_number": "$serial_number", "psid": "$psid"},
+			"ids":    bson.M{"$push": "$_id"},
+			"images": bson.M{"$push": "$images"},
+			"count":  bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs    []primitive.ObjectID `bson:"ids"`
+			Images [][]string           `bson:"images"`
+		}
+
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+
+		winner := group.IDs[0]
+		images := []string{}
+		for _, list := range group.Images {
+			for _, image := range list {
+				if !slices.Contains(images, image) {
+					images = append(images, image)
+				}
+			}
+		}
+
+		_, err := hards.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": group.IDs[1:]}}, bson.M{
+			"$set": bson.M{
+				"active":      false,
+				"merged_into": winner,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = hards.UpdateByID(ctx, winner, bson.M{"$set": bson.M{"images": images}})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	// replaced by the unique, partial serial_number_psid_unique index
+	return dropIndexIfExists(ctx, hards, "serial_number_psid")
+}
+
+func backfillHardSerialKey(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+	cursor, err := hards.Find(ctx, bson.M{"serial_key": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID           primitive.ObjectID `bson:"_id"`
+			SerialNumber string             `bson:"serial_number"`
+		}
+
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		_, err := hards.UpdateByID(ctx, doc.ID, bson.M{
+			"$set": bson.M{"serial_key": frozenFoldOCR(doc.SerialNumber)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// backfillHardSearchIndex indexes the public fields for search. The PSID
+// entries it wrote when released were replaced by backfillHardPsidBlindIndex,
+// which every database runs next, so they are left to it.
+func backfillHardSearchIndex(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+	cursor, err := hards.Find(ctx, bson.M{"search_keys": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID           primitive.ObjectID     `bson:"_id"`
+			SerialNumber string                 `bson:"serial_number"`
+			PartNumber   string                 `bson:"part_number"`
+			Model        string                 `bson:"model"`
+			Eui          string                 `bson:"eui"`
+			ExtraFields  map[string]interface{} `bson:"extra_fields"`
+		}
+
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		values := []string{doc.SerialNumber, doc.PartNumber, doc.Model, doc.Eui}
+		for _, value := range doc.ExtraFields {
+			if str, ok := value.(string); ok {
+				values = append(values, str)
+			}
+		}
+
+		keys, grams := frozenSearchIndex(values)
+		_, err := hards.UpdateByID(ctx, doc.ID, bson.M{
+			"$set": bson.M{
+				"search_keys":  keys,
+				"search_grams": grams,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func backfillHardVersion(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("hards").UpdateMany(ctx, bson.M{"version": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"version": 1},
+	})
+
+	return err
+}
+
+// backfillHardWipeState places records that predate the wipe workflow on it:
+// accepted drives are queued for wiping, everything else was only received.
+func backfillHardWipeState(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+	missing := bson.M{"wipe_state": bson.M{"$exists": false}}
+
+	_, err := hards.UpdateMany(ctx, bson.M{"$and": bson.A{
+		missing,
+		bson.M{"$or": bson.A{bson.M{"wipe_accepted": true}, bson.M{"vipe_accepted": true}}},
+	}}, bson.M{
+		"$set": bson.M{"wipe_state": repositories.WipeQueued},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = hards.UpdateMany(ctx, missing, bson.M{
+		"$set": bson.M{"wipe_state": repositories.WipeReceived},
+	})
+
+	return err
+}
+
+// backfillHardPsidBlindIndex moves PSID lookups and uniqueness onto the blind
+// index and encrypts the PSIDs if a key is configured. Without one they stay
+// plaintext until `psid rotate` is run with a key.
+func backfillHardPsidBlindIndex(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+
+	// the old unique index would reject the records whose plaintext is removed
+	for _, name := range []string{"serial_number_psid_unique", "psid"} {
+		if err := dropIndexIfExists(ctx, hards, name); err != nil {
+			return err
+		}
+	}
+
+	cursor, err := hards.Find(ctx, bson.M{"psid_bidx": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	psidCipher := utils.GetPsidCipher()
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Psid string             `bson:"psid"`
+		}
+
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		keys, grams := frozenBlindSearchIndex(psidCipher, doc.Psid)
+		set := bson.M{
+			"psid":       doc.Psid,
+			"psid_bidx":  psidCipher.BlindIndex(doc.Psid),
+			"psid_keys":  keys,
+			"psid_grams": grams,
+		}
+
+		if psidCipher.Enabled() && doc.Psid != "" {
+			keyID, sealed, err := psidCipher.Encrypt(doc.Psid)
+			if err != nil {
+				return err
+			}
+
+			set["psid"], set["psid_enc"], set["psid_kid"] = "", sealed, keyID
+		}
+
+		if _, err := hards.UpdateByID(ctx, doc.ID, bson.M{"$set": set}); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// backfillRequestLifecycle gives links created before they could expire a
+// status and a fresh lifetime, counted from the deploy rather than from their
+// creation so links already handed out keep working for a while.
+func backfillRequestLifecycle(ctx context.Context, db *mongo.Database) error {
+	requests := db.Collection("requests")
+	missing := bson.M{"status": bson.M{"$exists": false}}
+
+	_, err := requests.UpdateMany(ctx, missing, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"created_at": bson.M{"$toDate": "$_id"},
+			"created_by": "",
+			"expires_at": time.Now().UTC().Add(config.GetConfig().Webservice.PsidLinkTTL),
+			"status": bson.M{"$cond": bson.A{
+				bson.M{"$in": bson.A{false, bson.M{"$ifNull": bson.A{"$serial_numbers.psid_store", bson.A{}}}}},
+				repositories.RequestActive,
+				repositories.RequestCompleted,
+			}},
+		}}},
+	})
+
+	return err
+}
+
+// dropWipeAcceptedListingIndex removes the listing index on wipe_accepted,
+// which sorted records written by instances predating the key wrongly; the
+// listing sorts on vipe_accepted until every instance writes both keys.
+func dropWipeAcceptedListingIndex(ctx context.Context, db *mongo.Database) error {
+	return dropIndexIfExists(ctx, db.Collection("hards"), "listing_default_sort")
+}
+
+// anchorWipeLogHead records the newest wipe event as the head of the chain,
+// which Append keeps up to date from now on.
+func anchorWipeLogHead(ctx context.Context, db *mongo.Database) error {
+	var last repositories.WipeEvent
+	err := db.Collection("wipe_events").FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})).Decode(&last)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection("wipe_log_head").UpdateOne(ctx, bson.M{"_id": repositories.WipeLogHeadID}, bson.M{
+		"$setOnInsert": bson.M{"seq": last.Seq, "hash": last.Hash, "updated_at": time.Now().UTC()},
+	}, options.Update().SetUpsert(true))
+
+	return err
+}
+
+// numberWipeEventTransitions gives the events logged before they were
+// numbered their position among the events of their hard.
+func numberWipeEventTransitions(ctx context.Context, db *mongo.Database) error {
+	events := db.Collection("wipe_events")
+	cursor, err := events.Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.D{{Key: "hard_id", Value: 1}, {Key: "seq", Value: 1}}).
+		SetProjection(bson.M{"hard_id": 1, "transition": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var hardID primitive.ObjectID
+	index := 0
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			HardID     primitive.ObjectID `bson:"hard_id"`
+			Transition *int               `bson:"transition"`
+		}
+
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+
+		if doc.HardID != hardID {
+			hardID, index = doc.HardID, 0
+		}
+
+		if doc.Transition == nil {
+			if _, err := events.UpdateByID(ctx, doc.ID, bson.M{"$set": bson.M{"transition": index}}); err != nil {
+				return err
+			}
+		}
+
+		index++
+	}
+
+	return cursor.Err()
+}
+
+// dropPsidSearchGrams removes the blinded PSID keys and trigrams written by
+// migration 8: the trigrams can be matched against a dictionary built from
+// chosen PSIDs, and the PSID is now only searched whole through psid_bidx.
+func dropPsidSearchGrams(ctx context.Context, db *mongo.Database) error {
+	hards := db.Collection("hards")
+	for _, name := range []string{"psid_keys", "psid_grams"} {
+		if err := dropIndexIfExists(ctx, hards, name); err != nil {
+			return err
+		}
+	}
+
+	_, err := hards.UpdateMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"psid_keys": bson.M{"$exists": true}},
+		bson.M{"psid_grams": bson.M{"$exists": true}},
+	}}, bson.M{"$unset": bson.M{"psid_keys": "", "psid_grams": ""}})
+	return err
+}
@@ -0,0 +1,239 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const historyCollection = "schema_migrations"
+
+const (
+	statusRunning = "running"
+	statusApplied = "applied"
+)
+
+const (
+	// heartbeatInterval is how often the instance applying a migration
+	// refreshes its claim, and how often others check on it.
+	heartbeatInterval = 15 * time.Second
+	// staleClaimAfter is how long a running claim may go without a heartbeat
+	// before it is taken to belong to a crashed process.
+	staleClaimAfter = 2 * time.Minute
+)
+
+var (
+	ErrStaleClaim = errors.New("migration claim is stale")
+	ErrNoClaim    = errors.New("migration is not claimed as running")
+)
+
+type AppliedMigration struct {
+	Version     int       `bson:"_id" json:"version"`
+	Name        string    `bson:"name" json:"name"`
+	Status      string    `bson:"status" json:"status"`
+	StartedAt   time.Time `bson:"started_at" json:"started_at"`
+	HeartbeatAt time.Time `bson:"heartbeat_at,omitempty" json:"heartbeat_at,omitempty"`
+	AppliedAt   time.Time `bson:"applied_at,omitempty" json:"applied_at"`
+}
+
+// lastSeen is when the instance holding a running claim was last alive.
+func (m *AppliedMigration) lastSeen() time.Time {
+	if m.HeartbeatAt.After(m.StartedAt) {
+		return m.HeartbeatAt
+	}
+
+	return m.StartedAt
+}
+
+// Run applies every pending data migration in version order and then makes
+// sure all declared indexes exist. It is safe to call on every boot and from
+// several instances at once: a migration is claimed by inserting its version
+// into schema_migrations, so only one instance executes it while the others
+// wait for it to finish. A claim left behind by a crashed process is reported
+// as ErrStaleClaim and has to be released with `migrate release <version>`.
+func Run(ctx context.Context, db *mongo.Database) error {
+	history := db.Collection(historyCollection)
+	for _, migration := range migrations {
+		err := apply(ctx, history, db, migration)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return EnsureIndexes(ctx, db)
+}
+
+func apply(ctx context.Context, history *mongo.Collection, db *mongo.Database, migration Migration) error {
+	now := time.Now().UTC()
+	_, err := history.InsertOne(ctx, AppliedMigration{
+		Version:     migration.Version,
+		Name:        migration.Name,
+		Status:      statusRunning,
+		StartedAt:   now,
+		HeartbeatAt: now,
+	})
+
+	if mongo.IsDuplicateKeyError(err) {
+		// already applied or being applied by another instance
+		return waitForClaim(ctx, history, db, migration)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Applying migration %d (%s)", migration.Version, migration.Name)
+	stop := heartbeat(ctx, history, migration.Version)
+	err = migration.Up(ctx, db)
+	stop()
+
+	if err != nil {
+		// release the claim so the next run retries it
+		_, _ = history.DeleteOne(ctx, bson.M{"_id": migration.Version})
+		return err
+	}
+
+	_, err = history.UpdateByID(ctx, migration.Version, bson.M{
+		"$set": bson.M{
+			"status":     statusApplied,
+			"applied_at": time.Now().UTC(),
+		},
+	})
+
+	return err
+}
+
+// heartbeat keeps the claim of a running migration fresh until stop is called.
+func heartbeat(ctx context.Context, history *mongo.Collection, version int) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := history.UpdateOne(ctx, bson.M{"_id": version, "status": statusRunning}, bson.M{
+					"$set": bson.M{"heartbeat_at": time.Now().UTC()},
+				})
+				if err != nil && ctx.Err() == nil {
+					log.Printf("Failed to refresh claim of migration %d: %v", version, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitForClaim returns once a migration claimed by another instance is
+// applied, so later migrations and indexes never run ahead of it.
+func waitForClaim(ctx context.Context, history *mongo.Collection, db *mongo.Database, migration Migration) error {
+	logged := false
+	for {
+		claim := AppliedMigration{}
+		err := history.FindOne(ctx, bson.M{"_id": migration.Version}).Decode(&claim)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// the other instance failed and released it, try ourselves
+			return apply(ctx, history, db, migration)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if claim.Status == statusApplied {
+			return nil
+		}
+
+		if time.Since(claim.lastSeen()) > staleClaimAfter {
+			return fmt.Errorf("%w: no heartbeat since %s; if no instance is applying it, check its effects and run `migrate release %d`",
+				ErrStaleClaim, claim.lastSeen().Format(time.RFC3339), migration.Version)
+		}
+
+		if !logged {
+			log.Printf("Waiting for migration %d (%s) to be applied by another instance", migration.Version, migration.Name)
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(heartbeatInterval):
+		}
+	}
+}
+
+// Release drops the running claim of a migration left behind by a crashed
+// process so the next run applies it again.
+func Release(ctx context.Context, db *mongo.Database, version int) error {
+	res, err := db.Collection(historyCollection).DeleteOne(ctx, bson.M{"_id": version, "status": statusRunning})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("%w: %d", ErrNoClaim, version)
+	}
+
+	return nil
+}
+
+func EnsureIndexes(ctx context.Context, db *mongo.Database) error {
+	for _, spec := range indexes {
+		_, err := db.Collection(spec.Collection).Indexes().CreateMany(ctx, spec.Models)
+		if err != nil {
+			return fmt.Errorf("indexes on %s: %w", spec.Collection, err)
+		}
+	}
+
+	return nil
+}
+
+// Status lists the migrations recorded in the database next to the ones that
+// are still pending.
+func Status(ctx context.Context, db *mongo.Database) ([]AppliedMigration, error) {
+	cursor, err := db.Collection(historyCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := []AppliedMigration{}
+	if err := cursor.All(ctx, &recorded); err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]AppliedMigration{}
+	for _, applied := range recorded {
+		byVersion[applied.Version] = applied
+	}
+
+	result := []AppliedMigration{}
+	for _, migration := range migrations {
+		applied, ok := byVersion[migration.Version]
+		if !ok {
+			applied = AppliedMigration{
+				Version: migration.Version,
+				Name:    migration.Name,
+				Status:  "pending",
+			}
+		}
+
+		result = append(result, applied)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package repositories
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"scanner/databases"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CertificateEntry is the sanitization record of one drive as it was when
+// the certificate was issued.
+type CertificateEntry struct {
+	HardID       primitive.ObjectID `bson:"hard_id" json:"hard_id"`
+	SerialNumber string             `bson:"serial_number" json:"serial_number"`
+	Make         string             `bson:"make" json:"make"`
+	Model        string             `bson:"model" json:"model"`
+	Type         string             `bson:"type" json:"hard_type"`
+	Capacity     string             `bson:"capacity" json:"capacity"`
+	InventoryID  string             `bson:"inventory_id" json:"inventory_id"`
+	WipeState    WipeState          `bson:"wipe_state" json:"wipe_state"`
+	Method       string             `bson:"method" json:"method"`
+	Operator     string             `bson:"operator" json:"operator"`
+	WipedAt      time.Time          `bson:"wiped_at" json:"wiped_at"`
+	VerifiedBy   string             `bson:"verified_by,omitempty" json:"verified_by,omitempty"`
+	VerifiedAt   *time.Time         `bson:"verified_at,omitempty" json:"verified_at,omitempty"`
+}
+
+type Certificate struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Number      string             `bson:"number" json:"number"`
+	InventoryID string             `bson:"inventory_id,omitempty" json:"inventory_id,omitempty"`
+	Entries     []CertificateEntry `bson:"entries" json:"entries"`
+	IssuedBy    string             `bson:"issued_by" json:"issued_by"`
+	IssuedAt    time.Time          `bson:"issued_at" json:"issued_at"`
+	// Hash is the SHA-256 of the certified content, printed on the document so
+	// a copy can be checked against the record.
+	Hash string `bson:"hash" json:"hash"`
+}
+
+// ComputeHash hashes the certified content. Timestamps are truncated to the
+// precision MongoDB stores so the hash survives a round trip.
+func (c *Certificate) ComputeHash() string {
+	entries := make([]CertificateEntry, len(c.Entries))
+	for i, entry := range c.Entries {
+		entry.WipedAt = entry.WipedAt.UTC().Truncate(time.Millisecond)
+		if entry.VerifiedAt != nil {
+			verifiedAt := entry.VerifiedAt.UTC().Truncate(time.Millisecond)
+			entry.VerifiedAt = &verifiedAt
+		}
+
+		entries[i] = entry
+	}
+
+	data, _ := json.Marshal(struct {
+		Number      string             `json:"number"`
+		InventoryID string             `json:"inventory_id"`
+		Entries     []CertificateEntry `json:"entries"`
+		IssuedBy    string             `json:"issued_by"`
+		IssuedAt    time.Time          `json:"issued_at"`
+	}{c.Number, c.InventoryID, entries, c.IssuedBy, c.IssuedAt.UTC().Truncate(time.Millisecond)})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type CertificateRepository struct {
+	collection *mongo.Collection
+}
+
+func NewCertificateRepository() *CertificateRepository {
+	return &CertificateRepository{
+		collection: databases.DB.Collection("certificates"),
+	}
+}
+
+func (r *CertificateRepository) Insert(ctx context.Context, certificate *Certificate) error {
+	_, err := r.collection.InsertOne(ctx, certificate)
+	return err
+}
+
+func (r *CertificateRepository) FindByHash(ctx context.Context, hash string) (*Certificate, error) {
+	var certificate Certificate
+	err := r.collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate, nil
+}
+
+// FindByHard lists the certificates that cover a drive, newest first.
+func (r *CertificateRepository) FindByHard(ctx context.Context, hardID primitive.ObjectID) ([]Certificate, error) {
+	certificates := []Certificate{}
+	cursor, err := r.collection.Find(ctx, bson.M{"entries.hard_id": hardID}, options.Find().SetSort(bson.D{{Key: "issued_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &certificates); err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
@@ -0,0 +1,160 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+type sortKey struct {
+	Field string
+	Desc  bool
+}
+
+// parseSort turns "-created_at,serial_number" into sort keys using the allowed
+// field map (public name -> bson field). _id is always appended as tie-breaker
+// so that every page boundary is unique.
+func parseSort(raw string, allowed map[string]string, fallback []sortKey) ([]sortKey, error) {
+	keys := []sortKey{}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		desc := false
+		if strings.HasPrefix(part, "-") {
+			desc = true
+			part = part[1:]
+		} else if strings.HasPrefix(part, "+") {
+			part = part[1:]
+		}
+
+		field, ok := allowed[part]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported sort field %q", ErrInvalidQuery, part)
+		}
+
+		if seen[field] {
+			continue
+		}
+
+		seen[field] = true
+		keys = append(keys, sortKey{Field: field, Desc: desc})
+	}
+
+	if len(keys) == 0 {
+		keys = append(keys, fallback...)
+		for _, key := range fallback {
+			seen[key.Field] = true
+		}
+	}
+
+	if !seen["_id"] {
+		keys = append(keys, sortKey{Field: "_id"})
+	}
+
+	return keys, nil
+}
+
+func sortDocument(keys []sortKey) bson.D {
+	sort := bson.D{}
+	for _, key := range keys {
+		direction := 1
+		if key.Desc {
+			direction = -1
+		}
+
+		sort = append(sort, bson.E{Key: key.Field, Value: direction})
+	}
+
+	return sort
+}
+
+// encodeCursor stores the sort values of the last document of a page. BSON is
+// used instead of JSON so that ObjectIDs, dates and numbers keep their types.
+func encodeCursor(doc bson.Raw, keys []sortKey) (string, error) {
+	values := bson.A{}
+	for _, key := range keys {
+		value, err := doc.LookupErr(key.Field)
+		if err != nil {
+			values = append(values, nil)
+			continue
+		}
+
+		values = append(values, value)
+	}
+
+	data, err := bson.Marshal(bson.D{{Key: "v", Value: values}})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, keys []sortKey) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	var decoded struct {
+		Values []interface{} `bson:"v"`
+	}
+
+	if err := bson.Unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	if len(decoded.Values) != len(keys) {
+		return nil, fmt.Errorf("%w: cursor does not match the requested sort", ErrInvalidQuery)
+	}
+
+	return decoded.Values, nil
+}
+
+// keysetFilter matches every document that sorts strictly after the cursor
+// values. Missing fields sort as null, which is lower than any other value, so
+// they come first in ascending and last in descending order.
+func keysetFilter(keys []sortKey, values []interface{}) bson.M {
+	clauses := bson.A{}
+	for i, key := range keys {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[keys[j].Field] = values[j]
+		}
+
+		value := values[i]
+		switch {
+		case value == nil && key.Desc:
+			// nothing sorts after null in descending order
+			continue
+		case value == nil:
+			clause[key.Field] = bson.M{"$ne": nil}
+		case key.Desc:
+			// null and missing values sort last in descending order
+			clause["$or"] = bson.A{
+				bson.M{key.Field: bson.M{"$lt": value}},
+				bson.M{key.Field: nil},
+			}
+		default:
+			clause[key.Field] = bson.M{"$gt": value}
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	if len(clauses) == 0 {
+		// impossible boundary, make sure the page is empty
+		return bson.M{"_id": bson.M{"$exists": false}}
+	}
+
+	return bson.M{"$or": clauses}
+}
@@ -0,0 +1,68 @@
+package repositories
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestKeysetFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   []sortKey
+		values []interface{}
+		want   bson.M
+	}{
+		{
+			name:   "ascending",
+			keys:   []sortKey{{Field: "serial_number"}, {Field: "_id"}},
+			values: []interface{}{"SN1", "id1"},
+			want: bson.M{"$or": bson.A{
+				bson.M{"serial_number": bson.M{"$gt": "SN1"}},
+				bson.M{"serial_number": "SN1", "_id": bson.M{"$gt": "id1"}},
+			}},
+		},
+		{
+			name:   "ascending from null",
+			keys:   []sortKey{{Field: "serial_number"}, {Field: "_id"}},
+			values: []interface{}{nil, "id1"},
+			want: bson.M{"$or": bson.A{
+				bson.M{"serial_number": bson.M{"$ne": nil}},
+				bson.M{"serial_number": nil, "_id": bson.M{"$gt": "id1"}},
+			}},
+		},
+		{
+			name:   "descending keeps nulls on later pages",
+			keys:   []sortKey{{Field: "created_at", Desc: true}, {Field: "_id"}},
+			values: []interface{}{"t1", "id1"},
+			want: bson.M{"$or": bson.A{
+				bson.M{"$or": bson.A{
+					bson.M{"created_at": bson.M{"$lt": "t1"}},
+					bson.M{"created_at": nil},
+				}},
+				bson.M{"created_at": "t1", "_id": bson.M{"$gt": "id1"}},
+			}},
+		},
+		{
+			name:   "descending from null",
+			keys:   []sortKey{{Field: "created_at", Desc: true}, {Field: "_id"}},
+			values: []interface{}{nil, "id1"},
+			want: bson.M{"$or": bson.A{
+				bson.M{"created_at": nil, "_id": bson.M{"$gt": "id1"}},
+			}},
+		},
+		{
+			name:   "nothing after a descending null",
+			keys:   []sortKey{{Field: "created_at", Desc: true}},
+			values: []interface{}{nil},
+			want:   bson.M{"_id": bson.M{"$exists": false}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := keysetFilter(tt.keys, tt.values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
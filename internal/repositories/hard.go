@@ -2,8 +2,12 @@ package repositories
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
 	"scanner/databases"
+	"scanner/internal/utils"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -23,22 +27,222 @@ var MainKeys = []string{
 	"eui",
 }
 
+var (
+	ErrHardExists      = errors.New("hard with the same serial number and psid already exists")
+	ErrVersionConflict = errors.New("hard was modified by someone else")
+)
+
 type Hard struct {
-	ID            primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
-	Capacity      string                 `bson:"capacity" json:"capacity"`
-	Eui           string                 `bson:"eui" json:"eui"`
-	Type          string                 `bson:"type" json:"hard_type"`
-	InventoryID   string                 `bson:"inventory_id" json:"inventory_id"`
-	Make          string                 `bson:"make" json:"make"`
-	Model         string                 `bson:"model" json:"model"`
-	PartNumber    string                 `bson:"part_number" json:"part_number"`
-	SerialNumber  string                 `bson:"serial_number" json:"serial_number"`
-	Psid          string                 `bson:"psid" json:"psid"`
-	ExtraFileds   map[string]interface{} `bson:"extra_fields" json:"extra_fields"`
-	Images        []string               `bson:"images" json:"images"`
-	WipeAccepted  bool                   `bson:"vipe_accepted" json:"wipe_accepted"`
-	UserEdited    bool                   `bson:"user_edited" json:"user_edited"`
-	IncorrectPsid bool                   `bson:"incorrect_psid" json:"-"`
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Capacity     string             `bson:"capacity" json:"capacity"`
+	Eui          string             `bson:"eui" json:"eui"`
+	Type         string             `bson:"type" json:"hard_type"`
+	InventoryID  string             `bson:"inventory_id" json:"inventory_id"`
+	Make         string             `bson:"make" json:"make"`
+	Model        string             `bson:"model" json:"model"`
+	PartNumber   string             `bson:"part_number" json:"part_number"`
+	SerialNumber string             `bson:"serial_number" json:"serial_number"`
+	// Psid is always plaintext in memory. When PSID encryption is configured
+	// it is stored only as PsidCipher, sealed with the key PsidKeyID, and
+	// looked up through the PsidIndex blind index.
+	Psid        string                 `bson:"psid" json:"psid"`
+	PsidCipher  string                 `bson:"psid_enc,omitempty" json:"-"`
+	PsidKeyID   string                 `bson:"psid_kid,omitempty" json:"-"`
+	PsidIndex   string                 `bson:"psid_bidx" json:"-"`
+	ExtraFields map[string]interface{} `bson:"extra_fields" json:"extra_fields"`
+	// QuarantinedFields keeps OCR values that don't fit the extra field schema
+	// of the hard type, so they can be reviewed instead of being lost.
+	QuarantinedFields map[string]interface{} `bson:"quarantined_fields,omitempty" json:"quarantined_fields,omitempty"`
+	Images            []string               `bson:"images" json:"images"`
+	WipeAccepted      bool                   `bson:"wipe_accepted" json:"wipe_accepted"`
+	// LegacyWipeAccepted mirrors WipeAccepted under the old misspelled key so
+	// that instances still reading vipe_accepted keep working during rollout.
+	LegacyWipeAccepted bool `bson:"vipe_accepted" json:"-"`
+	// WipeState is the position of the drive in the wipe workflow;
+	// WipeAccepted is kept in sync with it for older clients.
+	WipeState       WipeState        `bson:"wipe_state" json:"wipe_state"`
+	WipeMethod      string           `bson:"wipe_method,omitempty" json:"wipe_method,omitempty"`
+	WipeTransitions []WipeTransition `bson:"wipe_transitions,omitempty" json:"wipe_transitions,omitempty"`
+	UserEdited      bool             `bson:"user_edited" json:"user_edited"`
+	IncorrectPsid   bool             `bson:"incorrect_psid" json:"-"`
+	// PsidMismatch is set when the PSID stored through the reader differs
+	// from what OCR read off the drive photo.
+	PsidMismatch bool `bson:"psid_mismatch,omitempty" json:"psid_mismatch,omitempty"`
+	// Active is false for records that no longer take part in the
+	// (serial_number, psid) uniqueness constraint, e.g. incorrect PSIDs.
+	Active     bool                `bson:"active" json:"-"`
+	MergedInto *primitive.ObjectID `bson:"merged_into,omitempty" json:"merged_into,omitempty"`
+	// SerialKey is the OCR-folded serial number used to find likely duplicates.
+	SerialKey string      `bson:"serial_key" json:"-"`
+	History   []HardEvent `bson:"history,omitempty" json:"history,omitempty"`
+	// search_* hold OCR-folded values and their trigrams of the public fields.
+	// The PSID is only searchable whole, through PsidIndex.
+	SearchKeys  []string `bson:"search_keys" json:"-"`
+	SearchGrams []string `bson:"search_grams" json:"-"`
+	// DeletedAt is set on soft-deleted records, which are inactive until restored.
+	DeletedAt    *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedBy    string     `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`
+	DeleteReason string     `bson:"delete_reason,omitempty" json:"delete_reason,omitempty"`
+	CapacityGB   float64    `bson:"capacity_gb" json:"-"`
+	// Version is incremented by every write and used for optimistic locking.
+	Version   int64     `bson:"version" json:"version"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type HardEvent struct {
+	Action  string                 `bson:"action" json:"action"`
+	Actor   string                 `bson:"actor" json:"actor"`
+	At      time.Time              `bson:"at" json:"at"`
+	Details map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+func NewHardEvent(action, actor string, details map[string]interface{}) HardEvent {
+	return HardEvent{
+		Action:  action,
+		Actor:   actor,
+		At:      time.Now().UTC(),
+		Details: details,
+	}
+}
+
+// beforeSave keeps the derived and bookkeeping fields in sync with the record.
+func (h *Hard) beforeSave() error {
+	now := time.Now().UTC()
+	if h.CreatedAt.IsZero() {
+		h.CreatedAt = now
+		if !h.ID.IsZero() {
+			h.CreatedAt = h.ID.Timestamp().UTC()
+		}
+	}
+
+	h.UpdatedAt = now
+	if h.WipeState == "" {
+		h.WipeState = legacyWipeState(h.WipeAccepted)
+	}
+
+	h.LegacyWipeAccepted = h.WipeAccepted
+	h.Derive()
+	return h.SealPsid()
+}
+
+// SealPsid encrypts the PSID with the active key, or clears the ciphertext
+// when encryption isn't configured so the plaintext is stored instead.
+func (h *Hard) SealPsid() error {
+	psidCipher := utils.GetPsidCipher()
+	if !psidCipher.Enabled() || h.Psid == "" {
+		h.PsidCipher, h.PsidKeyID = "", ""
+		return nil
+	}
+
+	keyID, sealed, err := psidCipher.Encrypt(h.Psid)
+	if err != nil {
+		return err
+	}
+
+	h.PsidKeyID, h.PsidCipher = keyID, sealed
+	return nil
+}
+
+// Derive recomputes the fields that only exist to make the record searchable.
+func (h *Hard) Derive() {
+	h.CapacityGB = utils.ParseCapacityGB(h.Capacity)
+	h.SerialKey = utils.FoldOCR(h.SerialNumber)
+	h.SearchKeys, h.SearchGrams = buildSearchIndex(h.searchableValues())
+	h.PsidIndex = utils.GetPsidCipher().BlindIndex(h.Psid)
+}
+
+// PsidUpdate is the update that stores the PSID fields of h as they are in
+// memory; SealPsid and Derive must have run first.
+func (h *Hard) PsidUpdate() bson.M {
+	update := bson.M{
+		"$set": bson.M{
+			"psid":      h.Psid,
+			"psid_bidx": h.PsidIndex,
+		},
+	}
+
+	if h.PsidCipher == "" {
+		update["$unset"] = bson.M{"psid_enc": "", "psid_kid": ""}
+		return update
+	}
+
+	update["$set"].(bson.M)["psid"] = ""
+	update["$set"].(bson.M)["psid_enc"] = h.PsidCipher
+	update["$set"].(bson.M)["psid_kid"] = h.PsidKeyID
+	return update
+}
+
+// MarshalBSON leaves the plaintext PSID out of records that carry it
+// encrypted.
+func (h Hard) MarshalBSON() ([]byte, error) {
+	type hardAlias Hard
+	alias := hardAlias(h)
+	if alias.PsidCipher != "" {
+		alias.Psid = ""
+	}
+
+	return bson.Marshal(alias)
+}
+
+// UnmarshalBSON accepts both the current wipe_accepted key and the legacy
+// vipe_accepted key, which is still written by instances that predate it.
+func (h *Hard) UnmarshalBSON(data []byte) error {
+	type hardAlias Hard
+	if err := bson.Unmarshal(data, (*hardAlias)(h)); err != nil {
+		return err
+	}
+
+	if h.PsidCipher != "" {
+		psid, err := utils.GetPsidCipher().Decrypt(h.PsidKeyID, h.PsidCipher)
+		if err != nil {
+			return fmt.Errorf("hard %s: %w", h.ID.Hex(), err)
+		}
+
+		h.Psid = psid
+	}
+
+	h.WipeAccepted = h.WipeAccepted || h.LegacyWipeAccepted
+	if h.WipeState == "" {
+		h.WipeState = legacyWipeState(h.WipeAccepted)
+	}
+
+	// records written before the active flag existed
+	if _, err := bson.Raw(data).LookupErr("active"); err != nil {
+		h.Active = !h.IncorrectPsid
+	}
+
+	return nil
+}
+
+// legacyWipeState maps the old boolean onto the workflow for records written
+// before wipe_state existed.
+func legacyWipeState(accepted bool) WipeState {
+	if accepted {
+		return WipeQueued
+	}
+
+	return WipeReceived
+}
+
+// activeFilter also matches records that predate the active flag.
+func activeFilter() bson.M {
+	return bson.M{"$ne": false}
+}
+
+// wipeAcceptedFilter matches on both keys for the same reason.
+func wipeAcceptedFilter(accepted bool) bson.M {
+	if accepted {
+		return bson.M{"$or": bson.A{
+			bson.M{"wipe_accepted": true},
+			bson.M{"vipe_accepted": true},
+		}}
+	}
+
+	return bson.M{
+		"wipe_accepted": bson.M{"$ne": true},
+		"vipe_accepted": bson.M{"$ne": true},
+	}
 }
 
 type HardRepository struct {
@@ -52,9 +256,23 @@ func NewHardRepository() *HardRepository {
 }
 
 type HardFilter struct {
-	SerialNumber string `json:"serial_number" form:"serial_number"`
-	Make         string `json:"make" form:"make"`
-	InventoryID  string `json:"inventory_id" form:"inventory_id"`
+	SerialNumber string   `json:"serial_number" form:"serial_number" query:"serial_number"`
+	SerialMatch  string   `json:"serial_match" form:"serial_match" query:"serial_match"`
+	Make         string   `json:"make" form:"make" query:"make"`
+	InventoryID  string   `json:"inventory_id" form:"inventory_id" query:"inventory_id"`
+	Type         string   `json:"hard_type" form:"hard_type" query:"hard_type"`
+	CapacityMin  *float64 `json:"capacity_min" form:"capacity_min" query:"capacity_min"`
+	CapacityMax  *float64 `json:"capacity_max" form:"capacity_max" query:"capacity_max"`
+	WipeAccepted *bool    `json:"wipe_accepted" form:"wipe_accepted" query:"wipe_accepted"`
+	UserEdited   *bool    `json:"user_edited" form:"user_edited" query:"user_edited"`
+	WipeState    string   `json:"wipe_state" form:"wipe_state" query:"wipe_state"`
+	CreatedFrom  string   `json:"created_from" form:"created_from" query:"created_from"`
+	CreatedTo    string   `json:"created_to" form:"created_to" query:"created_to"`
+	UpdatedFrom  string   `json:"updated_from" form:"updated_from" query:"updated_from"`
+	UpdatedTo    string   `json:"updated_to" form:"updated_to" query:"updated_to"`
+	Sort         string   `json:"sort" form:"sort" query:"sort"`
+	Limit        int      `json:"limit" form:"limit" query:"limit"`
+	Cursor       string   `json:"cursor" form:"cursor" query:"cursor"`
 }
 
 type AddHardFilter struct {
@@ -62,45 +280,262 @@ type AddHardFilter struct {
 	Psid         string `json:"psid" form:"psid"`
 }
 
-func (r *HardRepository) FindByInput(ctx context.Context, data *HardFilter) ([]Hard, error) {
-	hards := []Hard{}
-	filer := make(map[string]interface{})
+type HardPage struct {
+	Hards      []Hard `json:"data"`
+	Total      int64  `json:"total"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+const (
+	defaultHardPageSize = 50
+	maxHardPageSize     = 500
+)
+
+// hardSortFields maps the public sort names to stored fields.
+var hardSortFields = map[string]string{
+	"created_at":    "_id",
+	"updated_at":    "updated_at",
+	"serial_number": "serial_number",
+	"make":          "make",
+	"model":         "model",
+	"hard_type":     "type",
+	"capacity":      "capacity_gb",
+	"inventory_id":  "inventory_id",
+	"wipe_accepted": "vipe_accepted",
+	"user_edited":   "user_edited",
+}
+
+// each record has wipe_accepted = true shoud be upper then records with user_edited = true then other records
+//
+// Sorting uses the legacy vipe_accepted key: instances from before the rename
+// write only that key and this one writes both, so it is correct on every
+// record while both run side by side. Upgrade order for moving the sort to
+// wipe_accepted: roll this release out everywhere, then ship a release with a
+// migration that copies vipe_accepted over again and switches this sort and
+// the listing_sort_legacy index.
+var defaultHardSort = []sortKey{
+	{Field: "vipe_accepted", Desc: true},
+	{Field: "user_edited", Desc: true},
+}
+
+func parseFilterTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid date %q, expected RFC3339 or YYYY-MM-DD", ErrInvalidQuery, value)
+	}
+
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	return t, nil
+}
+
+func (r *HardRepository) buildFilter(data *HardFilter) (bson.M, error) {
+	filter := bson.M{}
 	if data.SerialNumber != "" {
-		filer["serial_number"] = data.SerialNumber
+		switch data.SerialMatch {
+		case "", "exact":
+			filter["serial_number"] = data.SerialNumber
+		case "prefix":
+			filter["serial_number"] = bson.M{"$regex": "^" + regexp.QuoteMeta(data.SerialNumber)}
+		case "partial":
+			filter["serial_number"] = bson.M{"$regex": regexp.QuoteMeta(data.SerialNumber), "$options": "i"}
+		default:
+			return nil, fmt.Errorf("%w: serial_match must be exact, prefix or partial", ErrInvalidQuery)
+		}
 	}
 
 	if data.Make != "" {
-		filer["make"] = data.Make
+		filter["make"] = data.Make
 	}
 
 	if data.InventoryID != "" {
-		filer["inventory_id"] = data.InventoryID
+		filter["inventory_id"] = data.InventoryID
+	}
+
+	if data.Type != "" {
+		filter["type"] = data.Type
+	}
+
+	if data.WipeState != "" {
+		if !WipeState(data.WipeState).Valid() {
+			return nil, fmt.Errorf("%w: unknown wipe_state %q", ErrInvalidQuery, data.WipeState)
+		}
+
+		filter["wipe_state"] = data.WipeState
+	}
+
+	if data.CapacityMin != nil || data.CapacityMax != nil {
+		capacity := bson.M{}
+		if data.CapacityMin != nil {
+			capacity["$gte"] = *data.CapacityMin
+		}
+
+		if data.CapacityMax != nil {
+			capacity["$lte"] = *data.CapacityMax
+		}
+
+		filter["capacity_gb"] = capacity
+	}
+
+	and := bson.A{}
+	if data.WipeAccepted != nil {
+		and = append(and, wipeAcceptedFilter(*data.WipeAccepted))
+	}
+
+	if data.UserEdited != nil {
+		if *data.UserEdited {
+			filter["user_edited"] = true
+		} else {
+			filter["user_edited"] = bson.M{"$ne": true}
+		}
+	}
+
+	// created_at is derived from the ObjectID so records stored before the
+	// field existed are still matched
+	if data.CreatedFrom != "" || data.CreatedTo != "" {
+		created := bson.M{}
+		if data.CreatedFrom != "" {
+			from, err := parseFilterTime(data.CreatedFrom, false)
+			if err != nil {
+				return nil, err
+			}
+
+			created["$gte"] = primitive.NewObjectIDFromTimestamp(from)
+		}
+
+		if data.CreatedTo != "" {
+			to, err := parseFilterTime(data.CreatedTo, true)
+			if err != nil {
+				return nil, err
+			}
+
+			created["$lt"] = primitive.NewObjectIDFromTimestamp(to.Add(time.Second))
+		}
+
+		filter["_id"] = created
 	}
 
-	if data.Make == "" && data.SerialNumber == "" {
-		return nil, fmt.Errorf("serial number must be provided")
+	if data.UpdatedFrom != "" || data.UpdatedTo != "" {
+		updated := bson.M{}
+		if data.UpdatedFrom != "" {
+			from, err := parseFilterTime(data.UpdatedFrom, false)
+			if err != nil {
+				return nil, err
+			}
+
+			updated["$gte"] = from
+		}
+
+		if data.UpdatedTo != "" {
+			to, err := parseFilterTime(data.UpdatedTo, true)
+			if err != nil {
+				return nil, err
+			}
+
+			updated["$lte"] = to
+		}
+
+		filter["updated_at"] = updated
 	}
 
 	// Filter out records with incorrect_psid = false
-	filer["incorrect_psid"] = bson.M{"$ne": true}
+	filter["incorrect_psid"] = bson.M{"$ne": true}
+	filter["active"] = activeFilter()
 
-	// each record has vipe_accepted = true shoud be upper then records with user_edited = true then other records
-	findOptions := options.Find().SetSort(bson.D{
-		{Key: "vipe_accepted", Value: -1},
-		{Key: "user_edited", Value: -1},
-	})
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
 
-	cursor, err := r.collection.Find(ctx, filer, findOptions)
+	return filter, nil
+}
+
+func (r *HardRepository) FindByInput(ctx context.Context, data *HardFilter) (*HardPage, error) {
+	filter, err := r.buildFilter(data)
 	if err != nil {
 		return nil, err
 	}
 
-	err = cursor.All(ctx, &hards)
+	keys, err := parseSort(data.Sort, hardSortFields, defaultHardSort)
 	if err != nil {
 		return nil, err
 	}
 
-	return hards, nil
+	limit := data.Limit
+	if limit <= 0 {
+		limit = defaultHardPageSize
+	}
+
+	if limit > maxHardPageSize {
+		limit = maxHardPageSize
+	}
+
+	total, err := r.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := filter
+	if data.Cursor != "" {
+		values, err := decodeCursor(data.Cursor, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		query = bson.M{"$and": bson.A{filter, keysetFilter(keys, values)}}
+	}
+
+	findOptions := options.Find().
+		SetSort(sortDocument(keys)).
+		SetLimit(int64(limit + 1))
+
+	cursor, err := r.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	page := &HardPage{
+		Hards: []Hard{},
+		Total: total,
+		Limit: limit,
+	}
+
+	var last bson.Raw
+	for cursor.Next(ctx) {
+		if len(page.Hards) == limit {
+			page.HasMore = true
+			break
+		}
+
+		hard := Hard{}
+		if err := cursor.Decode(&hard); err != nil {
+			return nil, err
+		}
+
+		page.Hards = append(page.Hards, hard)
+		last = append(bson.Raw{}, cursor.Current...)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if page.HasMore && last != nil {
+		page.NextCursor, err = encodeCursor(last, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
 }
 
 func (r *HardRepository) FindByID(ctx context.Context, id string) (*Hard, error) {
@@ -121,11 +556,30 @@ func (r *HardRepository) FindByID(ctx context.Context, id string) (*Hard, error)
 	return hard, nil
 }
 
+// FindByInventoryID returns the active hards of an inventory batch ordered by
+// serial number.
+func (r *HardRepository) FindByInventoryID(ctx context.Context, inventoryID string) ([]Hard, error) {
+	hards := []Hard{}
+	cursor, err := r.collection.Find(ctx, bson.M{
+		"inventory_id": inventoryID,
+		"active":       activeFilter(),
+	}, options.Find().SetSort(bson.D{{Key: "serial_number", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &hards); err != nil {
+		return nil, err
+	}
+
+	return hards, nil
+}
+
 func (r *HardRepository) FindByPsid(ctx context.Context, data AddHardFilter) (*Hard, error) {
 	hard := &Hard{}
 	filter := make(map[string]interface{})
 	if data.Psid != "" {
-		filter["psid"] = data.Psid
+		filter["psid_bidx"] = utils.GetPsidCipher().BlindIndex(data.Psid)
 	}
 
 	if data.SerialNumber != "" {
@@ -136,6 +590,10 @@ func (r *HardRepository) FindByPsid(ctx context.Context, data AddHardFilter) (*H
 		return nil, fmt.Errorf("psid or serial number must be provided")
 	}
 
+	// deleted, merged and incorrect-PSID records are never matched
+	filter["incorrect_psid"] = bson.M{"$ne": true}
+	filter["active"] = activeFilter()
+
 	err := r.collection.FindOne(ctx, filter).Decode(&hard)
 
 	if err != nil {
@@ -145,48 +603,122 @@ func (r *HardRepository) FindByPsid(ctx context.Context, data AddHardFilter) (*H
 	return hard, nil
 }
 
-func (r *HardRepository) WipeAccepted(ctx context.Context, hard *Hard) error {
-	update := map[string]interface{}{
-		"$set": map[string]interface{}{
-			"vipe_accepted": true,
-		},
+func (r *HardRepository) Insert(ctx context.Context, hard *Hard) error {
+	hard.Active = true
+	hard.Version = 1
+	if err := hard.beforeSave(); err != nil {
+		return err
 	}
 
-	_, err := r.collection.UpdateOne(ctx, map[string]interface{}{
-		"_id": hard.ID,
-	}, update)
+	_, err := r.collection.InsertOne(ctx, hard)
+	return err
+}
 
-	if err != nil {
-		return err
+// Upsert atomically inserts hard unless an active record with the same serial
+// number and PSID exists, in which case that record is returned and created is
+// false. Uniqueness is guaranteed by the serial_number_psid_bidx_unique index.
+func (r *HardRepository) Upsert(ctx context.Context, hard *Hard) (*Hard, bool, error) {
+	if hard.ID.IsZero() {
+		hard.ID = primitive.NewObjectID()
 	}
 
-	return nil
+	hard.Active = true
+	hard.Version = 1
+	if err := hard.beforeSave(); err != nil {
+		return nil, false, err
+	}
+
+	filter := bson.M{
+		"serial_number": hard.SerialNumber,
+		"psid_bidx":     hard.PsidIndex,
+		"active":        true,
+	}
+
+	findOptions := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before)
+
+	for attempt := 0; attempt < 3; attempt++ {
+		existing := &Hard{}
+		err := r.collection.FindOneAndUpdate(ctx, filter, bson.M{"$setOnInsert": hard}, findOptions).Decode(existing)
+		if err == nil {
+			return existing, false, nil
+		}
+
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// nothing matched before the update, so our document was inserted
+			return hard, true, nil
+		}
+
+		// a concurrent upsert won the race; the next attempt finds its document
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, false, err
+		}
+	}
+
+	return nil, false, fmt.Errorf("failed to upsert hard %s after concurrent inserts", hard.SerialNumber)
 }
 
-func (r *HardRepository) Insert(ctx context.Context, hard *Hard) error {
-	_, err := r.collection.InsertOne(ctx, hard)
-	return err
+// versionFilter matches the record id if it is still at version expected.
+// Records written before versioning have no version field and count as 0.
+func versionFilter(id primitive.ObjectID, expected int64) bson.M {
+	if expected == 0 {
+		return bson.M{"_id": id, "$or": bson.A{
+			bson.M{"version": expected},
+			bson.M{"version": bson.M{"$exists": false}},
+		}}
+	}
+
+	return bson.M{"_id": id, "version": expected}
 }
 
+// Update replaces the record only if it still has the version hard was loaded
+// with, and fails with ErrVersionConflict otherwise. On success hard carries
+// the new version.
 func (r *HardRepository) Update(ctx context.Context, id string, hard *Hard) error {
 	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return err
 	}
 
+	expected := hard.Version
+	filter := versionFilter(objID, expected)
+
+	if err := hard.beforeSave(); err != nil {
+		return err
+	}
+
+	hard.Version = expected + 1
 	update := map[string]interface{}{
 		"$set": hard,
 	}
 
-	_, err = r.collection.UpdateByID(ctx, objID, update)
-	return err
+	res, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		hard.Version = expected
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrHardExists
+		}
+
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		hard.Version = expected
+		return ErrVersionConflict
+	}
+
+	return nil
 }
 
 func (r *HardRepository) DeleteByPsid(ctx context.Context, hard *Hard) error {
 	update := map[string]interface{}{
 		"$set": map[string]interface{}{
 			"incorrect_psid": true,
+			"active":         false,
+			"updated_at":     time.Now().UTC(),
 		},
+		"$inc": map[string]interface{}{"version": 1},
 	}
 
 	_, err := r.collection.UpdateOne(ctx, map[string]interface{}{
@@ -199,3 +731,308 @@ func (r *HardRepository) DeleteByPsid(ctx context.Context, hard *Hard) error {
 
 	return nil
 }
+
+// ReplacePsid retires a record whose PSID turned out to be wrong, noting in
+// its history which record replaces it. It fails with ErrVersionConflict when
+// the record changed since hard was loaded, e.g. by a concurrent correction.
+func (r *HardRepository) ReplacePsid(ctx context.Context, hard *Hard, event HardEvent) error {
+	filter := versionFilter(hard.ID, hard.Version)
+	filter["active"] = true
+	res, err := r.collection.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{
+			"incorrect_psid": true,
+			"active":         false,
+			"updated_at":     event.At,
+		},
+		"$push": bson.M{"history": event},
+		"$inc":  bson.M{"version": 1},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
+func (r *HardRepository) FindByIDs(ctx context.Context, ids []string) ([]Hard, error) {
+	objIDs := []primitive.ObjectID{}
+	for _, id := range ids {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, err
+		}
+
+		objIDs = append(objIDs, objID)
+	}
+
+	hards := []Hard{}
+	cursor, err := r.collection.Find(ctx, bson.M{"_id": bson.M{"$in": objIDs}})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cursor.All(ctx, &hards)
+	if err != nil {
+		return nil, err
+	}
+
+	return hards, nil
+}
+
+type DuplicateGroup struct {
+	Key string   `bson:"_id" json:"key"`
+	IDs []string `bson:"ids" json:"ids"`
+}
+
+// FindDuplicateGroups groups active records sharing a serial number. With
+// fuzzy set the OCR-folded serial key is used instead, which also catches
+// records whose serial was misread (O/0, I/1, ...).
+func (r *HardRepository) FindDuplicateGroups(ctx context.Context, fuzzy bool, limit int) ([]DuplicateGroup, error) {
+	key := "$serial_number"
+	if fuzzy {
+		key = "$serial_key"
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"active":        activeFilter(),
+			"serial_number": bson.M{"$nin": bson.A{"", nil}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   key,
+			"ids":   bson.M{"$push": bson.M{"$toString": "$_id"}},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []DuplicateGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// MarkMerged retires the given records in favour of winner. They stay in the
+// collection for auditing but are excluded from lookups and uniqueness. A
+// record that was deactivated or edited since it was loaded fails the merge
+// with ErrVersionConflict, and the records marked before it are put back.
+func (r *HardRepository) MarkMerged(ctx context.Context, hards []Hard, winner primitive.ObjectID, event HardEvent) error {
+	marked := []primitive.ObjectID{}
+	for _, hard := range hards {
+		filter := versionFilter(hard.ID, hard.Version)
+		filter["active"] = true
+		res, err := r.collection.UpdateOne(ctx, filter, bson.M{
+			"$set": bson.M{
+				"active":      false,
+				"merged_into": winner,
+				"updated_at":  event.At,
+			},
+			"$push": bson.M{"history": event},
+			"$inc":  bson.M{"version": 1},
+		})
+
+		if err == nil && res.MatchedCount == 0 {
+			err = ErrVersionConflict
+		}
+
+		if err != nil {
+			if undoErr := r.UnmarkMerged(ctx, marked, winner, event); undoErr != nil {
+				return fmt.Errorf("%w (and failed to restore the merged records: %v)", err, undoErr)
+			}
+
+			return err
+		}
+
+		marked = append(marked, hard.ID)
+	}
+
+	return nil
+}
+
+// UnmarkMerged undoes MarkMerged when the merge could not be completed,
+// reactivating the records and dropping the merge event from their history.
+func (r *HardRepository) UnmarkMerged(ctx context.Context, ids []primitive.ObjectID, winner primitive.ObjectID, event HardEvent) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// event.At has a finer precision than stored dates, so it can't be matched
+	_, err := r.collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "merged_into": winner}, bson.M{
+		"$set":   bson.M{"active": true, "updated_at": time.Now().UTC()},
+		"$unset": bson.M{"merged_into": ""},
+		"$pull":  bson.M{"history": bson.M{"action": event.Action, "details": event.Details}},
+		"$inc":   bson.M{"version": 1},
+	})
+
+	return err
+}
+
+func (r *HardRepository) SoftDelete(ctx context.Context, hard *Hard, event HardEvent) error {
+	_, err := r.collection.UpdateByID(ctx, hard.ID, bson.M{
+		"$set": bson.M{
+			"active":        false,
+			"deleted_at":    event.At,
+			"deleted_by":    event.Actor,
+			"delete_reason": event.Details["reason"],
+			"updated_at":    event.At,
+		},
+		"$push": bson.M{"history": event},
+		"$inc":  bson.M{"version": 1},
+	})
+
+	return err
+}
+
+// Restore reactivates a soft-deleted record. It fails with ErrHardExists when
+// an active record with the same serial number and PSID was stored meanwhile,
+// and with mongo.ErrNoDocuments when the record was merged or had its PSID
+// replaced, as those stay retired.
+func (r *HardRepository) Restore(ctx context.Context, hard *Hard, event HardEvent) error {
+	res, err := r.collection.UpdateOne(ctx, bson.M{
+		"_id":            hard.ID,
+		"merged_into":    bson.M{"$exists": false},
+		"incorrect_psid": bson.M{"$ne": true},
+	}, bson.M{
+		"$set": bson.M{
+			"active":     true,
+			"updated_at": event.At,
+		},
+		"$unset": bson.M{
+			"deleted_at":    "",
+			"deleted_by":    "",
+			"delete_reason": "",
+		},
+		"$push": bson.M{"history": event},
+		"$inc":  bson.M{"version": 1},
+	})
+
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrHardExists
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (r *HardRepository) Purge(ctx context.Context, hard *Hard) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": hard.ID})
+	return err
+}
+
+// CountImageReferences counts the other records using an image file, which
+// merged records may share.
+func (r *HardRepository) CountImageReferences(ctx context.Context, image string, exclude primitive.ObjectID) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{
+		"_id":    bson.M{"$ne": exclude},
+		"images": image,
+	})
+}
+
+// RotatePsidKeys re-encrypts every PSID that isn't sealed with the active key,
+// including plaintext ones, and returns how many records were rewritten. The
+// version isn't bumped because the record doesn't change for API clients.
+func (r *HardRepository) RotatePsidKeys(ctx context.Context) (int, error) {
+	psidCipher := utils.GetPsidCipher()
+	if !psidCipher.Enabled() {
+		return 0, fmt.Errorf("%w: PSID_ACTIVE_KEY is not configured", utils.ErrUnknownPsidKey)
+	}
+
+	cursor, err := r.collection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"psid_enc": bson.M{"$exists": true}, "psid_kid": bson.M{"$ne": psidCipher.ActiveKeyID()}},
+		bson.M{"psid_enc": bson.M{"$exists": false}, "psid": bson.M{"$nin": bson.A{"", nil}}},
+	}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	rotated := 0
+	for cursor.Next(ctx) {
+		hard := Hard{}
+		if err := cursor.Decode(&hard); err != nil {
+			return rotated, err
+		}
+
+		previous := hard.PsidKeyID
+		if err := hard.SealPsid(); err != nil {
+			return rotated, err
+		}
+
+		// skip the record if it was rewritten since it was read
+		filter := bson.M{"_id": hard.ID, "psid_kid": previous}
+		if previous == "" {
+			filter["psid_kid"] = bson.M{"$exists": false}
+		}
+
+		hard.Derive()
+		result, err := r.collection.UpdateOne(ctx, filter, hard.PsidUpdate())
+		if err != nil {
+			return rotated, err
+		}
+
+		rotated += int(result.ModifiedCount)
+	}
+
+	return rotated, cursor.Err()
+}
+
+// ReindexPsids recomputes the blind index of every PSID with the current
+// index key and returns how many records changed. Like RotatePsidKeys it
+// leaves the version alone.
+func (r *HardRepository) ReindexPsids(ctx context.Context) (int, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	psidCipher := utils.GetPsidCipher()
+	reindexed := 0
+	for cursor.Next(ctx) {
+		hard := Hard{}
+		if err := cursor.Decode(&hard); err != nil {
+			return reindexed, err
+		}
+
+		index := psidCipher.BlindIndex(hard.Psid)
+		if index == hard.PsidIndex {
+			continue
+		}
+
+		// skip the record if its PSID was rewritten since it was read
+		result, err := r.collection.UpdateOne(ctx, bson.M{"_id": hard.ID, "psid_bidx": hard.PsidIndex}, bson.M{
+			"$set": bson.M{"psid_bidx": index},
+		})
+		if err != nil {
+			return reindexed, err
+		}
+
+		reindexed += int(result.ModifiedCount)
+	}
+
+	return reindexed, cursor.Err()
+}
@@ -0,0 +1,110 @@
+package repositories_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"scanner/databases"
+	"scanner/internal/migrations"
+	"scanner/internal/repositories"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase connects to the MongoDB at MONGODB_TEST_URI and returns a
+// scratch database with the declared indexes, dropped when the test ends.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	db := client.Database(fmt.Sprintf("scanner_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+
+	if err := migrations.EnsureIndexes(ctx, db); err != nil {
+		t.Fatalf("indexes: %v", err)
+	}
+
+	databases.DB = db
+	return db
+}
+
+func TestUpsertConcurrentDuplicates(t *testing.T) {
+	db := testDatabase(t)
+	repo := repositories.NewHardRepository()
+
+	const workers = 32
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int32
+		start   = make(chan struct{})
+		errs    = make(chan error, workers)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			_, ok, err := repo.Upsert(context.Background(), &repositories.Hard{
+				SerialNumber: "SN-RACE-1",
+				Psid:         "PSID0000RACE0001",
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if ok {
+				created.Add(1)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("upsert: %v", err)
+	}
+
+	if n := created.Load(); n != 1 {
+		t.Errorf("%d upserts reported creating the record, want 1", n)
+	}
+
+	count, err := db.Collection("hards").CountDocuments(context.Background(), bson.M{
+		"serial_number": "SN-RACE-1",
+		"active":        true,
+	})
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("%d active records, want 1", count)
+	}
+}
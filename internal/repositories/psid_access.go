@@ -0,0 +1,63 @@
+package repositories
+
+import (
+	"context"
+	"scanner/databases"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PsidAccess records one response that disclosed unmasked PSIDs.
+type PsidAccess struct {
+	ID      primitive.ObjectID   `bson:"_id" json:"id"`
+	Actor   string               `bson:"actor" json:"actor"`
+	Via     string               `bson:"via" json:"via"`
+	Method  string               `bson:"method" json:"method"`
+	Path    string               `bson:"path" json:"path"`
+	IP      string               `bson:"ip" json:"ip"`
+	HardIDs []primitive.ObjectID `bson:"hard_ids" json:"hard_ids"`
+	At      time.Time            `bson:"at" json:"at"`
+}
+
+type PsidAccessRepository struct {
+	collection *mongo.Collection
+}
+
+func NewPsidAccessRepository() *PsidAccessRepository {
+	return &PsidAccessRepository{
+		collection: databases.DB.Collection("psid_access_log"),
+	}
+}
+
+func (r *PsidAccessRepository) Insert(ctx context.Context, access *PsidAccess) error {
+	if access.ID.IsZero() {
+		access.ID = primitive.NewObjectID()
+	}
+
+	_, err := r.collection.InsertOne(ctx, access)
+	return err
+}
+
+// Find lists disclosures, newest first, optionally only those of one hard.
+func (r *PsidAccessRepository) Find(ctx context.Context, hardID *primitive.ObjectID, limit int64) ([]PsidAccess, error) {
+	filter := bson.M{}
+	if hardID != nil {
+		filter["hard_ids"] = *hardID
+	}
+
+	accesses := []PsidAccess{}
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &accesses); err != nil {
+		return nil, err
+	}
+
+	return accesses, nil
+}
@@ -0,0 +1,83 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"scanner/databases"
+	"scanner/internal/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrPsidIndexKeyChanged = errors.New("the PSID blind indexes were computed under another index key")
+
+const psidIndexMetaID = "psid_index"
+
+// PsidIndexMeta records which index key the stored blind indexes use.
+type PsidIndexMeta struct {
+	ID          string    `bson:"_id"`
+	Fingerprint string    `bson:"fingerprint"`
+	UpdatedAt   time.Time `bson:"updated_at"`
+}
+
+type PsidIndexRepository struct {
+	meta  *mongo.Collection
+	hards *mongo.Collection
+}
+
+func NewPsidIndexRepository() *PsidIndexRepository {
+	return &PsidIndexRepository{
+		meta:  databases.DB.Collection("meta"),
+		hards: databases.DB.Collection("hards"),
+	}
+}
+
+// Check fails with ErrPsidIndexKeyChanged when PSID_INDEX_KEY differs from
+// the key the stored indexes were computed with, as every lookup by PSID would
+// then miss and upserts would insert duplicates. A database without a
+// recorded fingerprint is checked against one of its records and then gets
+// the fingerprint of the current key.
+func (r *PsidIndexRepository) Check(ctx context.Context) error {
+	fingerprint := utils.GetPsidCipher().IndexFingerprint()
+
+	meta := PsidIndexMeta{}
+	err := r.meta.FindOne(ctx, bson.M{"_id": psidIndexMetaID}).Decode(&meta)
+	if err == nil {
+		if meta.Fingerprint != fingerprint {
+			return fmt.Errorf("%w, run `psid reindex` to recompute them", ErrPsidIndexKeyChanged)
+		}
+
+		return nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	sample := Hard{}
+	err = r.hards.FindOne(ctx, bson.M{"psid_bidx": bson.M{"$nin": bson.A{"", nil}}}).Decode(&sample)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	if err == nil && utils.GetPsidCipher().BlindIndex(sample.Psid) != sample.PsidIndex {
+		return fmt.Errorf("%w, run `psid reindex` to recompute them", ErrPsidIndexKeyChanged)
+	}
+
+	_, err = r.meta.UpdateOne(ctx, bson.M{"_id": psidIndexMetaID}, bson.M{
+		"$setOnInsert": bson.M{"fingerprint": fingerprint, "updated_at": time.Now().UTC()},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// Record marks the stored indexes as computed with the current key.
+func (r *PsidIndexRepository) Record(ctx context.Context) error {
+	_, err := r.meta.UpdateOne(ctx, bson.M{"_id": psidIndexMetaID}, bson.M{
+		"$set": bson.M{"fingerprint": utils.GetPsidCipher().IndexFingerprint(), "updated_at": time.Now().UTC()},
+	}, options.Update().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,86 @@
+package repositories
+
+import (
+	"context"
+	"scanner/databases"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReaderScan is a photo set uploaded through a reader link together with what
+// OCR read from it, kept until the technician stores a PSID for it. The OCR
+// PSID is only kept masked and as a blind index.
+type ReaderScan struct {
+	ScanID       string              `bson:"scan_id" json:"scan_id"`
+	RequestID    string              `bson:"request_id" json:"request_id"`
+	SerialNumber string              `bson:"serial_number" json:"serial_number"`
+	Images       []string            `bson:"images" json:"images"`
+	OcrPsid      string              `bson:"ocr_psid" json:"ocr_psid"`
+	OcrPsidIndex string              `bson:"ocr_psid_bidx" json:"-"`
+	HardID       *primitive.ObjectID `bson:"hard_id,omitempty" json:"hard_id,omitempty"`
+	CreatedAt    time.Time           `bson:"created_at" json:"created_at"`
+	// ExpiresAt is the expiry of the request; the TTL index removes the
+	// scan some time after that.
+	ExpiresAt time.Time  `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at,omitempty" json:"used_at,omitempty"`
+}
+
+type ReaderScanRepo struct {
+	collection *mongo.Collection
+}
+
+func NewReaderScanRepo() *ReaderScanRepo {
+	return &ReaderScanRepo{
+		collection: databases.DB.Collection("reader_scans"),
+	}
+}
+
+func (r *ReaderScanRepo) Insert(ctx context.Context, scan *ReaderScan) error {
+	_, err := r.collection.InsertOne(ctx, scan)
+	return err
+}
+
+// Claim marks the scan of serialNumber in requestID as used and returns it,
+// or mongo.ErrNoDocuments when it doesn't exist or was claimed already. The
+// claim is atomic so two concurrent stores can't both use the same scan.
+func (r *ReaderScanRepo) Claim(ctx context.Context, scanID, requestID, serialNumber string) (*ReaderScan, error) {
+	scan := &ReaderScan{}
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{
+		"scan_id":       scanID,
+		"request_id":    requestID,
+		"serial_number": serialNumber,
+		"used_at":       bson.M{"$exists": false},
+	}, bson.M{
+		"$set": bson.M{"used_at": time.Now().UTC()},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(scan)
+	if err != nil {
+		return nil, err
+	}
+
+	return scan, nil
+}
+
+// Release gives back a claimed scan that no hard was stored for.
+func (r *ReaderScanRepo) Release(ctx context.Context, scanID string) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{
+		"scan_id": scanID,
+		"hard_id": bson.M{"$exists": false},
+	}, bson.M{
+		"$unset": bson.M{"used_at": ""},
+	})
+
+	return err
+}
+
+// MarkUsed links a claimed scan to the hard stored from it.
+func (r *ReaderScanRepo) MarkUsed(ctx context.Context, scanID string, hardID primitive.ObjectID) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"scan_id": scanID}, bson.M{
+		"$set": bson.M{"hard_id": hardID},
+	})
+
+	return err
+}
@@ -4,23 +4,114 @@ import (
 	"context"
 	"errors"
 	"scanner/databases"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type RequestRepo struct {
 	collection *mongo.Collection
 }
 
+// Reader progress of one serial number of a request.
+const (
+	SerialPending  = "pending"
+	SerialScanned  = "scanned"
+	SerialStored   = "stored"
+	SerialConflict = "conflict"
+)
+
 type SerialCondition struct {
-	SerialNumber string `bson:"serial_number"`
-	PsidStore    bool   `bson:"psid_store"`
+	SerialNumber string `bson:"serial_number" json:"serial_number"`
+	PsidStore    bool   `bson:"psid_store" json:"psid_store"`
+	// State is empty on conditions written before progress was tracked; use
+	// Progress to read it.
+	State     string              `bson:"state,omitempty" json:"state"`
+	Images    []string            `bson:"images,omitempty" json:"images"`
+	HardID    *primitive.ObjectID `bson:"hard_id,omitempty" json:"hard_id,omitempty"`
+	ScannedAt *time.Time          `bson:"scanned_at,omitempty" json:"scanned_at,omitempty"`
+	StoredAt  *time.Time          `bson:"stored_at,omitempty" json:"stored_at,omitempty"`
+	// Scans counts the OCR scans made for the serial through the reader.
+	Scans int `bson:"scans,omitempty" json:"scans"`
+	// Attempts lists every PSID stored for the serial through the reader, the
+	// last one being current.
+	Attempts []PsidAttempt `bson:"attempts,omitempty" json:"attempts,omitempty"`
 }
 
+// Outcomes of a PsidAttempt.
+const (
+	AttemptStored    = "stored"
+	AttemptCorrected = "corrected"
+)
+
+// PsidAttempt is one PSID stored through the reader. The PSID is masked; the
+// plaintext only ever lives on the hard.
+type PsidAttempt struct {
+	Psid string `bson:"psid" json:"psid"`
+	// PsidMismatch is set when the PSID differs from what OCR read off the
+	// scan it was stored for.
+	PsidMismatch bool               `bson:"psid_mismatch" json:"psid_mismatch"`
+	HardID       primitive.ObjectID `bson:"hard_id" json:"hard_id"`
+	ScanID       string             `bson:"scan_id,omitempty" json:"scan_id,omitempty"`
+	Outcome      string             `bson:"outcome" json:"outcome"`
+	At           time.Time          `bson:"at" json:"at"`
+}
+
+func (sc *SerialCondition) Progress() string {
+	switch {
+	case sc.PsidStore:
+		return SerialStored
+	case sc.State == "":
+		return SerialPending
+	default:
+		return sc.State
+	}
+}
+
+const (
+	RequestActive    = "active"
+	RequestCompleted = "completed"
+	RequestRevoked   = "revoked"
+	// RequestExpired is never stored; it is reported for active requests
+	// past their expiry.
+	RequestExpired = "expired"
+)
+
 type Request struct {
 	SerialNumbers []SerialCondition `bson:"serial_numbers" json:"serial_numbers"`
 	UUid          string            `bson:"uuid" json:"uuid"`
+	// Status is active until every serial has its PSID stored (completed) or
+	// the link is revoked. Expiry is derived from ExpiresAt; the TTL index
+	// removes the document some time after that.
+	Status    string     `bson:"status" json:"status"`
+	CreatedBy string     `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at" json:"expires_at"`
+	RevokedBy string     `bson:"revoked_by,omitempty" json:"revoked_by,omitempty"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	// Token marks requests that track an encrypted reader token. Their UUid is
+	// the token nonce and is never accepted as a link on its own.
+	Token       bool   `bson:"token,omitempty" json:"token,omitempty"`
+	InventoryID string `bson:"inventory_id,omitempty" json:"inventory_id,omitempty"`
+	// ExpiryNotified is set once the request.expired webhook event is queued.
+	ExpiryNotified bool `bson:"expiry_notified,omitempty" json:"-"`
+}
+
+func (r *Request) Expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+// EffectiveStatus is Status, with active requests past their expiry reported
+// as expired.
+func (r *Request) EffectiveStatus() string {
+	if r.Status == RequestActive && r.Expired() {
+		return RequestExpired
+	}
+
+	return r.Status
 }
 
 func NewRequestRepo() *RequestRepo {
@@ -52,36 +143,180 @@ func (r *RequestRepo) FindByID(ctx context.Context, uuid string) (*Request, erro
 	return request, nil
 }
 
-func (r *RequestRepo) UpdatePsidStore(ctx context.Context, uuid string, serialNumber string) error {
+// Ensure inserts request unless a request with the same UUid exists and
+// returns the stored one. Tokens issued elsewhere are tracked from first use.
+func (r *RequestRepo) Ensure(ctx context.Context, request *Request) (*Request, error) {
+	stored := &Request{}
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{"uuid": request.UUid}, bson.M{
+		"$setOnInsert": request,
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// UpdatePsidStore marks a serial of an active, unexpired request as stored and
+// completes the request once no serial is left, reporting whether it did.
+func (r *RequestRepo) UpdatePsidStore(ctx context.Context, uuid string, serialNumber string) (bool, error) {
+	// a serial is stored once, so a concurrent store of it fails here
 	filter := bson.M{
-		"uuid":                         uuid,
-		"serial_numbers.serial_number": serialNumber,
+		"uuid": uuid,
+		"serial_numbers": bson.M{"$elemMatch": bson.M{
+			"serial_number": serialNumber,
+			"psid_store":    bson.M{"$ne": true},
+		}},
+		"status":     RequestActive,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
 	}
 
 	update := bson.M{
 		"$set": bson.M{
 			"serial_numbers.$.psid_store": true,
+			"serial_numbers.$.state":      SerialStored,
+			"serial_numbers.$.stored_at":  time.Now().UTC(),
 		},
 	}
 
 	res, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	if res.MatchedCount == 0 {
+		return false, errors.New("no document matched the filter")
+	}
+
+	res, err = r.collection.UpdateOne(ctx, bson.M{
+		"uuid":           uuid,
+		"status":         RequestActive,
+		"serial_numbers": bson.M{"$not": bson.M{"$elemMatch": bson.M{"psid_store": false}}},
+	}, bson.M{
+		"$set": bson.M{"status": RequestCompleted},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return res.ModifiedCount == 1, nil
+}
+
+// ClaimExpired marks one active request past its expiry as notified and
+// returns it, or mongo.ErrNoDocuments when there is none left.
+func (r *RequestRepo) ClaimExpired(ctx context.Context) (*Request, error) {
+	request := &Request{}
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{
+		"status":          RequestActive,
+		"expires_at":      bson.M{"$lte": time.Now().UTC()},
+		"expiry_notified": bson.M{"$ne": true},
+	}, bson.M{
+		"$set": bson.M{"expiry_notified": true},
+	}).Decode(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// UpdateSerial applies update to the condition of serialNumber. Paths are
+// relative to the condition, e.g. {"$set": {"state": "scanned"}}.
+func (r *RequestRepo) UpdateSerial(ctx context.Context, uuid, serialNumber string, update bson.M) error {
+	positional := bson.M{}
+	for operator, fields := range update {
+		set := bson.M{}
+		for field, value := range fields.(bson.M) {
+			set["serial_numbers.$."+field] = value
+		}
+
+		positional[operator] = set
+	}
+
+	_, err := r.collection.UpdateOne(ctx, bson.M{
+		"uuid":                         uuid,
+		"serial_numbers.serial_number": serialNumber,
+	}, positional)
+
+	return err
+}
+
+// ReserveScan counts one more OCR scan of serialNumber, unless max scans
+// were made already, in which case it returns mongo.ErrNoDocuments.
+func (r *RequestRepo) ReserveScan(ctx context.Context, uuid, serialNumber string, max int) error {
+	res, err := r.collection.UpdateOne(ctx, bson.M{
+		"uuid": uuid,
+		"serial_numbers": bson.M{"$elemMatch": bson.M{
+			"serial_number": serialNumber,
+			"scans":         bson.M{"$not": bson.M{"$gte": max}},
+		}},
+	}, bson.M{
+		"$inc": bson.M{"serial_numbers.$.scans": 1},
+	})
 	if err != nil {
 		return err
 	}
 
 	if res.MatchedCount == 0 {
-		return errors.New("no document matched the filter")
+		return mongo.ErrNoDocuments
 	}
 
 	return nil
 }
 
+// List returns requests matching filter, newest first.
+func (r *RequestRepo) List(ctx context.Context, filter bson.M, limit int64) ([]Request, error) {
+	requests := []Request{}
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &requests); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// Revoke disables an active link. Revoking a link twice is not an error.
+func (r *RequestRepo) Revoke(ctx context.Context, uuid, actor string) (*Request, error) {
+	now := time.Now().UTC()
+	request := &Request{}
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{
+		"uuid":   uuid,
+		"status": bson.M{"$ne": RequestRevoked},
+	}, bson.M{
+		"$set": bson.M{
+			"status":     RequestRevoked,
+			"revoked_by": actor,
+			"revoked_at": now,
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(request)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return r.FindByID(ctx, uuid)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// FindBySerials returns the usable request covering exactly serialNumbers,
+// which must not contain duplicates.
 func (r *RequestRepo) FindBySerials(ctx context.Context, serialNumbers []string) (*Request, error) {
 	request := &Request{}
+	// only links that can still be used are handed out again
 	filter := bson.M{
 		"serial_numbers.serial_number": bson.M{
 			"$all": serialNumbers,
 		},
+		"serial_numbers": bson.M{"$size": len(serialNumbers)},
+		"status":         RequestActive,
+		"expires_at":     bson.M{"$gt": time.Now().UTC()},
+		"token":          bson.M{"$ne": true},
 	}
 
 	err := r.collection.FindOne(ctx, filter).Decode(request)
@@ -91,3 +326,72 @@ func (r *RequestRepo) FindBySerials(ctx context.Context, serialNumbers []string)
 
 	return request, nil
 }
+
+// FindPending returns the usable requests, oldest first, in which any of
+// serialNumbers still waits for its PSID.
+func (r *RequestRepo) FindPending(ctx context.Context, serialNumbers []string) ([]Request, error) {
+	requests := []Request{}
+	cursor, err := r.collection.Find(ctx, bson.M{
+		"serial_numbers": bson.M{"$elemMatch": bson.M{
+			"serial_number": bson.M{"$in": serialNumbers},
+			"psid_store":    false,
+		}},
+		"status":     RequestActive,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &requests); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// AddSerials appends serial numbers to a usable request that doesn't hold any
+// of them yet and returns it, or mongo.ErrNoDocuments.
+func (r *RequestRepo) AddSerials(ctx context.Context, uuid string, serialNumbers []string) (*Request, error) {
+	conditions := bson.A{}
+	for _, sn := range serialNumbers {
+		conditions = append(conditions, SerialCondition{SerialNumber: sn, State: SerialPending})
+	}
+
+	request := &Request{}
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{
+		"uuid":                         uuid,
+		"status":                       RequestActive,
+		"expires_at":                   bson.M{"$gt": time.Now().UTC()},
+		"serial_numbers.serial_number": bson.M{"$nin": serialNumbers},
+	}, bson.M{
+		"$push": bson.M{"serial_numbers": bson.M{"$each": conditions}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// RemoveSerials takes serial numbers that are still pending out of a request.
+func (r *RequestRepo) RemoveSerials(ctx context.Context, uuid string, serialNumbers []string) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"uuid": uuid}, bson.M{
+		"$pull": bson.M{"serial_numbers": bson.M{
+			"serial_number": bson.M{"$in": serialNumbers},
+			"psid_store":    false,
+		}},
+	})
+
+	return err
+}
+
+// Delete removes a request no serial was stored through yet.
+func (r *RequestRepo) Delete(ctx context.Context, uuid string) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{
+		"uuid":                      uuid,
+		"serial_numbers.psid_store": bson.M{"$ne": true},
+	})
+
+	return err
+}
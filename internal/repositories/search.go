@@ -0,0 +1,244 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"scanner/internal/utils"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SearchModePrefix    = "prefix"
+	SearchModeSubstring = "substring"
+
+	gramSize            = 3
+	maxSearchCandidates = 1000
+)
+
+type HardSearch struct {
+	Query string `query:"q"`
+	Mode  string `query:"mode"`
+	// Strict disables OCR-confusion tolerance (O/0, I/1, S/5, ...).
+	Strict      bool `query:"strict"`
+	Limit       int  `query:"limit"`
+	IncludePsid bool `query:"-"`
+}
+
+type HardSearchResult struct {
+	Hard          Hard     `json:"hard"`
+	MatchedFields []string `json:"matched_fields"`
+	Score         int      `json:"score"`
+}
+
+func (h *Hard) searchableValues() map[string]string {
+	values := map[string]string{
+		"serial_number": h.SerialNumber,
+		"part_number":   h.PartNumber,
+		"model":         h.Model,
+		"eui":           h.Eui,
+	}
+
+	for key, value := range h.ExtraFields {
+		if str, ok := value.(string); ok {
+			values["extra_fields."+key] = str
+		}
+	}
+
+	return values
+}
+
+// buildSearchIndex returns the distinct folded values and their trigrams.
+func buildSearchIndex(values map[string]string) ([]string, []string) {
+	keys := []string{}
+	grams := []string{}
+	for _, value := range values {
+		folded := utils.FoldOCR(value)
+		if folded == "" {
+			continue
+		}
+
+		if !slices.Contains(keys, folded) {
+			keys = append(keys, folded)
+		}
+
+		for _, gram := range trigrams(folded) {
+			if !slices.Contains(grams, gram) {
+				grams = append(grams, gram)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	sort.Strings(grams)
+	return keys, grams
+}
+
+func trigrams(s string) []string {
+	grams := []string{}
+	for i := 0; i+gramSize <= len(s); i++ {
+		grams = append(grams, s[i:i+gramSize])
+	}
+
+	return grams
+}
+
+func searchClause(keysField, gramsField, folded, mode string) bson.M {
+	if mode == SearchModePrefix {
+		// an anchored regex can use the multikey index on the folded values
+		return bson.M{keysField: bson.M{"$regex": "^" + regexp.QuoteMeta(folded)}}
+	}
+
+	if len(folded) < gramSize {
+		return bson.M{keysField: bson.M{"$regex": regexp.QuoteMeta(folded)}}
+	}
+
+	return bson.M{gramsField: bson.M{"$all": trigrams(folded)}}
+}
+
+// Search finds active records whose serial number, part number, model, EUI,
+// string extra fields match the query, or (when IncludePsid is set) whose PSID
+// is exactly the query. The
+// trigram/prefix index only narrows the candidates, keeping exact and prefix
+// matches first when there are too many; every candidate is then checked
+// against the actual values and scored: exact matches first, then prefix,
+// then substring, with OCR-tolerant matches ranked below literal ones.
+func (r *HardRepository) Search(ctx context.Context, search *HardSearch) ([]HardSearchResult, error) {
+	mode := search.Mode
+	if mode == "" {
+		mode = SearchModeSubstring
+	}
+
+	if mode != SearchModePrefix && mode != SearchModeSubstring {
+		return nil, fmt.Errorf("%w: mode must be prefix or substring", ErrInvalidQuery)
+	}
+
+	folded := utils.FoldOCR(search.Query)
+	if folded == "" {
+		return nil, fmt.Errorf("%w: q must contain letters or digits", ErrInvalidQuery)
+	}
+
+	limit := search.Limit
+	if limit <= 0 {
+		limit = defaultHardPageSize
+	}
+
+	if limit > maxHardPageSize {
+		limit = maxHardPageSize
+	}
+
+	// the PSID is only ever matched whole through its blind index: blinded
+	// fragments of it would let anyone with the index guess it piecewise
+	psidIndex := utils.GetPsidCipher().BlindIndex(strings.TrimSpace(search.Query))
+	clauses := bson.A{searchClause("search_keys", "search_grams", folded, mode)}
+	if search.IncludePsid {
+		clauses = append(clauses, bson.M{"psid_bidx": psidIndex})
+	}
+
+	filter := bson.M{
+		"$or":            clauses,
+		"incorrect_psid": bson.M{"$ne": true},
+		"active":         activeFilter(),
+	}
+
+	// rank the candidates the way matchScore will before cutting them off,
+	// so the best matches make it into the window on large collections
+	rank := bson.A{bson.M{"$max": bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$search_keys", bson.A{}}},
+		"as":    "key",
+		"in": bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{"case": bson.M{"$eq": bson.A{"$$key", folded}}, "then": 3},
+				bson.M{"case": bson.M{"$eq": bson.A{bson.M{"$indexOfCP": bson.A{"$$key", folded}}, 0}}, "then": 2},
+			},
+			"default": 1,
+		}},
+	}}}}
+	if search.IncludePsid {
+		rank = append(rank, bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$psid_bidx", psidIndex}}, 3, 0}})
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$addFields", Value: bson.M{"search_rank": bson.M{"$max": rank}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "search_rank", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: maxSearchCandidates}},
+		{{Key: "$project", Value: bson.M{"search_rank": 0}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []Hard{}
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, err
+	}
+
+	results := []HardSearchResult{}
+	for _, hard := range candidates {
+		values := hard.searchableValues()
+		if search.IncludePsid && hard.PsidIndex == psidIndex {
+			values["psid"] = hard.Psid
+		}
+
+		result := HardSearchResult{Hard: hard, MatchedFields: []string{}}
+		for field, value := range values {
+			score := matchScore(search.Query, value, mode, search.Strict)
+			if score == 0 {
+				continue
+			}
+
+			result.MatchedFields = append(result.MatchedFields, field)
+			result.Score = max(result.Score, score)
+		}
+
+		if result.Score > 0 {
+			sort.Strings(result.MatchedFields)
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].Hard.SerialNumber < results[j].Hard.SerialNumber
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func matchScore(query, value, mode string, strict bool) int {
+	literalQuery, literalValue := utils.NormalizeSerial(query), utils.NormalizeSerial(value)
+	if score := compareSearch(literalQuery, literalValue, mode); score > 0 || strict {
+		return score * 2
+	}
+
+	return compareSearch(utils.FoldOCR(query), utils.FoldOCR(value), mode)
+}
+
+func compareSearch(query, value, mode string) int {
+	switch {
+	case query == "" || value == "":
+		return 0
+	case value == query:
+		return 3
+	case strings.HasPrefix(value, query):
+		return 2
+	case mode == SearchModeSubstring && strings.Contains(value, query):
+		return 1
+	default:
+		return 0
+	}
+}
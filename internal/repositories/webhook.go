@@ -0,0 +1,292 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"scanner/databases"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	EventSerialStored     = "serial.stored"
+	EventRequestCompleted = "request.completed"
+	EventRequestExpired   = "request.expired"
+)
+
+var WebhookEvents = []string{EventSerialStored, EventRequestCompleted, EventRequestExpired}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// WebhookSubscription receives events for one request, or for every request
+// when RequestID is empty. No Events means every event.
+type WebhookSubscription struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	URL       string             `bson:"url" json:"url"`
+	Secret    string             `bson:"secret" json:"secret,omitempty"`
+	Events    []string           `bson:"events" json:"events"`
+	RequestID string             `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	CreatedBy string             `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// WebhookEvent is the JSON body posted to subscribers.
+type WebhookEvent struct {
+	ID           string              `bson:"id" json:"id"`
+	Type         string              `bson:"type" json:"type"`
+	RequestID    string              `bson:"request_id" json:"request_id"`
+	InventoryID  string              `bson:"inventory_id,omitempty" json:"inventory_id,omitempty"`
+	SerialNumber string              `bson:"serial_number,omitempty" json:"serial_number,omitempty"`
+	HardID       *primitive.ObjectID `bson:"hard_id,omitempty" json:"hard_id,omitempty"`
+	// Corrected marks serial.stored events replacing a PSID stored earlier.
+	Corrected  bool      `bson:"corrected,omitempty" json:"corrected,omitempty"`
+	OccurredAt time.Time `bson:"occurred_at" json:"occurred_at"`
+}
+
+// WebhookDelivery is one event queued for one subscription.
+type WebhookDelivery struct {
+	ID             primitive.ObjectID `bson:"_id" json:"id"`
+	SubscriptionID primitive.ObjectID `bson:"subscription_id" json:"subscription_id"`
+	URL            string             `bson:"url" json:"url"`
+	Event          WebhookEvent       `bson:"event" json:"event"`
+	Status         string             `bson:"status" json:"status"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LastStatusCode int                `bson:"last_status_code,omitempty" json:"last_status_code,omitempty"`
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type WebhookRepository struct {
+	subscriptions *mongo.Collection
+	deliveries    *mongo.Collection
+}
+
+func NewWebhookRepository() *WebhookRepository {
+	return &WebhookRepository{
+		subscriptions: databases.DB.Collection("webhook_subscriptions"),
+		deliveries:    databases.DB.Collection("webhook_deliveries"),
+	}
+}
+
+func (r *WebhookRepository) InsertSubscription(ctx context.Context, subscription *WebhookSubscription) error {
+	if subscription.ID.IsZero() {
+		subscription.ID = primitive.NewObjectID()
+	}
+
+	_, err := r.subscriptions.InsertOne(ctx, subscription)
+	return err
+}
+
+// UpsertSubscription inserts subscription unless one with the same URL for the
+// same request exists, in which case that one is returned and created is
+// false.
+func (r *WebhookRepository) UpsertSubscription(ctx context.Context, subscription *WebhookSubscription) (*WebhookSubscription, bool, error) {
+	if subscription.ID.IsZero() {
+		subscription.ID = primitive.NewObjectID()
+	}
+
+	filter := bson.M{"url": subscription.URL, "request_id": subscription.RequestID}
+	if subscription.RequestID == "" {
+		filter["request_id"] = bson.M{"$in": bson.A{nil, ""}}
+	}
+
+	existing := &WebhookSubscription{}
+	err := r.subscriptions.FindOneAndUpdate(ctx, filter, bson.M{
+		"$setOnInsert": subscription,
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)).Decode(existing)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// nothing matched before the update, so ours was inserted
+		return subscription, true, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return existing, false, nil
+}
+
+func (r *WebhookRepository) SetSubscriptionEvents(ctx context.Context, id primitive.ObjectID, events []string) error {
+	_, err := r.subscriptions.UpdateByID(ctx, id, bson.M{"$set": bson.M{"events": events}})
+	return err
+}
+
+func (r *WebhookRepository) DeleteSubscription(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.subscriptions.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (r *WebhookRepository) FindSubscriptions(ctx context.Context, requestID string) ([]WebhookSubscription, error) {
+	filter := bson.M{}
+	if requestID != "" {
+		filter["request_id"] = requestID
+	}
+
+	subscriptions := []WebhookSubscription{}
+	cursor, err := r.subscriptions.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// MatchingSubscriptions returns the global subscriptions and those of
+// requestID that want eventType.
+func (r *WebhookRepository) MatchingSubscriptions(ctx context.Context, eventType, requestID string) ([]WebhookSubscription, error) {
+	subscriptions := []WebhookSubscription{}
+	cursor, err := r.subscriptions.Find(ctx, bson.M{
+		"request_id": bson.M{"$in": bson.A{nil, "", requestID}},
+		"$or": bson.A{
+			bson.M{"events": bson.M{"$size": 0}},
+			bson.M{"events": eventType},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+func (r *WebhookRepository) FindSubscription(ctx context.Context, id primitive.ObjectID) (*WebhookSubscription, error) {
+	subscription := &WebhookSubscription{}
+	if err := r.subscriptions.FindOne(ctx, bson.M{"_id": id}).Decode(subscription); err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+func (r *WebhookRepository) InsertDeliveries(ctx context.Context, deliveries []WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		documents = append(documents, delivery)
+	}
+
+	_, err := r.deliveries.InsertMany(ctx, documents)
+	return err
+}
+
+// ClaimDue takes the oldest pending delivery that is due and pushes its next
+// attempt back by lease, so another worker won't pick it up while it is being
+// sent. It returns mongo.ErrNoDocuments when nothing is due.
+func (r *WebhookRepository) ClaimDue(ctx context.Context, lease time.Duration) (*WebhookDelivery, error) {
+	now := time.Now().UTC()
+	delivery := &WebhookDelivery{}
+	err := r.deliveries.FindOneAndUpdate(ctx, bson.M{
+		"status":          DeliveryPending,
+		"next_attempt_at": bson.M{"$lte": now},
+	}, bson.M{
+		"$set": bson.M{"next_attempt_at": now.Add(lease)},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)).Decode(delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+// SaveAttempt records the outcome of sending a delivery.
+func (r *WebhookRepository) SaveAttempt(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := r.deliveries.UpdateByID(ctx, delivery.ID, bson.M{
+		"$set": bson.M{
+			"status":           delivery.Status,
+			"attempts":         delivery.Attempts,
+			"next_attempt_at":  delivery.NextAttemptAt,
+			"last_error":       delivery.LastError,
+			"last_status_code": delivery.LastStatusCode,
+			"delivered_at":     delivery.DeliveredAt,
+		},
+	})
+
+	return err
+}
+
+// FindDeliveries lists deliveries, newest first, optionally with one status.
+func (r *WebhookRepository) FindDeliveries(ctx context.Context, status string, limit int64) ([]WebhookDelivery, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	deliveries := []WebhookDelivery{}
+	cursor, err := r.deliveries.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+var ErrDeliveryDelivered = errors.New("delivery already succeeded")
+
+// Redeliver queues a delivery again with a fresh set of attempts. Deliveries
+// that already succeeded are left alone.
+func (r *WebhookRepository) Redeliver(ctx context.Context, id primitive.ObjectID) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	err := r.deliveries.FindOneAndUpdate(ctx, bson.M{
+		"_id":    id,
+		"status": bson.M{"$ne": DeliveryDelivered},
+	}, bson.M{
+		"$set": bson.M{
+			"status":          DeliveryPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now().UTC(),
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(delivery)
+	if err == nil {
+		return delivery, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	count, err := r.deliveries.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+
+	if count > 0 {
+		return nil, ErrDeliveryDelivered
+	}
+
+	return nil, mongo.ErrNoDocuments
+}
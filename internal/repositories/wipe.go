@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidWipeTransition = errors.New("invalid wipe state transition")
+
+type WipeState string
+
+const (
+	WipeReceived     WipeState = "received"
+	WipePsidVerified WipeState = "psid_verified"
+	WipeQueued       WipeState = "wipe_queued"
+	WipeWiped        WipeState = "wiped"
+	WipeVerified     WipeState = "verified"
+	WipeFailed       WipeState = "failed"
+	WipeDestroyed    WipeState = "destroyed"
+)
+
+// WipeStates lists every state in workflow order.
+var WipeStates = []WipeState{
+	WipeReceived,
+	WipePsidVerified,
+	WipeQueued,
+	WipeWiped,
+	WipeVerified,
+	WipeFailed,
+	WipeDestroyed,
+}
+
+// WipeMethods are the accepted values for the method of a wiped transition.
+var WipeMethods = []string{
+	"crypto_erase",
+	"overwrite",
+	"psid_revert",
+}
+
+// wipeTransitions lists the states reachable from each state. A drive can be
+// physically destroyed at any point before it was wiped, and a failed wipe
+// can be queued again.
+var wipeTransitions = map[WipeState][]WipeState{
+	WipeReceived:     {WipePsidVerified, WipeFailed, WipeDestroyed},
+	WipePsidVerified: {WipeQueued, WipeFailed, WipeDestroyed},
+	WipeQueued:       {WipeWiped, WipeFailed, WipeDestroyed},
+	WipeWiped:        {WipeVerified, WipeFailed},
+	WipeVerified:     {WipeDestroyed},
+	WipeFailed:       {WipeQueued, WipeDestroyed},
+	WipeDestroyed:    {},
+}
+
+func (s WipeState) Valid() bool {
+	_, ok := wipeTransitions[s]
+	return ok
+}
+
+// Next returns the states s can move to.
+func (s WipeState) Next() []WipeState {
+	return wipeTransitions[s]
+}
+
+func (s WipeState) CanTransition(to WipeState) bool {
+	for _, next := range wipeTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accepted reports whether a drive in this state counts as wipe accepted, the
+// flag older clients still filter on.
+func (s WipeState) Accepted() bool {
+	switch s {
+	case WipeQueued, WipeWiped, WipeVerified, WipeDestroyed:
+		return true
+	}
+
+	return false
+}
+
+type WipeTransition struct {
+	From   WipeState `bson:"from" json:"from"`
+	To     WipeState `bson:"to" json:"to"`
+	Method string    `bson:"method,omitempty" json:"method,omitempty"`
+	Note   string    `bson:"note,omitempty" json:"note,omitempty"`
+	Actor  string    `bson:"actor" json:"actor"`
+	At     time.Time `bson:"at" json:"at"`
+}
+
+// Transition moves hard to the next state in memory, recording who did it.
+// Saving is left to the caller.
+func (h *Hard) Transition(to WipeState, method, note, actor string) error {
+	if !h.WipeState.CanTransition(to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidWipeTransition, h.WipeState, to)
+	}
+
+	transition := WipeTransition{
+		From:   h.WipeState,
+		To:     to,
+		Method: method,
+		Note:   note,
+		Actor:  actor,
+		At:     time.Now().UTC(),
+	}
+
+	h.WipeState = to
+	h.WipeAccepted = to.Accepted()
+	if method != "" {
+		h.WipeMethod = method
+	}
+
+	h.WipeTransitions = append(h.WipeTransitions, transition)
+	return nil
+}
+
+// SaveWipeState persists the wipe fields changed by Transition, provided the
+// hard wasn't modified since it was read.
+func (r *HardRepository) SaveWipeState(ctx context.Context, hard *Hard) error {
+	now := time.Now().UTC()
+	result, err := r.collection.UpdateOne(ctx, versionFilter(hard.ID, hard.Version), bson.M{
+		"$set": bson.M{
+			"wipe_state":       hard.WipeState,
+			"wipe_method":      hard.WipeMethod,
+			"wipe_transitions": hard.WipeTransitions,
+			"wipe_accepted":    hard.WipeAccepted,
+			"vipe_accepted":    hard.WipeAccepted,
+			"updated_at":       now,
+		},
+		"$inc": bson.M{"version": 1},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrVersionConflict
+	}
+
+	hard.Version++
+	hard.UpdatedAt = now
+	return nil
+}
+
+// EachWithWipeTransitions calls fn for every record with wipe transitions,
+// including deleted and merged ones, whose history is kept as well.
+func (r *HardRepository) EachWithWipeTransitions(ctx context.Context, fn func(*Hard) error) error {
+	cursor, err := r.collection.Find(ctx, bson.M{"wipe_transitions.0": bson.M{"$exists": true}}, options.Find().
+		SetProjection(bson.M{"serial_number": 1, "wipe_transitions": 1}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		hard := &Hard{}
+		if err := cursor.Decode(hard); err != nil {
+			return err
+		}
+
+		if err := fn(hard); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
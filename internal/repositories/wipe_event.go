@@ -0,0 +1,355 @@
+package repositories
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"scanner/databases"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GenesisHash is the previous hash of the first event in the chain.
+var GenesisHash = strings.Repeat("0", 64)
+
+// ErrWipeEventLogged is returned by Append when the transition of the event
+// was logged already, e.g. by a concurrent writer.
+var ErrWipeEventLogged = errors.New("wipe transition is already logged")
+
+// WipeEvent is an entry of the append-only wipe log. Each event includes the
+// hash of the one before it, so changing, removing or reordering any event
+// breaks every hash after it.
+type WipeEvent struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	Seq          int64              `bson:"seq" json:"seq"`
+	HardID       primitive.ObjectID `bson:"hard_id" json:"hard_id"`
+	SerialNumber string             `bson:"serial_number" json:"serial_number"`
+	From         WipeState          `bson:"from" json:"from"`
+	To           WipeState          `bson:"to" json:"to"`
+	Method       string             `bson:"method,omitempty" json:"method,omitempty"`
+	Note         string             `bson:"note,omitempty" json:"note,omitempty"`
+	Actor        string             `bson:"actor" json:"actor"`
+	At           time.Time          `bson:"at" json:"at"`
+	PrevHash     string             `bson:"prev_hash" json:"prev_hash"`
+	Hash         string             `bson:"hash" json:"hash"`
+	// Transition is the position of the logged transition in the wipe
+	// transitions of the hard, unique per hard so that it can't be logged
+	// twice. It is not hashed, as events logged before it existed were
+	// numbered afterwards.
+	Transition int `bson:"transition" json:"transition"`
+}
+
+// NewWipeEvent logs the transition at position index of the wipe transitions
+// of hard.
+func NewWipeEvent(hard *Hard, index int, transition WipeTransition) *WipeEvent {
+	return &WipeEvent{
+		Transition:   index,
+		HardID:       hard.ID,
+		SerialNumber: hard.SerialNumber,
+		From:         transition.From,
+		To:           transition.To,
+		Method:       transition.Method,
+		Note:         transition.Note,
+		Actor:        transition.Actor,
+		At:           transition.At.UTC().Truncate(time.Millisecond),
+	}
+}
+
+// ComputeHash hashes the previous hash together with the content of the event.
+func (e *WipeEvent) ComputeHash() string {
+	data, _ := json.Marshal(struct {
+		Seq          int64     `json:"seq"`
+		HardID       string    `json:"hard_id"`
+		SerialNumber string    `json:"serial_number"`
+		From         WipeState `json:"from"`
+		To           WipeState `json:"to"`
+		Method       string    `json:"method"`
+		Note         string    `json:"note"`
+		Actor        string    `json:"actor"`
+		At           time.Time `json:"at"`
+	}{e.Seq, e.HardID.Hex(), e.SerialNumber, e.From, e.To, e.Method, e.Note, e.Actor, e.At.UTC()})
+
+	sum := sha256.Sum256(append([]byte(e.PrevHash), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// WipeLogHeadID is the _id of the single document of wipe_log_head.
+const WipeLogHeadID = "head"
+
+// WipeLogHead anchors the newest event of the chain outside of it, so that
+// removing events from the end of the log is detected too.
+type WipeLogHead struct {
+	ID        string    `bson:"_id" json:"-"`
+	Seq       int64     `bson:"seq" json:"seq"`
+	Hash      string    `bson:"hash" json:"hash"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type WipeEventRepository struct {
+	collection *mongo.Collection
+	head       *mongo.Collection
+}
+
+func NewWipeEventRepository() *WipeEventRepository {
+	return &WipeEventRepository{
+		collection: databases.DB.Collection("wipe_events"),
+		head:       databases.DB.Collection("wipe_log_head"),
+	}
+}
+
+// Append links event to the current head of the chain and stores it. The
+// unique index on seq makes concurrent appends race for the same slot; the
+// loser re-reads the head and tries again. The unique index on (hard_id,
+// transition) refuses a transition that is logged already with
+// ErrWipeEventLogged.
+func (r *WipeEventRepository) Append(ctx context.Context, event *WipeEvent) error {
+	for attempt := 0; attempt < 10; attempt++ {
+		event.Seq, event.PrevHash = 1, GenesisHash
+		var head WipeEvent
+		err := r.collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}})).Decode(&head)
+		if err == nil {
+			event.Seq, event.PrevHash = head.Seq+1, head.Hash
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		event.ID = primitive.NewObjectID()
+		event.Hash = event.ComputeHash()
+		_, err = r.collection.InsertOne(ctx, event)
+		if isDuplicateOn(err, "hard_id_transition") {
+			return ErrWipeEventLogged
+		}
+
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := r.anchor(ctx, event); err != nil {
+			return fmt.Errorf("wipe event %d logged but not anchored, `wipe-log repair` anchors it: %w", event.Seq, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("failed to append wipe event for %s: too much contention", event.SerialNumber)
+}
+
+// anchor moves the head to event unless a later event was anchored already.
+func (r *WipeEventRepository) anchor(ctx context.Context, event *WipeEvent) error {
+	_, err := r.head.UpdateOne(ctx, bson.M{
+		"_id": WipeLogHeadID,
+		"seq": bson.M{"$lt": event.Seq},
+	}, bson.M{
+		"$set": bson.M{"seq": event.Seq, "hash": event.Hash, "updated_at": time.Now().UTC()},
+	}, options.Update().SetUpsert(true))
+
+	// the head exists and is already past event
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	return err
+}
+
+// isDuplicateOn tells whether err is a duplicate key error of the named index.
+func isDuplicateOn(err error, index string) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == 11000 && strings.Contains(e.Message, index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RepairHead anchors the head at the last event of the intact start of the
+// chain, for appends that stored their event but failed to move the head. The
+// head is never moved backwards, past a break, or off an event whose hash it
+// doesn't match. It returns the new head sequence, or 0 if it didn't move.
+func (r *WipeEventRepository) RepairHead(ctx context.Context) (int64, error) {
+	var head WipeLogHead
+	err := r.head.FindOne(ctx, bson.M{"_id": WipeLogHeadID}).Decode(&head)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, err
+	}
+
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var last *WipeEvent
+	prevHash, expectedSeq := GenesisHash, int64(1)
+	for cursor.Next(ctx) {
+		event := &WipeEvent{}
+		if err := cursor.Decode(event); err != nil {
+			return 0, err
+		}
+
+		if event.Seq != expectedSeq || event.PrevHash != prevHash || event.ComputeHash() != event.Hash {
+			break
+		}
+
+		if event.Seq == head.Seq && event.Hash != head.Hash {
+			return 0, nil
+		}
+
+		last, prevHash, expectedSeq = event, event.Hash, event.Seq+1
+	}
+
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+
+	if last == nil || last.Seq <= head.Seq {
+		return 0, nil
+	}
+
+	if err := r.anchor(ctx, last); err != nil {
+		return 0, err
+	}
+
+	return last.Seq, nil
+}
+
+func (r *WipeEventRepository) FindByHard(ctx context.Context, hardID primitive.ObjectID) ([]WipeEvent, error) {
+	events := []WipeEvent{}
+	cursor, err := r.collection.Find(ctx, bson.M{"hard_id": hardID}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+type ChainBreak struct {
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// TransitionMismatch is a hard whose wipe transitions and logged events
+// disagree.
+type TransitionMismatch struct {
+	HardID       primitive.ObjectID `json:"hard_id"`
+	SerialNumber string             `json:"serial_number"`
+	Reason       string             `json:"reason"`
+}
+
+type ChainReport struct {
+	Valid  bool         `json:"valid"`
+	Events int64        `json:"events"`
+	Head   string       `json:"head"`
+	Breaks []ChainBreak `json:"breaks"`
+	// Mismatches is filled in by the caller comparing hards with the log.
+	Mismatches []TransitionMismatch `json:"mismatches"`
+}
+
+// Verify walks the whole chain in order, recomputing every hash, and checks
+// that it ends at the anchored head.
+func (r *WipeEventRepository) Verify(ctx context.Context) (*ChainReport, error) {
+	report := &ChainReport{Head: GenesisHash, Breaks: []ChainBreak{}, Mismatches: []TransitionMismatch{}}
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	expectedSeq := int64(1)
+	for cursor.Next(ctx) {
+		var event WipeEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, err
+		}
+
+		report.Events++
+		if event.Seq != expectedSeq {
+			report.Breaks = append(report.Breaks, ChainBreak{
+				Seq:    event.Seq,
+				Reason: fmt.Sprintf("expected sequence %d, events are missing", expectedSeq),
+			})
+		}
+
+		if event.PrevHash != report.Head {
+			report.Breaks = append(report.Breaks, ChainBreak{Seq: event.Seq, Reason: "previous hash does not match the preceding event"})
+		}
+
+		if event.ComputeHash() != event.Hash {
+			report.Breaks = append(report.Breaks, ChainBreak{Seq: event.Seq, Reason: "content does not match its hash"})
+		}
+
+		report.Head = event.Hash
+		expectedSeq = event.Seq + 1
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.verifyHead(ctx, report, expectedSeq-1); err != nil {
+		return nil, err
+	}
+
+	report.Valid = len(report.Breaks) == 0
+	return report, nil
+}
+
+// verifyHead compares the end of the chain with the anchored head.
+func (r *WipeEventRepository) verifyHead(ctx context.Context, report *ChainReport, lastSeq int64) error {
+	var head WipeLogHead
+	err := r.head.FindOne(ctx, bson.M{"_id": WipeLogHeadID}).Decode(&head)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if report.Events > 0 {
+			report.Breaks = append(report.Breaks, ChainBreak{Seq: lastSeq, Reason: "the chain has no anchored head"})
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case head.Seq > lastSeq:
+		report.Breaks = append(report.Breaks, ChainBreak{
+			Seq:    lastSeq + 1,
+			Reason: fmt.Sprintf("events %d to %d are missing from the end of the log", lastSeq+1, head.Seq),
+		})
+	case head.Seq < lastSeq:
+		report.Breaks = append(report.Breaks, ChainBreak{
+			Seq:    head.Seq + 1,
+			Reason: fmt.Sprintf("events after %d are not anchored in the head", head.Seq),
+		})
+	case head.Hash != report.Head:
+		report.Breaks = append(report.Breaks, ChainBreak{Seq: head.Seq, Reason: "the newest event does not match the anchored head"})
+	}
+
+	return nil
+}
+
+// CountByHard counts the events logged for a hard.
+func (r *WipeEventRepository) CountByHard(ctx context.Context, hardID primitive.ObjectID) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{"hard_id": hardID})
+}
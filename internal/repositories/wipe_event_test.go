@@ -0,0 +1,82 @@
+package repositories_test
+
+import (
+	"context"
+	"errors"
+	"scanner/internal/repositories"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAppendRefusesLoggedTransition(t *testing.T) {
+	db := testDatabase(t)
+	repo := repositories.NewWipeEventRepository()
+
+	hard := &repositories.Hard{ID: primitive.NewObjectID(), SerialNumber: "SN-LOG-1"}
+	transition := repositories.WipeTransition{
+		From: repositories.WipeReceived,
+		To:   repositories.WipeQueued,
+		At:   time.Now(),
+	}
+
+	if err := repo.Append(context.Background(), repositories.NewWipeEvent(hard, 0, transition)); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	err := repo.Append(context.Background(), repositories.NewWipeEvent(hard, 0, transition))
+	if !errors.Is(err, repositories.ErrWipeEventLogged) {
+		t.Fatalf("second append: got %v, want ErrWipeEventLogged", err)
+	}
+
+	count, err := db.Collection("wipe_events").CountDocuments(context.Background(), bson.M{"hard_id": hard.ID})
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("%d events logged, want 1", count)
+	}
+}
+
+func TestRepairHeadAnchorsUnanchoredEvents(t *testing.T) {
+	db := testDatabase(t)
+	repo := repositories.NewWipeEventRepository()
+
+	hard := &repositories.Hard{ID: primitive.NewObjectID(), SerialNumber: "SN-LOG-2"}
+	for i, to := range []repositories.WipeState{repositories.WipeQueued, repositories.WipeWiped} {
+		event := repositories.NewWipeEvent(hard, i, repositories.WipeTransition{To: to, At: time.Now()})
+		if err := repo.Append(context.Background(), event); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	// the second append was logged but its anchor failed
+	var first repositories.WipeEvent
+	if err := db.Collection("wipe_events").FindOne(context.Background(), bson.M{"seq": 1}).Decode(&first); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+
+	_, err := db.Collection("wipe_log_head").UpdateOne(context.Background(), bson.M{"_id": repositories.WipeLogHeadID}, bson.M{
+		"$set": bson.M{"seq": 1, "hash": first.Hash},
+	})
+	if err != nil {
+		t.Fatalf("rewind head: %v", err)
+	}
+
+	if report, err := repo.Verify(context.Background()); err != nil || report.Valid {
+		t.Fatalf("verify before repair: valid=%v err=%v", report != nil && report.Valid, err)
+	}
+
+	anchored, err := repo.RepairHead(context.Background())
+	if err != nil || anchored != 2 {
+		t.Fatalf("repair: anchored %d, %v; want 2", anchored, err)
+	}
+
+	report, err := repo.Verify(context.Background())
+	if err != nil || !report.Valid {
+		t.Errorf("verify after repair: %+v, %v", report, err)
+	}
+}
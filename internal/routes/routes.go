@@ -123,18 +123,65 @@ func SetupWebServicesRoutes(app *fiber.App, config *config.Config, scanService *
 	app.Post("/api/webservice/scan", webserviceMiddleware, webServiceHandler.Scan)
 	app.Post("/api/webservice/scan_file", webserviceMiddleware, webServiceHandler.ScanFile)
 	app.Get("/api/webservice/hards", webserviceMiddleware, webServiceHandler.GetInfo)
+	app.Get("/api/webservice/hards/search", webserviceMiddleware, webServiceHandler.SearchHards)
+	app.Get("/api/webservice/hards/fields", webserviceMiddleware, webServiceHandler.ExtraFieldSchemas)
+	app.Get("/api/webservice/hards/fields/:type", webserviceMiddleware, webServiceHandler.ExtraFieldSchema)
 	app.Get("/image/:filename", webServiceHandler.GetImage)
 	app.Post("/api/webservice/hards", webserviceMiddleware, webServiceHandler.AddHard)
 	app.Put("/api/webservice/hards/:id", webserviceMiddleware, webServiceHandler.EditHard)
+	app.Patch("/api/webservice/hards/:id", webserviceMiddleware, webServiceHandler.PatchHard)
+	app.Post("/api/webservice/hards/:id/images", webserviceMiddleware, webServiceHandler.AddImages)
+	app.Put("/api/webservice/hards/:id/images", webserviceMiddleware, webServiceHandler.ReorderImages)
+	app.Delete("/api/webservice/hards/:id/images/:filename", webserviceMiddleware, webServiceHandler.DeleteImage)
 	app.Post("/api/webservice/hards/wipe_accept", webserviceMiddleware, webServiceHandler.WipeAccept)
+	app.Get("/api/webservice/hards/:id/wipe", webserviceMiddleware, webServiceHandler.GetWipeState)
+	app.Post("/api/webservice/hards/:id/wipe", webserviceMiddleware, webServiceHandler.TransitionWipe)
+	app.Get("/api/webservice/hards/:id/wipe/events", webserviceMiddleware, webServiceHandler.GetWipeEvents)
+	app.Get("/api/webservice/psid_access", webserviceMiddleware, middlewares.WebserviceAdminMiddleware(), webServiceHandler.PsidAccessLog)
+	app.Get("/api/webservice/wipe_events/verify", webserviceMiddleware, middlewares.WebserviceAdminMiddleware(), webServiceHandler.VerifyWipeLog)
 
 	app.Post("/api/webservice/hards/link", webserviceMiddleware, webServiceHandler.GeneratePsidUrl)
+	app.Delete("/api/webservice/hards/link/:id", webserviceMiddleware, webServiceHandler.RevokePsidUrl)
+	app.Get("/api/webservice/requests", webserviceMiddleware, webServiceHandler.ListRequests)
+	app.Get("/api/webservice/requests/:id", webserviceMiddleware, webServiceHandler.GetRequest)
+	app.Post("/api/webservice/requests/qr_sheet", webserviceMiddleware, webServiceHandler.QRSheet)
+
+	webhookHandler := handlers.NewWebhookHandler(services.NewWebhookService())
+	adminMiddleware := middlewares.WebserviceAdminMiddleware()
+	app.Post("/api/webservice/webhooks", webserviceMiddleware, adminMiddleware, webhookHandler.Subscribe)
+	app.Get("/api/webservice/webhooks", webserviceMiddleware, adminMiddleware, webhookHandler.List)
+	app.Get("/api/webservice/webhooks/deliveries", webserviceMiddleware, adminMiddleware, webhookHandler.Deliveries)
+	app.Post("/api/webservice/webhooks/deliveries/:id/redeliver", webserviceMiddleware, adminMiddleware, webhookHandler.Redeliver)
+	app.Delete("/api/webservice/webhooks/:id", webserviceMiddleware, adminMiddleware, webhookHandler.Unsubscribe)
+
 	app.Delete("/api/webservice/hards", webserviceMiddleware, webServiceHandler.DeletePsid)
+	app.Delete("/api/webservice/hards/:id", webserviceMiddleware, webServiceHandler.DeleteHard)
+	app.Post("/api/webservice/hards/:id/restore", webserviceMiddleware, webServiceHandler.RestoreHard)
+	app.Delete("/api/webservice/hards/:id/purge", webserviceMiddleware, middlewares.WebserviceAdminMiddleware(), webServiceHandler.PurgeHard)
+
+	duplicateHandler := handlers.NewDuplicateHandler(services.NewDuplicateService())
+	app.Get("/api/webservice/hards/duplicates", webserviceMiddleware, duplicateHandler.List)
+	app.Post("/api/webservice/hards/duplicates/merge", webserviceMiddleware, middlewares.WebserviceAdminMiddleware(), duplicateHandler.Merge)
+
+	certificateHandler := handlers.NewCertificateHandler(services.NewCertificateService())
+	app.Post("/api/webservice/hards/:id/certificate", webserviceMiddleware, certificateHandler.IssueForHard)
+	app.Get("/api/webservice/hards/:id/certificates", webserviceMiddleware, certificateHandler.ListForHard)
+	app.Post("/api/webservice/certificates/inventory/:inventory_id", webserviceMiddleware, certificateHandler.IssueForInventory)
+	app.Get("/api/certificates/verify/:hash", certificateHandler.Verify)
+
+	// registered last so it doesn't shadow the static /hards/... routes above
+	app.Get("/api/webservice/hards/:id", webserviceMiddleware, webServiceHandler.GetHard)
 }
 
 func SetupReaderRoutes(app *fiber.App, scanService *services.ScanService, requestService *services.RequestService) {
 	readerHandler := handlers.NewReaderHandler(scanService, requestService)
-	app.Get("/api/reader/validate/:token", readerHandler.Validate)
-	app.Post("/api/reader/scan/:token", readerHandler.Scan)
-	app.Post("/api/reader/store/:token", readerHandler.Store)
+	// the lockout runs first so locked out IPs don't use up their rate limit
+	reader := app.Group("/api/reader", middlewares.ReaderLockout(), middlewares.ReaderIPLimit())
+	tokenLimit := middlewares.ReaderTokenLimit()
+	reader.Get("/validate/:token", tokenLimit, readerHandler.Validate)
+	reader.Post("/scan/:token", tokenLimit, readerHandler.Scan)
+	reader.Post("/store/:token", tokenLimit, readerHandler.Store)
+	reader.Post("/correct/:token", tokenLimit, readerHandler.Correct)
+
+	app.Get("/api/webservice/metrics/reader", middlewares.WebserviceMiddleware(), middlewares.WebserviceAdminMiddleware(), readerHandler.Metrics)
 }
@@ -0,0 +1,348 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"scanner/config"
+	"scanner/internal/repositories"
+	"scanner/internal/utils"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrNotCertifiable      = errors.New("hard has not been wiped")
+	ErrCertificateNotFound = errors.New("certificate not found")
+)
+
+// nistMethods describes the recorded wipe methods in NIST SP 800-88 terms.
+var nistMethods = map[string]string{
+	"crypto_erase": "Purge - Cryptographic Erase",
+	"overwrite":    "Clear - Overwrite",
+	"psid_revert":  "Purge - PSID Revert (TCG Opal)",
+}
+
+type CertificateService struct {
+	hardRepo        *repositories.HardRepository
+	certificateRepo *repositories.CertificateRepository
+}
+
+func NewCertificateService() *CertificateService {
+	return &CertificateService{
+		hardRepo:        repositories.NewHardRepository(),
+		certificateRepo: repositories.NewCertificateRepository(),
+	}
+}
+
+// IssueForHard certifies a single drive and returns the certificate together
+// with its PDF.
+func (s *CertificateService) IssueForHard(ctx context.Context, id, actor string) (*repositories.Certificate, []byte, error) {
+	hard, err := s.hardRepo.FindByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) || (err == nil && hard.DeletedAt != nil) {
+		return nil, nil, ErrHardNotFound
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry, ok := certificateEntry(hard)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s is %s", ErrNotCertifiable, hard.SerialNumber, hard.WipeState)
+	}
+
+	return s.issue(ctx, "", []repositories.CertificateEntry{entry}, []repositories.Hard{*hard}, actor)
+}
+
+// IssueForInventory certifies every wiped drive of an inventory batch. Drives
+// that haven't been wiped are returned in skipped and left off the document.
+func (s *CertificateService) IssueForInventory(ctx context.Context, inventoryID, actor string) (*repositories.Certificate, []byte, []string, error) {
+	hards, err := s.hardRepo.FindByInventoryID(ctx, inventoryID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(hards) == 0 {
+		return nil, nil, nil, ErrHardNotFound
+	}
+
+	entries := []repositories.CertificateEntry{}
+	certified := []repositories.Hard{}
+	skipped := []string{}
+	for _, hard := range hards {
+		entry, ok := certificateEntry(&hard)
+		if !ok {
+			skipped = append(skipped, hard.SerialNumber)
+			continue
+		}
+
+		entries = append(entries, entry)
+		certified = append(certified, hard)
+	}
+
+	if len(entries) == 0 {
+		return nil, nil, skipped, fmt.Errorf("%w: no drive of inventory %s has been wiped", ErrNotCertifiable, inventoryID)
+	}
+
+	certificate, pdf, err := s.issue(ctx, inventoryID, entries, certified, actor)
+	return certificate, pdf, skipped, err
+}
+
+func (s *CertificateService) issue(ctx context.Context, inventoryID string, entries []repositories.CertificateEntry, hards []repositories.Hard, actor string) (*repositories.Certificate, []byte, error) {
+	id := primitive.NewObjectID()
+	certificate := &repositories.Certificate{
+		ID:          id,
+		Number:      "WC-" + strings.ToUpper(id.Hex()),
+		InventoryID: inventoryID,
+		Entries:     entries,
+		IssuedBy:    actor,
+		IssuedAt:    time.Now().UTC().Truncate(time.Millisecond),
+	}
+	certificate.Hash = certificate.ComputeHash()
+
+	if err := s.certificateRepo.Insert(ctx, certificate); err != nil {
+		return nil, nil, err
+	}
+
+	return certificate, renderCertificate(certificate, hards), nil
+}
+
+// Verify looks a certificate up by the hash printed on it and reports whether
+// the stored content still produces that hash.
+func (s *CertificateService) Verify(ctx context.Context, hash string) (*repositories.Certificate, bool, error) {
+	certificate, err := s.certificateRepo.FindByHash(ctx, strings.ToLower(hash))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, ErrCertificateNotFound
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return certificate, certificate.ComputeHash() == certificate.Hash, nil
+}
+
+func (s *CertificateService) ListForHard(ctx context.Context, id string) ([]repositories.Certificate, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrHardNotFound
+	}
+
+	return s.certificateRepo.FindByHard(ctx, objID)
+}
+
+// certificateEntry builds the certified record of a drive from its last wipe,
+// and reports false if the drive has not been (successfully) wiped.
+func certificateEntry(hard *repositories.Hard) (repositories.CertificateEntry, bool) {
+	switch hard.WipeState {
+	case repositories.WipeWiped, repositories.WipeVerified, repositories.WipeDestroyed:
+	default:
+		return repositories.CertificateEntry{}, false
+	}
+
+	var wiped, verified *repositories.WipeTransition
+	for i := range hard.WipeTransitions {
+		transition := &hard.WipeTransitions[i]
+		switch transition.To {
+		case repositories.WipeWiped:
+			wiped, verified = transition, nil
+		case repositories.WipeVerified:
+			verified = transition
+		}
+	}
+
+	if wiped == nil {
+		// destroyed without ever being wiped
+		return repositories.CertificateEntry{}, false
+	}
+
+	entry := repositories.CertificateEntry{
+		HardID:       hard.ID,
+		SerialNumber: hard.SerialNumber,
+		Make:         hard.Make,
+		Model:        hard.Model,
+		Type:         hard.Type,
+		Capacity:     hard.Capacity,
+		InventoryID:  hard.InventoryID,
+		WipeState:    hard.WipeState,
+		Method:       wiped.Method,
+		Operator:     wiped.Actor,
+		WipedAt:      wiped.At,
+	}
+
+	if verified != nil {
+		verifiedAt := verified.At
+		entry.VerifiedBy = verified.Actor
+		entry.VerifiedAt = &verifiedAt
+	}
+
+	return entry, true
+}
+
+const certificateTimeFormat = "2006-01-02 15:04:05 MST"
+
+func renderCertificate(certificate *repositories.Certificate, hards []repositories.Hard) []byte {
+	doc := utils.NewPDFDocument()
+	verifyUrl := config.GetConfig().ServerConfig.BaseUrl + "/api/certificates/verify/" + certificate.Hash
+
+	header := func(page *utils.PDFPage) {
+		page.Text(50, 790, 20, true, "Certificate of Data Sanitization")
+		page.Text(50, 770, 10, false, "Media sanitization record following NIST SP 800-88 Rev. 1")
+		page.Line(50, 760, utils.PDFPageWidth-50, 760, 1)
+		page.Text(50, 740, 10, true, "Certificate No.")
+		page.Text(160, 740, 10, false, certificate.Number)
+		page.Text(50, 725, 10, true, "Issued")
+		page.Text(160, 725, 10, false, certificate.IssuedAt.Format(certificateTimeFormat)+" by "+certificate.IssuedBy)
+		if certificate.InventoryID != "" {
+			page.Text(50, 710, 10, true, "Inventory")
+			page.Text(160, 710, 10, false, certificate.InventoryID)
+		}
+	}
+
+	footer := func(page *utils.PDFPage, number, total int) {
+		page.Line(50, 110, utils.PDFPageWidth-50, 110, 0.5)
+		page.Text(50, 95, 9, true, "Verification hash (SHA-256)")
+		page.Text(50, 82, 8, false, certificate.Hash)
+		page.Text(50, 69, 8, false, "Verify at "+verifyUrl)
+		page.Text(utils.PDFPageWidth-100, 40, 8, false, fmt.Sprintf("Page %d of %d", number, total))
+	}
+
+	const rowsPerPage = 28
+	summaryPages := 0
+	if len(certificate.Entries) > 1 {
+		summaryPages = (len(certificate.Entries) + rowsPerPage - 1) / rowsPerPage
+	}
+
+	total := summaryPages + len(certificate.Entries)
+	pageNumber := 0
+	for p := 0; p < summaryPages; p++ {
+		page := doc.AddPage()
+		pageNumber++
+		header(page)
+		page.Text(50, 680, 12, true, fmt.Sprintf("Summary: %d drive(s)", len(certificate.Entries)))
+		y := 655.0
+		page.Text(50, y, 9, true, "Serial number")
+		page.Text(200, y, 9, true, "Model")
+		page.Text(340, y, 9, true, "Method")
+		page.Text(470, y, 9, true, "Completed")
+		page.Line(50, y-5, utils.PDFPageWidth-50, y-5, 0.5)
+		for _, entry := range certificate.Entries[p*rowsPerPage : min((p+1)*rowsPerPage, len(certificate.Entries))] {
+			y -= 18
+			page.Text(50, y, 9, false, entry.SerialNumber)
+			page.Text(200, y, 9, false, truncate(entry.Make+" "+entry.Model, 28))
+			page.Text(340, y, 9, false, truncate(nistMethod(entry.Method), 26))
+			page.Text(470, y, 9, false, entry.WipedAt.Format("2006-01-02"))
+		}
+
+		footer(page, pageNumber, total)
+	}
+
+	for i, entry := range certificate.Entries {
+		page := doc.AddPage()
+		pageNumber++
+		header(page)
+
+		verified := "-"
+		if entry.VerifiedAt != nil {
+			verified = entry.VerifiedAt.Format(certificateTimeFormat) + " by " + entry.VerifiedBy
+		}
+
+		rows := [][2]string{
+			{"Serial number", entry.SerialNumber},
+			{"Make", entry.Make},
+			{"Model", entry.Model},
+			{"Type", entry.Type},
+			{"Capacity", entry.Capacity},
+			{"Inventory ID", entry.InventoryID},
+			{"Sanitization method", nistMethod(entry.Method)},
+			{"Operator", entry.Operator},
+			{"Completed", entry.WipedAt.Format(certificateTimeFormat)},
+			{"Verified", verified},
+			{"Current state", string(entry.WipeState)},
+		}
+
+		y := 670.0
+		for _, row := range rows {
+			page.Text(50, y, 10, true, row[0])
+			page.Text(170, y, 10, false, truncate(row[1], 40))
+			y -= 20
+		}
+
+		if thumbnail, width, height, ok := certificateThumbnail(hards[i].Images); ok {
+			w, h := float64(width), float64(height)
+			doc.JPEG(page, thumbnail, width, height, utils.PDFPageWidth-50-w, 670-h+10, w, h)
+		}
+
+		page.Text(50, y-20, 9, false, "The storage media identified above was sanitized with the stated method and the")
+		page.Text(50, y-32, 9, false, "result recorded by the named operator.")
+		footer(page, pageNumber, total)
+	}
+
+	return doc.Bytes()
+}
+
+func nistMethod(method string) string {
+	if name, ok := nistMethods[method]; ok {
+		return name
+	}
+
+	return method
+}
+
+func truncate(value string, length int) string {
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value
+	}
+
+	return string(runes[:length-3]) + "..."
+}
+
+// certificateThumbnail scales the first readable photo of a drive down to fit
+// a 150pt box and re-encodes it as an RGB JPEG for embedding.
+func certificateThumbnail(images []string) ([]byte, int, int, bool) {
+	const box = 150
+	for _, name := range images {
+		file, err := os.Open(filepath.Join("./uploads", filepath.Base(name)))
+		if err != nil {
+			continue
+		}
+
+		src, _, err := image.Decode(file)
+		file.Close()
+		if err != nil {
+			continue
+		}
+
+		bounds := src.Bounds()
+		scale := min(float64(box)/float64(bounds.Dx()), float64(box)/float64(bounds.Dy()), 1)
+		width := max(int(float64(bounds.Dx())*scale), 1)
+		height := max(int(float64(bounds.Dy())*scale), 1)
+
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				dst.Set(x, y, src.At(bounds.Min.X+int(float64(x)/scale), bounds.Min.Y+int(float64(y)/scale)))
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+			continue
+		}
+
+		return buf.Bytes(), width, height, true
+	}
+
+	return nil, 0, 0, false
+}
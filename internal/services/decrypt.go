@@ -3,6 +3,7 @@ package services
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
@@ -10,25 +11,120 @@ import (
 	"strings"
 )
 
+var ErrUnknownReaderTokenKey = errors.New("unknown reader token key")
+
+// DecryptService reads and writes AES-256-GCM tokens in the iv.ciphertext.tag
+// layout produced by php/main.php. Tokens sealed with a named key are prefixed
+// with its id (kid.iv.ciphertext.tag) so keys can be rotated; unprefixed tokens
+// use SECRET_KEY.
 type DecryptService struct {
 	secretKey string
+	keys      map[string]cipher.AEAD
+	activeKey string
 }
 
 func NewDecryptService(secretKey string) *DecryptService {
 	return &DecryptService{
 		secretKey: secretKey,
+		keys:      map[string]cipher.AEAD{},
 	}
 }
 
-func (d *DecryptService) Decode(token string) (string, error) {
-	secret, err := hex.DecodeString(d.secretKey)
+// NewKeyedDecryptService also accepts tokens sealed with keys given as
+// "id:hexkey" pairs and seals new tokens with activeKey when it is set.
+func NewKeyedDecryptService(secretKey, keys, activeKey string) (*DecryptService, error) {
+	d := NewDecryptService(secretKey)
+	for _, pair := range strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		id, key, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("READER_TOKEN_KEYS entry %q must look like id:hexkey, with no dot in the id", pair)
+		}
+
+		gcm, err := newTokenGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("READER_TOKEN_KEYS key %s: %w", id, err)
+		}
+
+		d.keys[id] = gcm
+	}
+
+	if len(d.keys) > 0 && activeKey == "" {
+		return nil, errors.New("READER_TOKEN_ACTIVE_KEY must name one of READER_TOKEN_KEYS")
+	}
+
+	if _, ok := d.keys[activeKey]; activeKey != "" && !ok {
+		return nil, fmt.Errorf("READER_TOKEN_ACTIVE_KEY %q is not in READER_TOKEN_KEYS", activeKey)
+	}
+
+	d.activeKey = activeKey
+	return d, nil
+}
+
+func newTokenGCM(hexKey string) (cipher.AEAD, error) {
+	secret, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret: %w", err)
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		fmt.Printf("Error decoding secret: %v\n", err)
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return gcm, nil
+}
+
+func (d *DecryptService) secretGCM() (cipher.AEAD, error) {
+	return newTokenGCM(d.secretKey)
+}
+
+// Encode seals plain with the active key, or with SECRET_KEY when no key id
+// is configured.
+func (d *DecryptService) Encode(plain string) (string, error) {
+	prefix := ""
+	gcm, ok := d.keys[d.activeKey]
+	if ok {
+		prefix = d.activeKey + "."
+	} else {
+		var err error
+		if gcm, err = d.secretGCM(); err != nil {
+			return "", err
+		}
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
 		return "", err
 	}
 
+	sealed := gcm.Seal(nil, iv, []byte(plain), nil)
+	tagStart := len(sealed) - gcm.Overhead()
+	b64u := base64.RawURLEncoding.EncodeToString
+	return prefix + b64u(iv) + "." + b64u(sealed[:tagStart]) + "." + b64u(sealed[tagStart:]), nil
+}
+
+func (d *DecryptService) Decode(token string) (string, error) {
 	parts := strings.Split(token, ".")
-	if len(parts) != 3 {
+	var gcm cipher.AEAD
+	switch len(parts) {
+	case 4:
+		var ok bool
+		if gcm, ok = d.keys[parts[0]]; !ok {
+			return "", fmt.Errorf("%w: %q", ErrUnknownReaderTokenKey, parts[0])
+		}
+
+		parts = parts[1:]
+	case 3:
+		var err error
+		if gcm, err = d.secretGCM(); err != nil {
+			return "", err
+		}
+	default:
 		return "", errors.New("invalid token")
 	}
 
@@ -55,14 +151,8 @@ func (d *DecryptService) Decode(token string) (string, error) {
 		return "", fmt.Errorf("failed to decode tag: %w", err)
 	}
 
-	block, err := aes.NewCipher(secret)
-	if err != nil {
-		return "", fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+	if len(iv) != gcm.NonceSize() {
+		return "", errors.New("invalid iv length")
 	}
 
 	plain, err := gcm.Open(nil, iv, append(ciphertext, tag...), nil)
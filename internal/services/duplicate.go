@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"slices"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrMergeWipeHistory is returned when more than one of the records to merge
+// has wipe transitions; each is logged under its own record, so neither
+// history can be moved onto the other.
+var ErrMergeWipeHistory = errors.New("more than one record has a wipe history")
+
+type DuplicateService struct {
+	hardRepo *repositories.HardRepository
+}
+
+func NewDuplicateService() *DuplicateService {
+	return &DuplicateService{
+		hardRepo: repositories.NewHardRepository(),
+	}
+}
+
+type DuplicateCluster struct {
+	Key      string              `json:"key"`
+	Hards    []repositories.Hard `json:"hards"`
+	Proposal *MergeProposal      `json:"proposal"`
+}
+
+type MergeProposal struct {
+	WinnerID primitive.ObjectID   `json:"winner_id"`
+	LoserIDs []primitive.ObjectID `json:"loser_ids"`
+	Merged   repositories.Hard    `json:"merged"`
+}
+
+func (s *DuplicateService) FindClusters(ctx context.Context, fuzzy bool, limit int) ([]DuplicateCluster, error) {
+	groups, err := s.hardRepo.FindDuplicateGroups(ctx, fuzzy, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []DuplicateCluster{}
+	for _, group := range groups {
+		hards, err := s.hardRepo.FindByIDs(ctx, group.IDs)
+		if err != nil {
+			return nil, err
+		}
+
+		// clusters that can't be merged are still listed, without a proposal
+		proposal, err := proposeMerge(hards)
+		if err != nil && !errors.Is(err, ErrMergeWipeHistory) {
+			return nil, err
+		}
+
+		clusters = append(clusters, DuplicateCluster{
+			Key:      group.Key,
+			Hards:    hards,
+			Proposal: proposal,
+		})
+	}
+
+	return clusters, nil
+}
+
+func (s *DuplicateService) ProposeMerge(ctx context.Context, ids []string) (*MergeProposal, error) {
+	hards, err := s.loadActive(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return proposeMerge(hards)
+}
+
+// Merge folds the given records into the best ranked one. The losers are kept
+// but marked as merged into the winner.
+func (s *DuplicateService) Merge(ctx context.Context, ids []string, actor string) (*repositories.Hard, error) {
+	hards, err := s.loadActive(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal, err := proposeMerge(hards)
+	if err != nil {
+		return nil, err
+	}
+
+	losers := []repositories.Hard{}
+	for _, hard := range hards {
+		if slices.Contains(proposal.LoserIDs, hard.ID) {
+			losers = append(losers, hard)
+		}
+	}
+
+	loserIDs := []string{}
+	for _, id := range proposal.LoserIDs {
+		loserIDs = append(loserIDs, id.Hex())
+	}
+
+	// losers go first so the winner may take over their PSID without
+	// violating the unique (serial_number, psid) index
+	mergedInto := repositories.NewHardEvent("merged_into", actor, map[string]interface{}{
+		"winner_id": proposal.WinnerID.Hex(),
+	})
+	err = s.hardRepo.MarkMerged(ctx, losers, proposal.WinnerID, mergedInto)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := proposal.Merged
+	merged.History = append(merged.History, repositories.NewHardEvent("merged", actor, map[string]interface{}{
+		"merged_ids": loserIDs,
+	}))
+
+	err = s.hardRepo.Update(ctx, merged.ID.Hex(), &merged)
+	if err != nil {
+		// put the losers back so the records are as they were before
+		if undoErr := s.hardRepo.UnmarkMerged(ctx, proposal.LoserIDs, proposal.WinnerID, mergedInto); undoErr != nil {
+			return nil, fmt.Errorf("%w (and failed to restore the merged records: %v)", err, undoErr)
+		}
+
+		return nil, err
+	}
+
+	return &merged, nil
+}
+
+func (s *DuplicateService) loadActive(ctx context.Context, ids []string) ([]repositories.Hard, error) {
+	if len(ids) < 2 {
+		return nil, errors.New("at least two hard ids are required")
+	}
+
+	hards, err := s.hardRepo.FindByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hards) != len(ids) {
+		return nil, errors.New("some hards were not found")
+	}
+
+	for _, hard := range hards {
+		if !hard.Active {
+			return nil, fmt.Errorf("hard %s is not active", hard.ID.Hex())
+		}
+	}
+
+	return hards, nil
+}
+
+// rankHards orders records by how much their values can be trusted: the one
+// with a wipe history first, as that history stays with it, then
+// wipe-accepted, then user-edited, then the most recently updated.
+func rankHards(hards []repositories.Hard) []repositories.Hard {
+	ranked := slices.Clone(hards)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if hasA, hasB := len(a.WipeTransitions) > 0, len(b.WipeTransitions) > 0; hasA != hasB {
+			return hasA
+		}
+
+		if a.WipeAccepted != b.WipeAccepted {
+			return a.WipeAccepted
+		}
+
+		if a.UserEdited != b.UserEdited {
+			return a.UserEdited
+		}
+
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.After(b.UpdatedAt)
+		}
+
+		return a.ID.Hex() < b.ID.Hex()
+	})
+
+	return ranked
+}
+
+func proposeMerge(hards []repositories.Hard) (*MergeProposal, error) {
+	if len(hards) < 2 {
+		return nil, errors.New("at least two hards are required to merge")
+	}
+
+	withHistory := 0
+	for _, hard := range hards {
+		if len(hard.WipeTransitions) > 0 {
+			withHistory++
+		}
+	}
+
+	if withHistory > 1 {
+		return nil, ErrMergeWipeHistory
+	}
+
+	ranked := rankHards(hards)
+	merged := ranked[0]
+	merged.ExtraFields = map[string]interface{}{}
+	merged.Images = []string{}
+	merged.History = []repositories.HardEvent{}
+
+	pick := func(get func(h *repositories.Hard) *string) {
+		for i := range ranked {
+			if value := *get(&ranked[i]); value != "" {
+				*get(&merged) = value
+				return
+			}
+		}
+	}
+
+	pick(func(h *repositories.Hard) *string { return &h.Capacity })
+	pick(func(h *repositories.Hard) *string { return &h.Eui })
+	pick(func(h *repositories.Hard) *string { return &h.Type })
+	pick(func(h *repositories.Hard) *string { return &h.InventoryID })
+	pick(func(h *repositories.Hard) *string { return &h.Make })
+	pick(func(h *repositories.Hard) *string { return &h.Model })
+	pick(func(h *repositories.Hard) *string { return &h.PartNumber })
+	pick(func(h *repositories.Hard) *string { return &h.Psid })
+
+	loserIDs := []primitive.ObjectID{}
+	for i, hard := range ranked {
+		if i > 0 {
+			loserIDs = append(loserIDs, hard.ID)
+		}
+
+		// a duplicate accepted before the workflow had transitions carries its
+		// state over; a winner with transitions keeps its own, matching its log
+		if len(merged.WipeTransitions) == 0 && !merged.WipeState.Accepted() && hard.WipeState.Accepted() {
+			merged.WipeState = hard.WipeState
+			merged.WipeMethod = hard.WipeMethod
+		}
+
+		merged.WipeAccepted = merged.WipeAccepted || hard.WipeAccepted
+		merged.UserEdited = merged.UserEdited || hard.UserEdited
+
+		for key, value := range hard.ExtraFields {
+			if _, ok := merged.ExtraFields[key]; !ok {
+				merged.ExtraFields[key] = value
+			}
+		}
+
+		for _, image := range hard.Images {
+			if !slices.Contains(merged.Images, image) {
+				merged.Images = append(merged.Images, image)
+			}
+		}
+
+		merged.History = append(merged.History, hard.History...)
+
+		if hard.CreatedAt.Before(merged.CreatedAt) {
+			merged.CreatedAt = hard.CreatedAt
+		}
+	}
+
+	sort.SliceStable(merged.History, func(i, j int) bool {
+		return merged.History[i].At.Before(merged.History[j].At)
+	})
+
+	return &MergeProposal{
+		WinnerID: merged.ID,
+		LoserIDs: loserIDs,
+		Merged:   merged,
+	}, nil
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidExtraFields = errors.New("invalid extra fields")
+
+// ExtraFieldsError lists why each rejected field didn't match the schema.
+type ExtraFieldsError struct {
+	Problems map[string]string
+}
+
+func (e *ExtraFieldsError) Error() string {
+	return fmt.Sprintf("%v: %d field(s) rejected", ErrInvalidExtraFields, len(e.Problems))
+}
+
+func (e *ExtraFieldsError) Is(target error) bool {
+	return target == ErrInvalidExtraFields
+}
+
+const (
+	FieldTypeString  = "string"
+	FieldTypeInteger = "integer"
+	FieldTypeNumber  = "number"
+	FieldTypeBoolean = "boolean"
+)
+
+type FieldDefinition struct {
+	Name    string   `json:"name"`
+	Label   string   `json:"label"`
+	Type    string   `json:"type"`
+	Enum    []string `json:"enum,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	// Aliases are alternative keys, e.g. as returned by the OCR service.
+	Aliases []string `json:"aliases,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+type HardTypeSchema struct {
+	Type    string            `json:"hard_type"`
+	Aliases []string          `json:"aliases,omitempty"`
+	Fields  []FieldDefinition `json:"fields"`
+}
+
+var commonExtraFields = []FieldDefinition{
+	{Name: "form_factor", Label: "Form Factor", Type: FieldTypeString, Enum: []string{"2.5", "3.5", "M.2 2230", "M.2 2242", "M.2 2260", "M.2 2280", "U.2", "mSATA"}},
+	{Name: "interface", Label: "Interface", Type: FieldTypeString, Enum: []string{"SATA", "SAS", "NVMe", "PCIe", "IDE"}},
+	{Name: "firmware", Label: "Firmware", Type: FieldTypeString, Aliases: []string{"fw", "firmware_version"}},
+	{Name: "wwn", Label: "WWN", Type: FieldTypeString, Pattern: `^[0-9A-F]{16}$`, Aliases: []string{"world_wide_name"}},
+	{Name: "manufacture_date", Label: "Manufacture Date", Type: FieldTypeString, Aliases: []string{"date", "mfg_date"}},
+}
+
+// extraFieldSchemas holds the fields allowed on top of the main ones for each
+// hard type. The type names match the "hards" storages list.
+var extraFieldSchemas = []HardTypeSchema{
+	{
+		Type:    "SATA 2.5",
+		Aliases: []string{"HDD", "SATA"},
+		Fields: append([]FieldDefinition{
+			{Name: "rpm", Label: "RPM", Type: FieldTypeInteger, Aliases: []string{"speed"}},
+			{Name: "cache_mb", Label: "Cache (MB)", Type: FieldTypeInteger, Aliases: []string{"cache"}},
+		}, commonExtraFields...),
+	},
+	{
+		Type:    "SSD 2.5",
+		Aliases: []string{"SSD"},
+		Fields: append([]FieldDefinition{
+			{Name: "tbw", Label: "Endurance (TBW)", Type: FieldTypeNumber},
+		}, commonExtraFields...),
+	},
+	{
+		Type:    "NVME SSD",
+		Aliases: []string{"NVME", "NVME M.2"},
+		Fields: append([]FieldDefinition{
+			{Name: "tbw", Label: "Endurance (TBW)", Type: FieldTypeNumber},
+			{Name: "pcie_gen", Label: "PCIe Generation", Type: FieldTypeInteger, Aliases: []string{"pcie"}},
+		}, commonExtraFields...),
+	},
+}
+
+// compile the patterns once, coerce runs for every field OCR returns
+func init() {
+	compile := func(fields []FieldDefinition) {
+		for i := range fields {
+			if fields[i].Pattern != "" {
+				fields[i].pattern = regexp.MustCompile(fields[i].Pattern)
+			}
+		}
+	}
+
+	compile(commonExtraFields)
+	for _, schema := range extraFieldSchemas {
+		compile(schema.Fields)
+	}
+}
+
+func ExtraFieldSchemas() []HardTypeSchema {
+	return extraFieldSchemas
+}
+
+// ExtraFieldSchema returns the schema of a hard type. Unknown or empty types
+// only get the fields shared by every type.
+func ExtraFieldSchema(hardType string) HardTypeSchema {
+	normalized := strings.ToUpper(strings.TrimSpace(hardType))
+	for _, schema := range extraFieldSchemas {
+		if strings.ToUpper(schema.Type) == normalized {
+			return schema
+		}
+
+		for _, alias := range schema.Aliases {
+			if strings.ToUpper(alias) == normalized {
+				return schema
+			}
+		}
+	}
+
+	return HardTypeSchema{Type: hardType, Fields: commonExtraFields}
+}
+
+func (s HardTypeSchema) lookup(key string) (FieldDefinition, bool) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	for _, field := range s.Fields {
+		if field.Name == key {
+			return field, true
+		}
+
+		for _, alias := range field.Aliases {
+			if alias == key {
+				return field, true
+			}
+		}
+	}
+
+	return FieldDefinition{}, false
+}
+
+// ValidateExtraFields coerces fields to the schema of hardType. Values that are
+// unknown or can't be coerced are returned in quarantined together with the
+// reason in problems; callers decide whether to reject or keep them aside.
+func ValidateExtraFields(hardType string, fields map[string]interface{}) (valid map[string]interface{}, quarantined map[string]interface{}, problems map[string]string) {
+	schema := ExtraFieldSchema(hardType)
+	valid = map[string]interface{}{}
+	quarantined = map[string]interface{}{}
+	problems = map[string]string{}
+
+	for key, value := range fields {
+		field, ok := schema.lookup(key)
+		if !ok {
+			quarantined[key] = value
+			problems[key] = fmt.Sprintf("unknown field for hard type %q", schema.Type)
+			continue
+		}
+
+		coerced, err := field.coerce(value)
+		if err != nil {
+			quarantined[key] = value
+			problems[key] = err.Error()
+			continue
+		}
+
+		valid[field.Name] = coerced
+	}
+
+	return valid, quarantined, problems
+}
+
+// validateExtraFieldsStrict is used for fields sent by clients, which are
+// rejected as a whole when any of them doesn't match the schema.
+func validateExtraFieldsStrict(hardType string, fields map[string]interface{}) (map[string]interface{}, error) {
+	valid, _, problems := ValidateExtraFields(hardType, fields)
+	if len(problems) > 0 {
+		return nil, &ExtraFieldsError{Problems: problems}
+	}
+
+	return valid, nil
+}
+
+var leadingNumber = regexp.MustCompile(`^[-+]?[0-9]+(?:[.,][0-9]+)?`)
+
+func (f FieldDefinition) coerce(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, fmt.Errorf("%s must not be empty", f.Name)
+	}
+
+	text := strings.TrimSpace(fmt.Sprintf("%v", value))
+	switch f.Type {
+	case FieldTypeInteger, FieldTypeNumber:
+		// accept OCR values such as "7200 RPM" or "1,5"
+		number := leadingNumber.FindString(text)
+		parsed, err := strconv.ParseFloat(strings.ReplaceAll(number, ",", "."), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a %s", f.Name, f.Type)
+		}
+
+		if f.Type == FieldTypeInteger {
+			if parsed != float64(int64(parsed)) {
+				return nil, fmt.Errorf("%s must be an integer", f.Name)
+			}
+
+			return int64(parsed), nil
+		}
+
+		return parsed, nil
+	case FieldTypeBoolean:
+		switch strings.ToLower(text) {
+		case "true", "yes", "y", "1":
+			return true, nil
+		case "false", "no", "n", "0":
+			return false, nil
+		}
+
+		return nil, fmt.Errorf("%s must be a boolean", f.Name)
+	default:
+		if text == "" {
+			return nil, fmt.Errorf("%s must not be empty", f.Name)
+		}
+
+		if len(f.Enum) > 0 {
+			for _, option := range f.Enum {
+				if strings.EqualFold(option, text) || strings.EqualFold(option, strings.Trim(text, `"”`)) {
+					return option, nil
+				}
+			}
+
+			return nil, fmt.Errorf("%s must be one of %s", f.Name, strings.Join(f.Enum, ", "))
+		}
+
+		if f.pattern != nil {
+			text = strings.ToUpper(strings.ReplaceAll(text, " ", ""))
+			if !f.pattern.MatchString(text) {
+				return nil, fmt.Errorf("%s has an invalid format", f.Name)
+			}
+		}
+
+		return text, nil
+	}
+}
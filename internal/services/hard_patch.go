@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"scanner/internal/repositories"
+	"scanner/internal/utils"
+	"strings"
+)
+
+type PatchFormat string
+
+const (
+	// MergePatch is an RFC 7396 JSON merge patch.
+	MergePatch PatchFormat = "merge"
+	// JSONPatch is an RFC 6902 list of JSON Patch operations.
+	JSONPatch PatchFormat = "json"
+)
+
+// patchableFields maps the JSON names of the editable string fields of a hard
+// to the field itself. Everything else (id, images, wipe state, history, ...)
+// is read-only through PATCH. psid is only included for callers allowed to
+// read it, since copy, move and test operations reveal its value.
+func patchableFields(hard *repositories.Hard, psidAccess bool) map[string]*string {
+	fields := map[string]*string{
+		"capacity":      &hard.Capacity,
+		"eui":           &hard.Eui,
+		"hard_type":     &hard.Type,
+		"inventory_id":  &hard.InventoryID,
+		"make":          &hard.Make,
+		"model":         &hard.Model,
+		"part_number":   &hard.PartNumber,
+		"serial_number": &hard.SerialNumber,
+	}
+
+	if psidAccess {
+		fields["psid"] = &hard.Psid
+	}
+
+	return fields
+}
+
+// patchDocument is the JSON view of a hard that patches are applied to.
+// version is included so a patch can test it, but it can't be changed.
+func patchDocument(hard *repositories.Hard, psidAccess bool) map[string]interface{} {
+	doc := map[string]interface{}{
+		"version": float64(hard.Version),
+	}
+
+	for name, field := range patchableFields(hard, psidAccess) {
+		doc[name] = *field
+	}
+
+	extra := map[string]interface{}{}
+	for key, value := range hard.ExtraFields {
+		extra[key] = value
+	}
+
+	// round trip through JSON so values compare the same way as the patch
+	data, _ := json.Marshal(extra)
+	var decoded map[string]interface{}
+	_ = json.Unmarshal(data, &decoded)
+	if decoded == nil {
+		decoded = map[string]interface{}{}
+	}
+
+	doc["extra_fields"] = decoded
+	return doc
+}
+
+// PatchHard applies a merge patch or a JSON Patch to the editable fields of a
+// hard. Removing a field (null in a merge patch, "remove" in a JSON Patch)
+// clears it; extra fields are validated against the schema of the resulting
+// hard type before anything is saved. Without psidAccess any patch that reads
+// or writes the psid is refused with ErrPsidForbidden.
+func (s *ScanService) PatchHard(ctx context.Context, hard *repositories.Hard, format PatchFormat, body []byte, psidAccess bool, actor string) error {
+	doc := patchDocument(hard, psidAccess)
+
+	var patched interface{}
+	switch format {
+	case MergePatch:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return fmt.Errorf("%w: %v", utils.ErrInvalidPatch, err)
+		}
+
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return fmt.Errorf("%w: a merge patch must be a JSON object", utils.ErrInvalidPatch)
+		}
+
+		if _, ok := patch.(map[string]interface{})["psid"]; ok && !psidAccess {
+			return ErrPsidForbidden
+		}
+
+		patched = utils.ApplyMergePatch(doc, patch)
+	case JSONPatch:
+		var operations []utils.PatchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			return fmt.Errorf("%w: %v", utils.ErrInvalidPatch, err)
+		}
+
+		if !psidAccess {
+			for _, operation := range operations {
+				if touchesPsid(operation.Path) || touchesPsid(operation.From) {
+					return ErrPsidForbidden
+				}
+			}
+		}
+
+		var err error
+		patched, err = utils.ApplyJSONPatch(doc, operations)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unsupported patch format %q", utils.ErrInvalidPatch, format)
+	}
+
+	data, err := patchResult(hard, patched, psidAccess)
+	if err != nil {
+		return err
+	}
+
+	return s.UpdateHard(ctx, hard, data, actor)
+}
+
+// touchesPsid tells whether a JSON pointer names the psid. The whole document
+// ("") counts too, since replacing or testing it would reach the psid.
+func touchesPsid(pointer string) bool {
+	return pointer == "" || pointer == "/psid" || strings.HasPrefix(pointer, "/psid/")
+}
+
+// patchResult validates the patched document and turns it into the
+// equivalent EditHardResponse, containing only what changed.
+func patchResult(hard *repositories.Hard, patched interface{}, psidAccess bool) (EditHardResponse, error) {
+	var data EditHardResponse
+	result, ok := patched.(map[string]interface{})
+	if !ok {
+		return data, fmt.Errorf("%w: the patched document must be a JSON object", utils.ErrInvalidPatch)
+	}
+
+	fields := patchableFields(hard, psidAccess)
+	values := map[string]*string{}
+	for key, value := range result {
+		switch key {
+		case "version":
+			version, ok := value.(float64)
+			if !ok || int64(version) != hard.Version {
+				return data, repositories.ErrVersionConflict
+			}
+		case "extra_fields":
+			if _, ok := value.(map[string]interface{}); !ok && value != nil {
+				return data, fmt.Errorf("%w: extra_fields must be an object", utils.ErrInvalidPatch)
+			}
+		case "psid":
+			if !psidAccess {
+				return data, ErrPsidForbidden
+			}
+
+			fallthrough
+		default:
+			if _, ok := fields[key]; !ok {
+				return data, fmt.Errorf("%w: field %q can't be patched", utils.ErrInvalidPatch, key)
+			}
+
+			str, ok := value.(string)
+			if !ok && value != nil {
+				return data, fmt.Errorf("%w: field %q must be a string", utils.ErrInvalidPatch, key)
+			}
+
+			values[key] = &str
+		}
+	}
+
+	// fields missing from the result were removed by the patch
+	for name, field := range fields {
+		value, ok := values[name]
+		if !ok {
+			value = new(string)
+		}
+
+		if *value != *field {
+			values[name] = value
+		} else {
+			delete(values, name)
+		}
+	}
+
+	if value, ok := values["serial_number"]; ok && *value == "" {
+		return data, fmt.Errorf("%w: serial_number can't be cleared", utils.ErrInvalidPatch)
+	}
+
+	data.Capacity = values["capacity"]
+	data.Eui = values["eui"]
+	data.Type = values["hard_type"]
+	data.InventoryID = values["inventory_id"]
+	data.Make = values["make"]
+	data.Model = values["model"]
+	data.PartNumber = values["part_number"]
+	data.SerialNumber = values["serial_number"]
+	data.Psid = values["psid"]
+
+	before := patchDocument(hard, psidAccess)["extra_fields"].(map[string]interface{})
+	after, _ := result["extra_fields"].(map[string]interface{})
+	extra := map[string]interface{}{}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			extra[key] = nil
+		}
+	}
+
+	for key, value := range after {
+		if value == nil {
+			return data, fmt.Errorf("%w: extra field %q can't be null, remove it instead", utils.ErrInvalidPatch, key)
+		}
+
+		if old, ok := before[key]; !ok || !jsonValueEqual(old, value) {
+			extra[key] = value
+		}
+	}
+
+	data.ExtraFields = extra
+	return data, nil
+}
+
+func jsonValueEqual(a, b interface{}) bool {
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aj) == string(bj)
+}
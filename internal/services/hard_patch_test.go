@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"scanner/internal/repositories"
+	"scanner/internal/utils"
+	"testing"
+)
+
+func patchTestHard() *repositories.Hard {
+	return &repositories.Hard{
+		SerialNumber: "SN1",
+		Psid:         "PSID0001",
+		Make:         "WD",
+		Model:        "Blue",
+		ExtraFields:  map[string]interface{}{"rpm": int64(7200), "firmware": "01.01"},
+		Version:      3,
+	}
+}
+
+func TestPatchHardRefusesPsidWithoutAccess(t *testing.T) {
+	tests := []struct {
+		format PatchFormat
+		body   string
+	}{
+		{MergePatch, `{"psid":"PSID0002"}`},
+		{MergePatch, `{"psid":null}`},
+		{JSONPatch, `[{"op":"replace","path":"/psid","value":"PSID0002"}]`},
+		{JSONPatch, `[{"op":"test","path":"/psid","value":"PSID0001"}]`},
+		{JSONPatch, `[{"op":"copy","from":"/psid","path":"/model"}]`},
+		{JSONPatch, `[{"op":"move","from":"/psid","path":"/model"}]`},
+		{JSONPatch, `[{"op":"replace","path":"","value":{}}]`},
+	}
+
+	// refused before anything is loaded or saved, so no repository is needed
+	s := &ScanService{}
+	for _, tt := range tests {
+		err := s.PatchHard(context.Background(), patchTestHard(), tt.format, []byte(tt.body), false, "test")
+		if !errors.Is(err, ErrPsidForbidden) {
+			t.Errorf("%s %s: got %v, want ErrPsidForbidden", tt.format, tt.body, err)
+		}
+	}
+}
+
+func TestPatchDocumentHidesPsidWithoutAccess(t *testing.T) {
+	if _, ok := patchDocument(patchTestHard(), false)["psid"]; ok {
+		t.Error("psid is in the patch document without psid access")
+	}
+
+	if psid := patchDocument(patchTestHard(), true)["psid"]; psid != "PSID0001" {
+		t.Errorf("psid = %v with psid access", psid)
+	}
+}
+
+func TestPatchResult(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name       string
+		psidAccess bool
+		format     PatchFormat
+		body       string
+		want       EditHardResponse
+		err        error
+	}{
+		{
+			name:   "changed fields only",
+			format: MergePatch,
+			body:   `{"make":"WD","model":"Red"}`,
+			want:   EditHardResponse{Model: str("Red"), ExtraFields: map[string]interface{}{}},
+		},
+		{
+			name:   "null clears a field",
+			format: MergePatch,
+			body:   `{"model":null}`,
+			want:   EditHardResponse{Model: str(""), ExtraFields: map[string]interface{}{}},
+		},
+		{
+			name:   "remove clears a field",
+			format: JSONPatch,
+			body:   `[{"op":"remove","path":"/make"}]`,
+			want:   EditHardResponse{Make: str(""), ExtraFields: map[string]interface{}{}},
+		},
+		{
+			name:   "serial number can't be cleared",
+			format: MergePatch,
+			body:   `{"serial_number":null}`,
+			err:    utils.ErrInvalidPatch,
+		},
+		{
+			name:   "removed extra field becomes null",
+			format: MergePatch,
+			body:   `{"extra_fields":{"firmware":null,"rpm":5400}}`,
+			want:   EditHardResponse{ExtraFields: map[string]interface{}{"firmware": nil, "rpm": float64(5400)}},
+		},
+		{
+			name:   "unchanged extra field is left out",
+			format: JSONPatch,
+			body:   `[{"op":"add","path":"/extra_fields/cache_mb","value":64}]`,
+			want:   EditHardResponse{ExtraFields: map[string]interface{}{"cache_mb": float64(64)}},
+		},
+		{
+			name:   "extra field set to null by a json patch",
+			format: JSONPatch,
+			body:   `[{"op":"replace","path":"/extra_fields/firmware","value":null}]`,
+			err:    utils.ErrInvalidPatch,
+		},
+		{
+			name:   "extra_fields must stay an object",
+			format: JSONPatch,
+			body:   `[{"op":"replace","path":"/extra_fields","value":"x"}]`,
+			err:    utils.ErrInvalidPatch,
+		},
+		{
+			name:   "read-only field",
+			format: MergePatch,
+			body:   `{"images":["a.jpg"]}`,
+			err:    utils.ErrInvalidPatch,
+		},
+		{
+			name:   "non-string field",
+			format: MergePatch,
+			body:   `{"model":5}`,
+			err:    utils.ErrInvalidPatch,
+		},
+		{
+			name:   "stale version",
+			format: JSONPatch,
+			body:   `[{"op":"replace","path":"/version","value":2}]`,
+			err:    repositories.ErrVersionConflict,
+		},
+		{
+			name:   "version test passes",
+			format: JSONPatch,
+			body:   `[{"op":"test","path":"/version","value":3},{"op":"replace","path":"/model","value":"Red"}]`,
+			want:   EditHardResponse{Model: str("Red"), ExtraFields: map[string]interface{}{}},
+		},
+		{
+			name:       "psid with access",
+			psidAccess: true,
+			format:     JSONPatch,
+			body:       `[{"op":"copy","from":"/psid","path":"/model"}]`,
+			want:       EditHardResponse{Model: str("PSID0001"), ExtraFields: map[string]interface{}{}},
+		},
+	}
+
+	for _, tt := range tests {
+		hard := patchTestHard()
+		doc := patchDocument(hard, tt.psidAccess)
+
+		var patched interface{}
+		if tt.format == MergePatch {
+			patched = utils.ApplyMergePatch(doc, decodeTestJSON(t, tt.body))
+		} else {
+			var err error
+			patched, err = utils.ApplyJSONPatch(doc, decodeTestOperations(t, tt.body))
+			if err != nil {
+				t.Fatalf("%s: apply: %v", tt.name, err)
+			}
+		}
+
+		got, err := patchResult(hard, patched, tt.psidAccess)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if !jsonValueEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPatchResultRefusesPsidWithoutAccess(t *testing.T) {
+	hard := patchTestHard()
+	patched := patchDocument(hard, false)
+	patched["psid"] = "PSID0002"
+
+	if _, err := patchResult(hard, patched, false); !errors.Is(err, ErrPsidForbidden) {
+		t.Errorf("got %v, want ErrPsidForbidden", err)
+	}
+}
+
+func decodeTestJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+
+	return value
+}
+
+func decodeTestOperations(t *testing.T, data string) []utils.PatchOperation {
+	t.Helper()
+
+	var operations []utils.PatchOperation
+	if err := json.Unmarshal([]byte(data), &operations); err != nil {
+		t.Fatalf("decode %s: %v", data, err)
+	}
+
+	return operations
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"context"
+	"scanner/internal/repositories"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PsidAccessService struct {
+	psidAccessRepo *repositories.PsidAccessRepository
+}
+
+func NewPsidAccessService() *PsidAccessService {
+	return &PsidAccessService{
+		psidAccessRepo: repositories.NewPsidAccessRepository(),
+	}
+}
+
+func (s *PsidAccessService) Record(ctx context.Context, access repositories.PsidAccess) error {
+	access.At = time.Now().UTC()
+	return s.psidAccessRepo.Insert(ctx, &access)
+}
+
+func (s *PsidAccessService) List(ctx context.Context, hardID string, limit int64) ([]repositories.PsidAccess, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	if hardID == "" {
+		return s.psidAccessRepo.Find(ctx, nil, limit)
+	}
+
+	objID, err := primitive.ObjectIDFromHex(hardID)
+	if err != nil {
+		return nil, ErrHardNotFound
+	}
+
+	return s.psidAccessRepo.Find(ctx, &objID, limit)
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"scanner/config"
+	"scanner/internal/utils"
+	"strings"
+	"time"
+)
+
+var ErrInvalidQRFormat = errors.New("invalid QR code format")
+
+// ReaderURL is the page a technician opens to scan drives for link, which is
+// a request UUID or an encrypted reader token.
+func ReaderURL(link string) string {
+	cfg := config.GetConfig().ServerConfig
+	return strings.TrimRight(cfg.BaseUrl, "/") + "/" + strings.Trim(cfg.ReaderPath, "/") + "/" + link
+}
+
+// ReaderQRCode renders the reader URL of link as a data URI, in "png" or
+// "svg" format, ready to be put in an <img> tag.
+func ReaderQRCode(link, format string) (string, error) {
+	code, err := utils.NewQRCode([]byte(ReaderURL(link)))
+	if err != nil {
+		return "", err
+	}
+
+	switch format {
+	case "png":
+		data, err := code.PNG(8)
+		if err != nil {
+			return "", err
+		}
+
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+	case "svg":
+		return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(code.SVG())), nil
+	default:
+		return "", fmt.Errorf("%w: %q, expected png or svg", ErrInvalidQRFormat, format)
+	}
+}
+
+type qrSheetEntry struct {
+	link      string
+	serials   []string
+	expiresAt time.Time
+}
+
+// QRSheet renders a printable A4 sheet with a labelled QR code for each link,
+// twelve to a page. Links are resolved like the reader does, so revoked,
+// expired and completed links are refused and a stale code never ends up on
+// the bench. Each code is labelled with the serials still waiting for a PSID.
+func (r *RequestService) QRSheet(ctx context.Context, links []string) ([]byte, error) {
+	entries := []qrSheetEntry{}
+	for _, link := range links {
+		request, err := r.resolveRequest(ctx, link)
+		if err != nil {
+			return nil, err
+		}
+
+		serials, err := outstandingSerials(request)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, request.UUid)
+		}
+
+		entries = append(entries, qrSheetEntry{
+			link:      link,
+			serials:   serials,
+			expiresAt: request.ExpiresAt,
+		})
+	}
+
+	return renderQRSheet(entries)
+}
+
+func renderQRSheet(entries []qrSheetEntry) ([]byte, error) {
+	const (
+		columns  = 3
+		rows     = 4
+		cellW    = (utils.PDFPageWidth - 60) / columns
+		cellH    = (utils.PDFPageHeight - 80) / rows
+		codeSide = 130.0
+	)
+
+	doc := utils.NewPDFDocument()
+	var page *utils.PDFPage
+	for i, entry := range entries {
+		slot := i % (columns * rows)
+		if slot == 0 {
+			page = doc.AddPage()
+			page.Text(30, utils.PDFPageHeight-35, 12, true, "PSID reader links")
+			page.Text(utils.PDFPageWidth-190, utils.PDFPageHeight-35, 9, false, "Printed "+time.Now().UTC().Format("2006-01-02 15:04 MST"))
+		}
+
+		code, err := utils.NewQRCode([]byte(ReaderURL(entry.link)))
+		if err != nil {
+			return nil, err
+		}
+
+		x := 30 + float64(slot%columns)*cellW
+		top := utils.PDFPageHeight - 50 - float64(slot/columns)*cellH
+		page.Rect(x+4, top-cellH+8, cellW-8, cellH-8, 0.3)
+		page.DrawQRCode(code, x+(cellW-codeSide)/2, top-codeSide-6, codeSide)
+
+		y := top - codeSide - 20
+		serials := entry.serials
+		if len(serials) > 3 {
+			serials = append(serials[:2:2], fmt.Sprintf("+%d more", len(entry.serials)-2))
+		}
+
+		for _, serial := range serials {
+			page.Text(x+12, y, 8, true, truncate(serial, 34))
+			y -= 11
+		}
+
+		page.Text(x+12, y, 7, false, "Expires "+entry.expiresAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+
+	if len(entries) == 0 {
+		doc.AddPage()
+	}
+
+	return doc.Bytes(), nil
+}
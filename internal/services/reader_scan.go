@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"scanner/config"
+	"scanner/internal/repositories"
+	"scanner/internal/utils"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrScanNotFound     = errors.New("scan not found or already used")
+	ErrScanLimitReached = errors.New("scan limit reached for this serial number")
+)
+
+// ReserveScan takes one of the OCR scans allowed per serial of a request
+// before the paid OCR call is made.
+func (r *RequestService) ReserveScan(ctx context.Context, requestID, serialNumber string) error {
+	max := config.GetConfig().ReaderLimits.ScansPerSerial
+	if max <= 0 {
+		return nil
+	}
+
+	err := r.requestRepo.ReserveScan(ctx, requestID, serialNumber, max)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("%w: %d scans allowed", ErrScanLimitReached, max)
+	}
+
+	return err
+}
+
+// RecordScan keeps the images uploaded for serialNumber and the PSID OCR read
+// from them. The reader stores a PSID by referring to the returned scan.
+func (r *RequestService) RecordScan(ctx context.Context, link *ReaderLink, serialNumber string, images []string, ocrPsid string) (*repositories.ReaderScan, error) {
+	now := time.Now().UTC()
+	scan := &repositories.ReaderScan{
+		ScanID:       uuid.New().String(),
+		RequestID:    link.RequestID,
+		SerialNumber: serialNumber,
+		Images:       images,
+		OcrPsid:      utils.MaskPsid(ocrPsid),
+		OcrPsidIndex: utils.GetPsidCipher().BlindIndex(normalizePsid(ocrPsid)),
+		CreatedAt:    now,
+		ExpiresAt:    link.ExpiresAt,
+	}
+
+	if err := r.scanRepo.Insert(ctx, scan); err != nil {
+		return nil, err
+	}
+
+	// the scan is usable even if the request's progress can't be updated
+	if err := r.MarkScanned(ctx, link.RequestID, serialNumber, images); err != nil {
+		log.Printf("Failed to record scan of %s for request %s: %v", serialNumber, link.RequestID, err)
+	}
+
+	return scan, nil
+}
+
+// TakeScan claims the scan a PSID is being stored for. A scan belongs to one
+// serial of one request and is used once; callers must ReleaseScan it when
+// storing fails so the reader can try again.
+func (r *RequestService) TakeScan(ctx context.Context, scanID, requestID, serialNumber string) (*repositories.ReaderScan, error) {
+	scan, err := r.scanRepo.Claim(ctx, scanID, requestID, serialNumber)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrScanNotFound
+	}
+
+	return scan, err
+}
+
+// ReleaseScan gives back a scan taken with TakeScan that nothing was stored
+// for.
+func (r *RequestService) ReleaseScan(ctx context.Context, scan *repositories.ReaderScan) {
+	if err := r.scanRepo.Release(ctx, scan.ScanID); err != nil {
+		log.Printf("Failed to release scan %s of request %s: %v", scan.ScanID, scan.RequestID, err)
+	}
+}
+
+// PsidMismatch reports whether psid differs from what OCR read for scan,
+// including when OCR read nothing.
+func PsidMismatch(scan *repositories.ReaderScan, psid string) bool {
+	return scan.OcrPsidIndex != utils.GetPsidCipher().BlindIndex(normalizePsid(psid))
+}
+
+func normalizePsid(psid string) string {
+	return strings.ToUpper(strings.TrimSpace(psid))
+}
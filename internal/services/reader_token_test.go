@@ -0,0 +1,134 @@
+package services_test
+
+import (
+	"errors"
+	"scanner/internal/services"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures below are sealed the way php/main.php does it (AES-256-GCM,
+// 12 byte IV, b64url(iv).b64url(ciphertext).b64url(tag)) with the fixed IV
+// "0123456789ab" so they stay stable.
+const (
+	testSecretKey = "b2e32f9dd1a8c4e9ef6b339c8c373eab85a9cda934f3dfc2b88d7c5c4bb1e8f0"
+	testKeyring   = "k1:3f1c5a7e9b2d4f6081a3c5e7f9b1d3f5a7c9e1b3d5f7a9c1e3b5d7f9a1c3e5f7"
+
+	// {"inventory_id":"12345ABC","serial_numbers":["S98765"],"exp":1767225600,"nonce":"8f14e45fceea167a5a36dedd4bea2543"}
+	phpToken      = "MDEyMzQ1Njc4OWFi.D8QpLlmMq-vs_O0dx6IqEPpUvyIbkLf_801XQ3LpEAysOh1WCWC8Nxh0stiBmjP8-WE9OpdpGMlkXSmzVYm61NN_u6pQQgvxui3VNpxuAEQGpK2Rd5MjPU8EK6TNV1QQ1Pk8RW5UnMELas_LFCAaTQt8PQ.-ysaRaWGN9W2UxBQQ_53Ig"
+	phpKeyedToken = "k1.MDEyMzQ1Njc4OWFi.-SieEt0e4ageCRDSoQ-BhKRPFOGzqYlnU-PbwhfL76hucolqL_6UqhCLtXxUk44Xm4-CkczIDld2i3LyKRG54w2ZE79L0BgZrW5MtJO-Pp5Y4PXhW_CtIVIGR2S64VsqQi594BHkXE_Fs5ePM9c528WHBQ.-5oPl9lxe3VTxI1Cp85FWw"
+
+	// {"inventory_id":"12345ABC","serial_numbers":["S98765"],"exp":4102444800,"nonce":"8f14e45fceea167a5a36dedd4bea2543"}
+	phpTokenFarExp = "MDEyMzQ1Njc4OWFi.D8QpLlmMq-vs_O0dx6IqEPpUvyIbkLf_801XQ3LpEAysOh1WCWC8Nxh0stiBmjP8-WE9OpdpGMlkXSmzVYy80tZ5vateQgvxui3VNpxuAEQGpK2Rd5MjPU8EK6TNV1QQ1Pk8RW5UnMELas_LFCAaTQt8PQ.sbIebGIXC3vFkg1_bV7crg"
+
+	// {"serial_numbers":["S98765"],"nonce":"8f14e45fceea167a5a36dedd4bea2543"}
+	phpTokenNoExp = "MDEyMzQ1Njc4OWFi.D8QzJV2ApPPc4OEvzKN6Wfpf1jN8nM6KhlpZPC2uDAqjNScaRi_mNFsz9dbv3gOgpDc6OYJVAYoyEz30C9y5gIEsu6pSQRmg.Z6AHM1G2D1djU-qzmi01UA"
+
+	// {"serial_numbers":["S98765"],"exp":4102444800}
+	phpTokenNoNonce = "MDEyMzQ1Njc4OWFi.D8QzJV2ApPPc4OEvzKN6Wfpf1jN8nM6KhlpZPC2uBx29dHgMTT3sZl4zqNLqxQ.kFsVXOtTt3ywUgzG0yPgrQ"
+)
+
+func keyedService(t *testing.T, active string) *services.DecryptService {
+	t.Helper()
+
+	d, err := services.NewKeyedDecryptService(testSecretKey, testKeyring, active)
+	if err != nil {
+		t.Fatalf("NewKeyedDecryptService: %v", err)
+	}
+
+	return d
+}
+
+func TestReaderTokenRoundTrip(t *testing.T) {
+	expiresAt := time.Now().Add(72 * time.Hour).Unix()
+	for name, d := range map[string]*services.DecryptService{
+		"secret": services.NewDecryptService(testSecretKey),
+		"keyed":  keyedService(t, "k1"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			link, err := d.EncodeReaderToken(services.ReaderToken{
+				InventoryID:   "INV-1",
+				SerialNumbers: []string{"S1", "S2"},
+				ExpiresAt:     expiresAt,
+				Nonce:         "abc",
+			})
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			if name == "keyed" && !strings.HasPrefix(link, "k1.") {
+				t.Errorf("link %q is not prefixed with the active key id", link)
+			}
+
+			token, err := d.DecodeReaderToken(link)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			if token.InventoryID != "INV-1" || strings.Join(token.Serials(), ",") != "S1,S2" ||
+				token.ExpiresAt != expiresAt || token.Nonce != "abc" {
+				t.Errorf("decoded %+v", token)
+			}
+		})
+	}
+}
+
+func TestDecodePhpReaderToken(t *testing.T) {
+	d := keyedService(t, "k1")
+	for _, link := range []string{phpToken, phpKeyedToken} {
+		token, err := d.DecodeReaderToken(link)
+		if err != nil {
+			t.Fatalf("decode %.12s...: %v", link, err)
+		}
+
+		if token.InventoryID != "12345ABC" || len(token.Serials()) != 1 || token.Serials()[0] != "S98765" ||
+			token.ExpiresAt != 1767225600 || token.Nonce != "8f14e45fceea167a5a36dedd4bea2543" {
+			t.Errorf("decoded %+v", token)
+		}
+	}
+}
+
+func TestDecodeReaderTokenRejects(t *testing.T) {
+	d := keyedService(t, "k1")
+	tests := map[string]string{
+		"no exp":      phpTokenNoExp,
+		"no nonce":    phpTokenNoNonce,
+		"far exp":     phpTokenFarExp,
+		"unknown kid": "k9." + strings.TrimPrefix(phpKeyedToken, "k1."),
+		"tampered":    phpToken[:len(phpToken)-2] + "AA",
+	}
+
+	for name, link := range tests {
+		if _, err := d.DecodeReaderToken(link); !errors.Is(err, services.ErrInvalidReaderToken) {
+			t.Errorf("%s: got %v, want ErrInvalidReaderToken", name, err)
+		}
+	}
+
+	_, err := d.Decode("k9." + strings.TrimPrefix(phpKeyedToken, "k1."))
+	if !errors.Is(err, services.ErrUnknownReaderTokenKey) {
+		t.Errorf("unknown kid: got %v, want ErrUnknownReaderTokenKey", err)
+	}
+}
+
+func TestNewKeyedDecryptServiceErrors(t *testing.T) {
+	tests := []struct {
+		keys, active, want string
+	}{
+		{testKeyring, "k2", `READER_TOKEN_ACTIVE_KEY "k2" is not in READER_TOKEN_KEYS`},
+		{testKeyring, "", "READER_TOKEN_ACTIVE_KEY must name one of READER_TOKEN_KEYS"},
+		{"k1", "k1", "READER_TOKEN_KEYS entry"},
+		{"k1:zz", "k1", "READER_TOKEN_KEYS key k1"},
+	}
+
+	for _, tt := range tests {
+		_, err := services.NewKeyedDecryptService(testSecretKey, tt.keys, tt.active)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("keys %q active %q: got %v, want %q", tt.keys, tt.active, err, tt.want)
+		}
+
+		if err != nil && strings.Contains(err.Error(), "PSID") {
+			t.Errorf("keys %q active %q: error mentions PSID: %v", tt.keys, tt.active, err)
+		}
+	}
+}
@@ -2,29 +2,83 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"scanner/config"
 	"scanner/internal/repositories"
+	"scanner/internal/utils"
+	"time"
 
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxPsidLinkTTL caps the lifetime a caller may ask for.
+const maxPsidLinkTTL = 30 * 24 * time.Hour
+
+var (
+	ErrRequestNotFound  = errors.New("request not found")
+	ErrRequestExpired   = errors.New("request link has expired")
+	ErrRequestRevoked   = errors.New("request link has been revoked")
+	ErrRequestCompleted = errors.New("request link has already been used for every serial number")
+	ErrInvalidLinkTTL   = errors.New("invalid link lifetime")
+
+	ErrInvalidRequestStatus = errors.New("invalid request status")
 )
 
 type RequestService struct {
 	requestRepo *repositories.RequestRepo
+	scanRepo    *repositories.ReaderScanRepo
+	tokens      *DecryptService
+	webhooks    *WebhookService
 }
 
 func NewRequestService() *RequestService {
+	cfg := config.GetConfig().ServerConfig
+	tokens, err := NewKeyedDecryptService(cfg.SecretKey, cfg.ReaderTokenKeys, cfg.ReaderTokenActiveKey)
+	if err != nil {
+		log.Fatalf("Failed to initialize reader tokens: %v", err)
+	}
+
 	return &RequestService{
 		requestRepo: repositories.NewRequestRepo(),
+		scanRepo:    repositories.NewReaderScanRepo(),
+		tokens:      tokens,
+		webhooks:    NewWebhookService(),
 	}
 }
 
-func (r *RequestService) FindExistingSerialNumbers(ctx context.Context, serialNumbers []string) (*repositories.Request, error) {
-	return r.requestRepo.FindBySerials(ctx, serialNumbers)
+// CreateRequest creates a reader link for serialNumbers that expires after ttl,
+// or after the configured PSID_LINK_TTL when ttl is zero.
+func (r *RequestService) CreateRequest(ctx context.Context, serialNumbers []string, ttl time.Duration, actor string) (*repositories.Request, error) {
+	request, err := newRequest(uuid.New().String(), serialNumbers, ttl, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.requestRepo.Create(ctx, request)
 }
 
-func (r *RequestService) CreateRequest(ctx context.Context, serialNumbers []string) (*repositories.Request, error) {
+func newRequest(id string, serialNumbers []string, ttl time.Duration, actor string) (*repositories.Request, error) {
+	if ttl == 0 {
+		ttl = config.GetConfig().Webservice.PsidLinkTTL
+	}
+
+	if ttl <= 0 || ttl > maxPsidLinkTTL {
+		return nil, fmt.Errorf("%w: must be between 0 and %s", ErrInvalidLinkTTL, maxPsidLinkTTL)
+	}
+
+	now := time.Now().UTC()
 	request := &repositories.Request{
 		SerialNumbers: []repositories.SerialCondition{},
-		UUid:          uuid.New().String(),
+		UUid:          id,
+		Status:        repositories.RequestActive,
+		CreatedBy:     actor,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl).Truncate(time.Second),
 	}
 
 	for _, sn := range serialNumbers {
@@ -34,15 +88,171 @@ func (r *RequestService) CreateRequest(ctx context.Context, serialNumbers []stri
 		})
 	}
 
-	return r.requestRepo.Create(ctx, request)
+	return request, nil
+}
+
+// CreateTokenRequest issues a self-contained encrypted reader link. The
+// request is stored as well so the link can be listed and revoked before the
+// reader first opens it.
+func (r *RequestService) CreateTokenRequest(ctx context.Context, inventoryID string, serialNumbers []string, ttl time.Duration, actor string) (*repositories.Request, string, error) {
+	nonce, err := NewReaderTokenNonce()
+	if err != nil {
+		return nil, "", err
+	}
+
+	request, err := newRequest(nonce, serialNumbers, ttl, actor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	request.Token = true
+	request.InventoryID = inventoryID
+
+	token, err := r.tokens.EncodeReaderToken(ReaderToken{
+		InventoryID:   inventoryID,
+		SerialNumbers: serialNumbers,
+		ExpiresAt:     request.ExpiresAt.Unix(),
+		Nonce:         nonce,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	request, err = r.requestRepo.Create(ctx, request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return request, token, nil
+}
+
+// ResolveLink returns the id under which a reader link's progress is tracked
+// and the serial numbers that still need a PSID. The link is either a request
+// UUID or an encrypted token; a token seen for the first time is recorded so
+// serials stored through it aren't offered again.
+func (r *RequestService) ResolveLink(ctx context.Context, link string) (string, []string, error) {
+	request, err := r.resolveRequest(ctx, link)
+	if err != nil {
+		return "", nil, err
+	}
+
+	serials, err := outstandingSerials(request)
+	return request.UUid, serials, err
+}
+
+// ReaderLink is what a reader link gives access to: the serials still waiting
+// for a PSID and those stored already, which can be corrected until the link
+// expires or is revoked.
+type ReaderLink struct {
+	RequestID string
+	ExpiresAt time.Time
+	Pending   []string
+	Stored    []repositories.SerialCondition
+}
+
+// ResolveReaderLink is ResolveLink for readers that also work on stored
+// serials, so a completed request is not an error.
+func (r *RequestService) ResolveReaderLink(ctx context.Context, link string) (*ReaderLink, error) {
+	request, err := r.resolveRequest(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := outstandingSerials(request)
+	if err != nil && !errors.Is(err, ErrRequestCompleted) {
+		return nil, err
+	}
+
+	state := &ReaderLink{
+		RequestID: request.UUid,
+		ExpiresAt: request.ExpiresAt,
+		Pending:   pending,
+		Stored:    []repositories.SerialCondition{},
+	}
+
+	if state.Pending == nil {
+		state.Pending = []string{}
+	}
+
+	for _, condition := range request.SerialNumbers {
+		if condition.PsidStore {
+			state.Stored = append(state.Stored, condition)
+		}
+	}
+
+	return state, nil
+}
+
+func (r *RequestService) resolveRequest(ctx context.Context, link string) (*repositories.Request, error) {
+	if !IsReaderToken(link) {
+		request, err := r.requestRepo.FindByID(ctx, link)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrRequestNotFound
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// a token nonce is not a link by itself
+		if request.Token {
+			return nil, ErrRequestNotFound
+		}
+
+		return request, nil
+	}
+
+	token, err := r.tokens.DecodeReaderToken(link)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRequestNotFound, err)
+	}
+
+	if time.Now().After(token.Expiry()) {
+		return nil, ErrRequestExpired
+	}
+
+	request := &repositories.Request{
+		SerialNumbers: []repositories.SerialCondition{},
+		UUid:          token.Nonce,
+		Status:        repositories.RequestActive,
+		CreatedAt:     time.Now().UTC(),
+		ExpiresAt:     token.Expiry(),
+		Token:         true,
+		InventoryID:   token.InventoryID,
+	}
+
+	for _, sn := range token.Serials() {
+		request.SerialNumbers = append(request.SerialNumbers, repositories.SerialCondition{
+			SerialNumber: sn,
+		})
+	}
+
+	return r.requestRepo.Ensure(ctx, request)
 }
 
+// GetRequestByID returns the serial numbers of a usable link that still need
+// a PSID, or the reason the link can't be used.
 func (r *RequestService) GetRequestByID(ctx context.Context, uuid string) ([]string, error) {
-	reques, err := r.requestRepo.FindByID(ctx, uuid)
+	if IsReaderToken(uuid) {
+		return nil, ErrRequestNotFound
+	}
+
+	request, err := r.resolveRequest(ctx, uuid)
 	if err != nil {
 		return nil, err
 	}
 
+	return outstandingSerials(request)
+}
+
+func outstandingSerials(reques *repositories.Request) ([]string, error) {
+	switch {
+	case reques.Status == repositories.RequestRevoked:
+		return nil, ErrRequestRevoked
+	case reques.Expired():
+		return nil, ErrRequestExpired
+	}
+
 	serials := []string{}
 	for _, sc := range reques.SerialNumbers {
 		if sc.PsidStore {
@@ -52,9 +262,142 @@ func (r *RequestService) GetRequestByID(ctx context.Context, uuid string) ([]str
 		serials = append(serials, sc.SerialNumber)
 	}
 
+	if len(serials) == 0 {
+		return nil, ErrRequestCompleted
+	}
+
 	return serials, nil
 }
 
-func (r *RequestService) UpdatePsidStore(ctx context.Context, uuid string, serialNumber string) error {
+// UpdatePsidStore marks serialNumber as stored and reports whether that
+// completed the request. Callers announce completion with NotifyCompleted
+// once the serial's hard is linked, so request.completed follows the last
+// serial.stored.
+func (r *RequestService) UpdatePsidStore(ctx context.Context, uuid string, serialNumber string) (bool, error) {
 	return r.requestRepo.UpdatePsidStore(ctx, uuid, serialNumber)
 }
+
+func (r *RequestService) NotifyCompleted(ctx context.Context, uuid string) {
+	r.emit(ctx, repositories.WebhookEvent{
+		Type:      repositories.EventRequestCompleted,
+		RequestID: uuid,
+	})
+}
+
+// emit queues a webhook event. Failing to queue one doesn't fail the reader.
+func (r *RequestService) emit(ctx context.Context, event repositories.WebhookEvent) {
+	if err := r.webhooks.Emit(ctx, event); err != nil {
+		log.Printf("Failed to queue %s for request %s: %v", event.Type, event.RequestID, err)
+	}
+}
+
+func (r *RequestService) RevokeRequest(ctx context.Context, uuid, actor string) (*repositories.Request, error) {
+	request, err := r.requestRepo.Revoke(ctx, uuid, actor)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRequestNotFound
+	}
+
+	return request, err
+}
+
+// GetRequest returns a request with its per-serial progress. Unlike
+// GetRequestByID it also returns revoked, expired and completed requests.
+func (r *RequestService) GetRequest(ctx context.Context, uuid string) (*repositories.Request, error) {
+	request, err := r.requestRepo.FindByID(ctx, uuid)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRequestNotFound
+	}
+
+	return request, err
+}
+
+// ListRequests lists requests, newest first, optionally only those with the
+// given effective status.
+func (r *RequestService) ListRequests(ctx context.Context, status string, limit int64) ([]repositories.Request, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{}
+	switch status {
+	case "":
+	case repositories.RequestActive:
+		filter = bson.M{"status": repositories.RequestActive, "expires_at": bson.M{"$gt": now}}
+	case repositories.RequestExpired:
+		filter = bson.M{"status": repositories.RequestActive, "expires_at": bson.M{"$lte": now}}
+	case repositories.RequestCompleted, repositories.RequestRevoked:
+		filter = bson.M{"status": status}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRequestStatus, status)
+	}
+
+	return r.requestRepo.List(ctx, filter, limit)
+}
+
+// MarkScanned records that the reader uploaded images for serialNumber.
+func (r *RequestService) MarkScanned(ctx context.Context, uuid, serialNumber string, images []string) error {
+	return r.requestRepo.UpdateSerial(ctx, uuid, serialNumber, bson.M{
+		"$set":  bson.M{"state": repositories.SerialScanned, "scanned_at": time.Now().UTC()},
+		"$push": bson.M{"images": bson.M{"$each": images}},
+	})
+}
+
+// MarkConflict records that the PSID sent for serialNumber belongs to an
+// existing hard. The serial stays open so the reader can try again.
+func (r *RequestService) MarkConflict(ctx context.Context, uuid, serialNumber string, hardID primitive.ObjectID) error {
+	return r.requestRepo.UpdateSerial(ctx, uuid, serialNumber, bson.M{
+		"$set": bson.M{"state": repositories.SerialConflict, "hard_id": hardID},
+	})
+}
+
+// MarkStored links the serial of scan to the hard created for it and records
+// the attempt.
+func (r *RequestService) MarkStored(ctx context.Context, scan *repositories.ReaderScan, psid string, hardID primitive.ObjectID) error {
+	return r.recordAttempt(ctx, scan, psid, hardID, repositories.AttemptStored)
+}
+
+// MarkCorrected links the serial of scan to the hard that replaced the one
+// stored with a wrong PSID. The earlier attempts are kept.
+func (r *RequestService) MarkCorrected(ctx context.Context, scan *repositories.ReaderScan, psid string, hardID primitive.ObjectID) error {
+	return r.recordAttempt(ctx, scan, psid, hardID, repositories.AttemptCorrected)
+}
+
+func (r *RequestService) recordAttempt(ctx context.Context, scan *repositories.ReaderScan, psid string, hardID primitive.ObjectID, outcome string) error {
+	if err := r.scanRepo.MarkUsed(ctx, scan.ScanID, hardID); err != nil {
+		return err
+	}
+
+	attempt := repositories.PsidAttempt{
+		Psid:         utils.MaskPsid(psid),
+		PsidMismatch: PsidMismatch(scan, psid),
+		HardID:       hardID,
+		ScanID:       scan.ScanID,
+		Outcome:      outcome,
+		At:           time.Now().UTC(),
+	}
+
+	set := bson.M{"hard_id": hardID}
+	if outcome == repositories.AttemptCorrected {
+		set["state"] = repositories.SerialStored
+		set["stored_at"] = attempt.At
+	}
+
+	err := r.requestRepo.UpdateSerial(ctx, scan.RequestID, scan.SerialNumber, bson.M{
+		"$set":  set,
+		"$push": bson.M{"attempts": attempt},
+	})
+	if err != nil {
+		return err
+	}
+
+	r.emit(ctx, repositories.WebhookEvent{
+		Type:         repositories.EventSerialStored,
+		RequestID:    scan.RequestID,
+		SerialNumber: scan.SerialNumber,
+		HardID:       &hardID,
+		Corrected:    outcome == repositories.AttemptCorrected,
+	})
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// How OpenLink treats serial numbers that are already pending in another
+// usable request.
+const (
+	// OverlapReject refuses the link and reports where the serials are pending.
+	OverlapReject = "reject"
+	// OverlapSplit leaves pending serials where they are and links the rest.
+	OverlapSplit = "split"
+	// OverlapMerge adds the remaining serials to the one request holding the
+	// pending ones, so the technician keeps using the same link.
+	OverlapMerge = "merge"
+)
+
+// Where a serial number of an OpenLink call ended up.
+const (
+	AssignedNew      = "new"
+	AssignedExisting = "existing"
+	AssignedMerged   = "merged"
+)
+
+var (
+	ErrNoSerialNumbers = errors.New("serial_numbers is required")
+	ErrInvalidOverlap  = errors.New("invalid overlap mode")
+	ErrSerialsPending  = errors.New("serial numbers are already pending in other requests")
+)
+
+type SerialAssignment struct {
+	SerialNumber string `json:"serial_number"`
+	RequestID    string `json:"request_id"`
+	Outcome      string `json:"outcome"`
+}
+
+// OverlapError lists the serial numbers that are pending elsewhere.
+type OverlapError struct {
+	Reason    string
+	Conflicts []SerialAssignment
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrSerialsPending, e.Reason)
+}
+
+func (e *OverlapError) Unwrap() error {
+	return ErrSerialsPending
+}
+
+type LinkOptions struct {
+	SerialNumbers []string
+	TTL           time.Duration
+	Overlap       string
+	// Token issues an encrypted reader token instead of a request UUID.
+	Token       bool
+	InventoryID string
+	Actor       string
+}
+
+// LinkResult describes the outcome of OpenLink. Request is nil when every
+// serial number was left in the request it was already pending in.
+// TTLIgnored is set when the link was reused or merged into, which keeps its
+// own expiry whatever TTL was asked for.
+type LinkResult struct {
+	Request     *repositories.Request
+	Token       string
+	Reused      bool
+	TTLIgnored  bool
+	Assignments []SerialAssignment
+}
+
+// OpenLink hands out a reader link for serial numbers. A usable request for
+// exactly the same serials is reused; serials pending in other requests are
+// handled according to opts.Overlap. When another call links the same serials
+// at the same time, the older link keeps them and the other call fails with
+// an OverlapError after undoing its change.
+func (r *RequestService) OpenLink(ctx context.Context, opts LinkOptions) (*LinkResult, error) {
+	serials := []string{}
+	seen := map[string]bool{}
+	for _, sn := range opts.SerialNumbers {
+		sn = strings.TrimSpace(sn)
+		if sn == "" || seen[sn] {
+			continue
+		}
+
+		seen[sn] = true
+		serials = append(serials, sn)
+	}
+
+	if len(serials) == 0 {
+		return nil, ErrNoSerialNumbers
+	}
+
+	switch opts.Overlap {
+	case "":
+		opts.Overlap = OverlapReject
+	case OverlapReject, OverlapSplit:
+	case OverlapMerge:
+		if opts.Token {
+			return nil, fmt.Errorf("%w: a token can't be extended, use reject or split", ErrInvalidOverlap)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q, expected reject, split or merge", ErrInvalidOverlap, opts.Overlap)
+	}
+
+	if !opts.Token {
+		request, err := r.requestRepo.FindBySerials(ctx, serials)
+		if err == nil {
+			return &LinkResult{
+				Request:     request,
+				Reused:      true,
+				TTLIgnored:  opts.TTL != 0,
+				Assignments: assignAll(serials, request.UUid, AssignedExisting),
+			}, nil
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+
+	pending, err := r.requestRepo.FindPending(ctx, serials)
+	if err != nil {
+		return nil, err
+	}
+
+	// the oldest request wins when a serial is pending in several
+	pendingIn := map[string]*repositories.Request{}
+	for i := range pending {
+		for _, condition := range pending[i].SerialNumbers {
+			if seen[condition.SerialNumber] && !condition.PsidStore && pendingIn[condition.SerialNumber] == nil {
+				pendingIn[condition.SerialNumber] = &pending[i]
+			}
+		}
+	}
+
+	conflicts := []SerialAssignment{}
+	remaining := []string{}
+	holders := map[string]*repositories.Request{}
+	for _, sn := range serials {
+		holder, ok := pendingIn[sn]
+		if !ok {
+			remaining = append(remaining, sn)
+			continue
+		}
+
+		holders[holder.UUid] = holder
+		conflicts = append(conflicts, SerialAssignment{SerialNumber: sn, RequestID: holder.UUid, Outcome: AssignedExisting})
+	}
+
+	if len(conflicts) > 0 && opts.Overlap == OverlapReject {
+		return nil, &OverlapError{Reason: "pass overlap=split or overlap=merge to proceed", Conflicts: conflicts}
+	}
+
+	if len(conflicts) > 0 && opts.Overlap == OverlapMerge {
+		if len(holders) > 1 {
+			return nil, &OverlapError{Reason: "they are spread over several requests, which can't be merged", Conflicts: conflicts}
+		}
+
+		holder := holders[conflicts[0].RequestID]
+		if holder.Token {
+			return nil, &OverlapError{Reason: "they are pending in a token link, which can't be extended", Conflicts: conflicts}
+		}
+
+		request := holder
+		if len(remaining) > 0 {
+			request, err = r.requestRepo.AddSerials(ctx, holder.UUid, remaining)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, &OverlapError{Reason: linkRaceReason, Conflicts: conflicts}
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			if err := r.keepSerials(ctx, request.UUid, remaining, false); err != nil {
+				return nil, err
+			}
+		}
+
+		return &LinkResult{
+			Request:     request,
+			Reused:      len(remaining) == 0,
+			TTLIgnored:  opts.TTL != 0,
+			Assignments: append(conflicts, assignAll(remaining, holder.UUid, AssignedMerged)...),
+		}, nil
+	}
+
+	result := &LinkResult{Assignments: conflicts}
+	if len(remaining) == 0 {
+		return result, nil
+	}
+
+	if opts.Token {
+		result.Request, result.Token, err = r.CreateTokenRequest(ctx, opts.InventoryID, remaining, opts.TTL, opts.Actor)
+	} else {
+		result.Request, err = r.CreateRequest(ctx, remaining, opts.TTL, opts.Actor)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.keepSerials(ctx, result.Request.UUid, remaining, true); err != nil {
+		return nil, err
+	}
+
+	result.Assignments = append(result.Assignments, assignAll(remaining, result.Request.UUid, AssignedNew)...)
+	return result, nil
+}
+
+const linkRaceReason = "another link was opened for them at the same time, try again"
+
+// keepSerials checks that requestID is the oldest usable request holding each
+// of serials, which fails when another OpenLink linked them concurrently. The
+// losing call takes its serials out again, deleting the request it created.
+func (r *RequestService) keepSerials(ctx context.Context, requestID string, serials []string, created bool) error {
+	pending, err := r.requestRepo.FindPending(ctx, serials)
+	if err != nil {
+		return err
+	}
+
+	owners := map[string]string{}
+	for _, request := range pending {
+		for _, condition := range request.SerialNumbers {
+			if !condition.PsidStore && owners[condition.SerialNumber] == "" {
+				owners[condition.SerialNumber] = request.UUid
+			}
+		}
+	}
+
+	lost := []SerialAssignment{}
+	for _, sn := range serials {
+		if owners[sn] != requestID {
+			lost = append(lost, SerialAssignment{SerialNumber: sn, RequestID: owners[sn], Outcome: AssignedExisting})
+		}
+	}
+
+	if len(lost) == 0 {
+		return nil
+	}
+
+	if created {
+		err = r.requestRepo.Delete(ctx, requestID)
+	} else {
+		err = r.requestRepo.RemoveSerials(ctx, requestID, serials)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w (and undoing the link failed: %v)", &OverlapError{Reason: linkRaceReason, Conflicts: lost}, err)
+	}
+
+	return &OverlapError{Reason: linkRaceReason, Conflicts: lost}
+}
+
+func assignAll(serials []string, requestID, outcome string) []SerialAssignment {
+	assignments := []SerialAssignment{}
+	for _, sn := range serials {
+		assignments = append(assignments, SerialAssignment{SerialNumber: sn, RequestID: requestID, Outcome: outcome})
+	}
+
+	return assignments
+}
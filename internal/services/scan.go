@@ -8,10 +8,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"scanner/config"
 	"scanner/internal/repositories"
 	"slices"
@@ -19,15 +22,18 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type ScanService struct {
-	hardRepo *repositories.HardRepository
+	hardRepo      *repositories.HardRepository
+	wipeEventRepo *repositories.WipeEventRepository
 }
 
 func NewScanService() *ScanService {
 	return &ScanService{
-		hardRepo: repositories.NewHardRepository(),
+		hardRepo:      repositories.NewHardRepository(),
+		wipeEventRepo: repositories.NewWipeEventRepository(),
 	}
 }
 
@@ -246,7 +252,7 @@ func (s *ScanService) StoreScanResultIfNotExists(ctx context.Context, ocrRespons
 		PartNumber:   "",
 		SerialNumber: serialNumber,
 		Psid:         psidValue,
-		ExtraFileds:  make(map[string]interface{}),
+		ExtraFields:  make(map[string]interface{}),
 		Images:       images,
 	}
 
@@ -276,36 +282,175 @@ func (s *ScanService) StoreScanResultIfNotExists(ctx context.Context, ocrRespons
 				continue
 			}
 
-			newHard.ExtraFileds[key] = value
+			newHard.ExtraFields[key] = value
 		}
 	}
 
-	err = s.hardRepo.Insert(ctx, newHard)
+	applyExtraFieldSchema(newHard, newHard.ExtraFields)
+
+	// another scan of the same drive may have stored it in the meantime
+	hard, _, err := s.hardRepo.Upsert(ctx, newHard)
 	if err != nil {
 		return nil, err
 	}
 
-	return newHard, nil
+	return hard, nil
+}
+
+// applyExtraFieldSchema stores the fields that match the schema of the hard
+// type and quarantines the rest.
+func applyExtraFieldSchema(hard *repositories.Hard, fields map[string]interface{}) {
+	valid, quarantined, _ := ValidateExtraFields(hard.Type, fields)
+	hard.ExtraFields = valid
+	for key, value := range quarantined {
+		if hard.QuarantinedFields == nil {
+			hard.QuarantinedFields = map[string]interface{}{}
+		}
+
+		hard.QuarantinedFields[key] = value
+	}
 }
 
-func (s *ScanService) GetHardInfoByHardFilter(ctx context.Context, filter *repositories.HardFilter) ([]repositories.Hard, error) {
-	hards, err := s.hardRepo.FindByInput(ctx, filter)
+func (s *ScanService) GetHardInfoByHardFilter(ctx context.Context, filter *repositories.HardFilter) (*repositories.HardPage, error) {
+	page, err := s.hardRepo.FindByInput(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	return hards, nil
+	return page, nil
+}
+
+var (
+	ErrHardNotFound   = errors.New("hard not found")
+	ErrHardNotDeleted = errors.New("hard is not deleted")
+	// ErrHardRetired is returned for records that were merged into another
+	// one or replaced by a PSID correction, which are never reactivated.
+	ErrHardRetired = errors.New("hard was merged or replaced and can't be restored")
+)
+
+func (s *ScanService) SearchHards(ctx context.Context, search *repositories.HardSearch) ([]repositories.HardSearchResult, error) {
+	return s.hardRepo.Search(ctx, search)
 }
 
 func (s *ScanService) GetHardInfo(ctx context.Context, id string) (*repositories.Hard, error) {
+	return s.findHard(ctx, id, false)
+}
+
+func (s *ScanService) findHard(ctx context.Context, id string, includeDeleted bool) (*repositories.Hard, error) {
 	hard, err := s.hardRepo.FindByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, primitive.ErrInvalidHex) {
+		return nil, ErrHardNotFound
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
+	if hard.DeletedAt != nil && !includeDeleted {
+		return nil, ErrHardNotFound
+	}
+
 	return hard, nil
 }
 
+func (s *ScanService) DeleteHard(ctx context.Context, id, reason, actor string) (*repositories.Hard, error) {
+	hard, err := s.findHard(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	event := repositories.NewHardEvent("deleted", actor, map[string]interface{}{
+		"reason": reason,
+	})
+
+	if err := s.hardRepo.SoftDelete(ctx, hard, event); err != nil {
+		return nil, err
+	}
+
+	return s.findHard(ctx, id, true)
+}
+
+func (s *ScanService) RestoreHard(ctx context.Context, id, actor string) (*repositories.Hard, error) {
+	hard, err := s.findHard(ctx, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if hard.DeletedAt == nil {
+		return nil, ErrHardNotDeleted
+	}
+
+	if hard.MergedInto != nil || hard.IncorrectPsid {
+		return nil, ErrHardRetired
+	}
+
+	event := repositories.NewHardEvent("restored", actor, map[string]interface{}{
+		"deleted_at":    hard.DeletedAt,
+		"deleted_by":    hard.DeletedBy,
+		"delete_reason": hard.DeleteReason,
+	})
+
+	err = s.hardRepo.Restore(ctx, hard, event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// merged or corrected since it was loaded
+		return nil, ErrHardRetired
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.findHard(ctx, id, false)
+}
+
+// PurgeHard removes a record for good, together with the image files no
+// other record refers to.
+func (s *ScanService) PurgeHard(ctx context.Context, id, actor string) error {
+	hard, err := s.findHard(ctx, id, true)
+	if err != nil {
+		return err
+	}
+
+	if err := s.hardRepo.Purge(ctx, hard); err != nil {
+		return err
+	}
+
+	if err := s.removeOrphanImages(ctx, hard.Images, hard.ID); err != nil {
+		return err
+	}
+
+	log.Printf("Hard %s (serial %s) purged by %s", hard.ID.Hex(), hard.SerialNumber, actor)
+	return nil
+}
+
+// DiscardHard removes a record that was just created when what it was created
+// for failed. Its images are kept as they still belong to the reader scan.
+func (s *ScanService) DiscardHard(ctx context.Context, hard *repositories.Hard) error {
+	return s.hardRepo.Purge(ctx, hard)
+}
+
+// removeOrphanImages deletes the image files that no record other than owner
+// refers to; merged records may share images.
+func (s *ScanService) removeOrphanImages(ctx context.Context, images []string, owner primitive.ObjectID) error {
+	for _, image := range images {
+		refs, err := s.hardRepo.CountImageReferences(ctx, image, owner)
+		if err != nil {
+			return err
+		}
+
+		if refs > 0 {
+			continue
+		}
+
+		err = os.Remove(filepath.Join("./uploads", filepath.Base(image)))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove image %s of hard %s: %v", image, owner.Hex(), err)
+		}
+	}
+
+	return nil
+}
+
 func (s *ScanService) DeletePsid(ctx context.Context, hard *repositories.Hard) error {
 	return s.hardRepo.DeleteByPsid(ctx, hard)
 }
@@ -329,9 +474,18 @@ type AddHardResponse struct {
 	PartNumber   string `json:"part_number" form:"part_number"`
 	SerialNumber string `json:"serial_number" form:"serial_number"`
 	Psid         string `json:"psid" form:"psid"`
+
+	ExtraFields map[string]interface{} `json:"extra_fields" form:"-"`
+	// PsidMismatch is only set by the reader, never from a request body.
+	PsidMismatch bool `json:"-" form:"-"`
 }
 
 func (s *ScanService) AddHard(ctx context.Context, data AddHardResponse, images []string) (*repositories.Hard, error) {
+	extraFields, err := validateExtraFieldsStrict(data.Type, data.ExtraFields)
+	if err != nil {
+		return nil, err
+	}
+
 	newHard := &repositories.Hard{
 		ID:           primitive.NewObjectID(),
 		Capacity:     data.Capacity,
@@ -343,18 +497,93 @@ func (s *ScanService) AddHard(ctx context.Context, data AddHardResponse, images
 		PartNumber:   data.PartNumber,
 		SerialNumber: data.SerialNumber,
 		Psid:         data.Psid,
-		ExtraFileds:  make(map[string]interface{}),
+		PsidMismatch: data.PsidMismatch,
+		ExtraFields:  extraFields,
 		Images:       images,
 	}
 
-	err := s.hardRepo.Insert(ctx, newHard)
+	hard, created, err := s.hardRepo.Upsert(ctx, newHard)
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		return hard, repositories.ErrHardExists
+	}
+
+	return hard, nil
+}
+
+var (
+	ErrPsidUnchanged = errors.New("psid is the one already stored")
+	ErrWipeStarted   = errors.New("the wipe workflow has started, the psid can't be corrected")
+)
+
+// CorrectPsid replaces the hard stored with a wrong PSID by a new record with
+// psid and images. The old record is kept, marked incorrect, for auditing.
+// Corrections are refused once the drive has moved through the wipe workflow,
+// as its transitions and log belong to the old record.
+func (s *ScanService) CorrectPsid(ctx context.Context, id, psid string, mismatch bool, images []string, actor string) (*repositories.Hard, error) {
+	old, err := s.findHard(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(old.WipeTransitions) > 0 || (old.WipeState != "" && old.WipeState != repositories.WipeReceived) {
+		return nil, ErrWipeStarted
+	}
+
+	existing, err := s.hardRepo.FindByPsid(ctx, repositories.AddHardFilter{SerialNumber: old.SerialNumber, Psid: psid})
+	if err == nil && existing != nil {
+		if existing.ID == old.ID {
+			return nil, ErrPsidUnchanged
+		}
+
+		return existing, repositories.ErrHardExists
+	}
+
+	hard, err := s.AddHard(ctx, AddHardResponse{
+		InventoryID:  old.InventoryID,
+		Type:         old.Type,
+		Capacity:     old.Capacity,
+		Eui:          old.Eui,
+		Make:         old.Make,
+		Model:        old.Model,
+		PartNumber:   old.PartNumber,
+		SerialNumber: old.SerialNumber,
+		Psid:         psid,
+		PsidMismatch: mismatch,
+		ExtraFields:  old.ExtraFields,
+	}, images)
 	if err != nil {
+		return hard, err
+	}
+
+	event := repositories.NewHardEvent("psid_replaced", actor, map[string]interface{}{
+		"replaced_by": hard.ID,
+	})
+
+	if err := s.hardRepo.ReplacePsid(ctx, old, event); err != nil {
+		// don't leave two active records for the same drive
+		if purgeErr := s.DiscardHard(ctx, hard); purgeErr != nil {
+			return nil, fmt.Errorf("%w (and removing the new record %s failed: %v)", err, hard.ID.Hex(), purgeErr)
+		}
+
 		return nil, err
 	}
 
-	return newHard, nil
+	return hard, nil
 }
 
+var (
+	// ErrPsidForbidden is returned when a caller without psid:read tries to
+	// read or change the psid of a hard.
+	ErrPsidForbidden = errors.New("the psid:read permission is required to read or change the psid")
+	// ErrMaskedPsid is returned for psid values that look like the masked
+	// form shown to callers without psid:read.
+	ErrMaskedPsid = errors.New("psid looks masked, send the full value")
+)
+
 type EditHardResponse struct {
 	InventoryID  *string `json:"inventory_id" form:"inventory_id"`
 	Type         *string `json:"hard_type" form:"hard_type"`
@@ -365,77 +594,153 @@ type EditHardResponse struct {
 	PartNumber   *string `json:"part_number" form:"part_number"`
 	SerialNumber *string `json:"serial_number" form:"serial_number"`
 	Psid         *string `json:"psid" form:"psid"`
+
+	// ExtraFields is a patch: a key set to null removes the field.
+	ExtraFields map[string]interface{} `json:"extra_fields" form:"-"`
+	// Version, when set, must match the current version of the hard.
+	Version *int64 `json:"version" form:"version"`
 }
 
-func (s *ScanService) UpdateHard(ctx context.Context, hard *repositories.Hard, data EditHardResponse) error {
-	if data.Capacity != nil {
-		hard.Capacity = *data.Capacity
+func (s *ScanService) UpdateHard(ctx context.Context, hard *repositories.Hard, data EditHardResponse, actor string) error {
+	if data.Psid != nil && strings.Contains(*data.Psid, "*") {
+		return ErrMaskedPsid
 	}
 
-	if data.Eui != nil {
-		hard.Eui = *data.Eui
-	}
+	changes := map[string]interface{}{}
+	set := func(name string, field *string, value *string) {
+		if value == nil || *field == *value {
+			return
+		}
 
-	if data.Type != nil {
-		hard.Type = *data.Type
-	}
+		if name == "psid" {
+			// never copy a PSID into the audit trail
+			changes[name] = map[string]interface{}{"changed": true}
+		} else {
+			changes[name] = map[string]interface{}{"from": *field, "to": *value}
+		}
 
-	if data.InventoryID != nil {
-		hard.InventoryID = *data.InventoryID
+		*field = *value
 	}
 
-	if data.Make != nil {
-		hard.Make = *data.Make
-	}
+	set("capacity", &hard.Capacity, data.Capacity)
+	set("eui", &hard.Eui, data.Eui)
+	set("hard_type", &hard.Type, data.Type)
+	set("inventory_id", &hard.InventoryID, data.InventoryID)
+	set("make", &hard.Make, data.Make)
+	set("model", &hard.Model, data.Model)
+	set("part_number", &hard.PartNumber, data.PartNumber)
+	set("serial_number", &hard.SerialNumber, data.SerialNumber)
+	set("psid", &hard.Psid, data.Psid)
 
-	if data.Model != nil {
-		hard.Model = *data.Model
+	if _, ok := changes["hard_type"]; ok {
+		// fields of the previous type may not be valid for the new one
+		applyExtraFieldSchema(hard, hard.ExtraFields)
 	}
 
-	if data.PartNumber != nil {
-		hard.PartNumber = *data.PartNumber
-	}
+	if len(data.ExtraFields) > 0 {
+		updates := map[string]interface{}{}
+		for key, value := range data.ExtraFields {
+			if value != nil {
+				updates[key] = value
+			}
+		}
 
-	if data.SerialNumber != nil {
-		hard.SerialNumber = *data.SerialNumber
-	}
+		valid, err := validateExtraFieldsStrict(hard.Type, updates)
+		if err != nil {
+			return err
+		}
+
+		if hard.ExtraFields == nil {
+			hard.ExtraFields = map[string]interface{}{}
+		}
 
-	if data.Psid != nil {
-		hard.Psid = *data.Psid
+		for key, value := range data.ExtraFields {
+			if value != nil {
+				continue
+			}
+
+			if old, ok := hard.ExtraFields[key]; ok {
+				changes["extra_fields."+key] = map[string]interface{}{"from": old, "to": nil}
+				delete(hard.ExtraFields, key)
+			}
+
+			if old, ok := hard.QuarantinedFields[key]; ok {
+				changes["quarantined_fields."+key] = map[string]interface{}{"from": old, "to": nil}
+				delete(hard.QuarantinedFields, key)
+			}
+		}
+
+		for key, value := range valid {
+			old, ok := hard.ExtraFields[key]
+			if ok && old == value {
+				continue
+			}
+
+			changes["extra_fields."+key] = map[string]interface{}{"from": old, "to": value}
+			hard.ExtraFields[key] = value
+		}
 	}
 
 	hard.UserEdited = true
+	if len(changes) > 0 {
+		hard.History = append(hard.History, repositories.NewHardEvent("edited", actor, changes))
+	}
 
 	return s.hardRepo.Update(ctx, hard.ID.Hex(), hard)
 }
 
-func (s *ScanService) WipeAccept(ctx context.Context, serialNumber, psid string) error {
-	hard, err := s.hardRepo.FindByPsid(ctx, repositories.AddHardFilter{
-		SerialNumber: serialNumber,
-		Psid:         psid,
-	})
+// AddImages appends already stored image files to a hard.
+func (s *ScanService) AddImages(ctx context.Context, hard *repositories.Hard, images []string, actor string) error {
+	hard.Images = append(hard.Images, images...)
+	hard.History = append(hard.History, repositories.NewHardEvent("images_added", actor, map[string]interface{}{
+		"images": images,
+	}))
 
-	if err != nil {
-		if err.Error() == "mongo: no documents in result" {
-			newHard := &repositories.Hard{
-				ID:           primitive.NewObjectID(),
-				SerialNumber: serialNumber,
-				Psid:         psid,
-				ExtraFileds:  make(map[string]interface{}),
-				WipeAccepted: true,
-			}
+	return s.hardRepo.Update(ctx, hard.ID.Hex(), hard)
+}
 
-			err := s.hardRepo.Insert(ctx, newHard)
-			if err != nil {
-				return err
-			}
+var ErrImageNotFound = errors.New("image not found")
 
-			return nil
-		}
+func (s *ScanService) RemoveImage(ctx context.Context, hard *repositories.Hard, image string, actor string) error {
+	image = filepath.Base(image)
+	idx := slices.Index(hard.Images, image)
+	if idx < 0 {
+		return ErrImageNotFound
+	}
 
+	hard.Images = slices.Delete(hard.Images, idx, idx+1)
+	hard.History = append(hard.History, repositories.NewHardEvent("image_removed", actor, map[string]interface{}{
+		"image": image,
+	}))
+
+	if err := s.hardRepo.Update(ctx, hard.ID.Hex(), hard); err != nil {
 		return err
 	}
 
-	hard.WipeAccepted = true
-	return s.hardRepo.WipeAccepted(ctx, hard)
+	return s.removeOrphanImages(ctx, []string{image}, hard.ID)
+}
+
+// ReorderImages sets the image order; images must contain exactly the
+// current images of the hard.
+func (s *ScanService) ReorderImages(ctx context.Context, hard *repositories.Hard, images []string, actor string) error {
+	ordered := []string{}
+	for _, image := range images {
+		ordered = append(ordered, filepath.Base(image))
+	}
+
+	current := slices.Clone(hard.Images)
+	sorted := slices.Clone(ordered)
+	slices.Sort(current)
+	slices.Sort(sorted)
+	if !slices.Equal(current, sorted) {
+		return fmt.Errorf("%w: the new order must list every current image exactly once", ErrImageNotFound)
+	}
+
+	hard.History = append(hard.History, repositories.NewHardEvent("images_reordered", actor, map[string]interface{}{
+		"from": hard.Images,
+		"to":   ordered,
+	}))
+	hard.Images = ordered
+
+	return s.hardRepo.Update(ctx, hard.ID.Hex(), hard)
 }
@@ -0,0 +1,392 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"scanner/config"
+	"scanner/internal/repositories"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrInvalidWebhook          = errors.New("invalid webhook")
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrWebhookTargetBlocked    = errors.New("webhook target is not a public address")
+)
+
+// maxWebhookBackoff caps the delay between two attempts of a delivery.
+const maxWebhookBackoff = 6 * time.Hour
+
+type WebhookService struct {
+	webhookRepo *repositories.WebhookRepository
+	requestRepo *repositories.RequestRepo
+	client      *http.Client
+}
+
+func NewWebhookService() *WebhookService {
+	return &WebhookService{
+		webhookRepo: repositories.NewWebhookRepository(),
+		requestRepo: repositories.NewRequestRepo(),
+		client:      webhookClient(config.GetConfig().Webhook),
+	}
+}
+
+// webhookClient checks every address it connects to, including after
+// redirects and DNS changes, so a callback URL can't reach internal services.
+func webhookClient(cfg config.Webhook) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivateTargets {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || blockedWebhookIP(ip) {
+				return fmt.Errorf("%w: %s", ErrWebhookTargetBlocked, host)
+			}
+
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: cfg.Timeout, Transport: transport}
+}
+
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func blockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || carrierGradeNAT.Contains(ip)
+}
+
+// Subscribe registers url for events of requestID, or of every request when
+// requestID is empty. The returned subscription carries the signing secret,
+// which is not shown again. Subscribing a URL again for the same request
+// returns the existing subscription, without its secret and with created
+// false, and widens its events instead of duplicating every delivery.
+func (s *WebhookService) Subscribe(ctx context.Context, rawURL string, events []string, requestID, actor string) (*repositories.WebhookSubscription, bool, error) {
+	if err := ValidateWebhook(rawURL, events); err != nil {
+		return nil, false, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, false, err
+	}
+
+	if events == nil {
+		events = []string{}
+	}
+
+	subscription := &repositories.WebhookSubscription{
+		URL:       rawURL,
+		Secret:    hex.EncodeToString(secret),
+		Events:    events,
+		RequestID: requestID,
+		CreatedBy: actor,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	existing, created, err := s.webhookRepo.UpsertSubscription(ctx, subscription)
+	if err != nil || created {
+		return existing, created, err
+	}
+
+	existing.Secret = ""
+	if merged := mergeWebhookEvents(existing.Events, events); !slices.Equal(merged, existing.Events) {
+		if err := s.webhookRepo.SetSubscriptionEvents(ctx, existing.ID, merged); err != nil {
+			return nil, false, err
+		}
+
+		existing.Events = merged
+	}
+
+	return existing, false, nil
+}
+
+// mergeWebhookEvents returns the events wanted by either list, where an empty
+// list means every event.
+func mergeWebhookEvents(current, added []string) []string {
+	if len(current) == 0 || len(added) == 0 {
+		return []string{}
+	}
+
+	merged := slices.Clone(current)
+	for _, event := range added {
+		if !slices.Contains(merged, event) {
+			merged = append(merged, event)
+		}
+	}
+
+	return merged
+}
+
+func ValidateWebhook(rawURL string, events []string) error {
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+
+	// names are checked again when connecting, literal addresses can be
+	// refused right away
+	if !config.GetConfig().Webhook.AllowPrivateTargets {
+		host := target.Hostname()
+		ip := net.ParseIP(host)
+		if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") || (ip != nil && blockedWebhookIP(ip)) {
+			return fmt.Errorf("%w: url must point to a public address", ErrInvalidWebhook)
+		}
+	}
+
+	for _, event := range events {
+		if !slices.Contains(repositories.WebhookEvents, event) {
+			return fmt.Errorf("%w: unknown event %q, expected one of %v", ErrInvalidWebhook, event, repositories.WebhookEvents)
+		}
+	}
+
+	return nil
+}
+
+func (s *WebhookService) Unsubscribe(ctx context.Context, id string) error {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrWebhookNotFound
+	}
+
+	err = s.webhookRepo.DeleteSubscription(ctx, objID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrWebhookNotFound
+	}
+
+	return err
+}
+
+// Subscriptions lists subscriptions without their secrets.
+func (s *WebhookService) Subscriptions(ctx context.Context, requestID string) ([]repositories.WebhookSubscription, error) {
+	subscriptions, err := s.webhookRepo.FindSubscriptions(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	return subscriptions, nil
+}
+
+// Emit queues event for every matching subscription. Delivery happens in Run.
+func (s *WebhookService) Emit(ctx context.Context, event repositories.WebhookEvent) error {
+	subscriptions, err := s.webhookRepo.MatchingSubscriptions(ctx, event.Type, event.RequestID)
+	if err != nil {
+		return err
+	}
+
+	event.ID = uuid.New().String()
+	event.OccurredAt = time.Now().UTC()
+
+	deliveries := []repositories.WebhookDelivery{}
+	for _, subscription := range subscriptions {
+		deliveries = append(deliveries, repositories.WebhookDelivery{
+			ID:             primitive.NewObjectID(),
+			SubscriptionID: subscription.ID,
+			URL:            subscription.URL,
+			Event:          event,
+			Status:         repositories.DeliveryPending,
+			NextAttemptAt:  event.OccurredAt,
+			CreatedAt:      event.OccurredAt,
+		})
+	}
+
+	return s.webhookRepo.InsertDeliveries(ctx, deliveries)
+}
+
+func (s *WebhookService) Deliveries(ctx context.Context, status string, limit int64) ([]repositories.WebhookDelivery, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	return s.webhookRepo.FindDeliveries(ctx, status, limit)
+}
+
+// Redeliver queues a pending or dead delivery to be sent again right away.
+func (s *WebhookService) Redeliver(ctx context.Context, id string) (*repositories.WebhookDelivery, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+
+	delivery, err := s.webhookRepo.Redeliver(ctx, objID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+
+	return delivery, err
+}
+
+// SignWebhook returns the X-Scanner-Signature header value for body: the
+// timestamp and the HMAC-SHA256 of "timestamp.body" under the subscription
+// secret. Receivers should reject old timestamps to prevent replays.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	ts := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the delay before attempt number attempts+1: 30s doubling
+// each time, capped at maxWebhookBackoff.
+func webhookBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxWebhookBackoff)
+}
+
+// Run sends due deliveries and queues request.expired events until ctx is
+// done. Several instances may run against the same database.
+func (s *WebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(config.GetConfig().Webhook.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.emitExpired(ctx)
+		s.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *WebhookService) emitExpired(ctx context.Context) {
+	for {
+		request, err := s.requestRepo.ClaimExpired(ctx)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to look up expired requests: %v", err)
+			return
+		}
+
+		if err := s.Emit(ctx, repositories.WebhookEvent{
+			Type:        repositories.EventRequestExpired,
+			RequestID:   request.UUid,
+			InventoryID: request.InventoryID,
+		}); err != nil {
+			log.Printf("Failed to queue %s for request %s: %v", repositories.EventRequestExpired, request.UUid, err)
+		}
+	}
+}
+
+func (s *WebhookService) deliverDue(ctx context.Context) {
+	cfg := config.GetConfig().Webhook
+	for {
+		delivery, err := s.webhookRepo.ClaimDue(ctx, 2*cfg.Timeout)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to claim webhook delivery: %v", err)
+			return
+		}
+
+		s.attempt(ctx, delivery, cfg.MaxAttempts)
+		if err := s.webhookRepo.SaveAttempt(ctx, delivery); err != nil {
+			log.Printf("Failed to save webhook delivery %s: %v", delivery.ID.Hex(), err)
+		}
+	}
+}
+
+// attempt sends delivery once and updates it with the outcome.
+func (s *WebhookService) attempt(ctx context.Context, delivery *repositories.WebhookDelivery, maxAttempts int) {
+	delivery.Attempts++
+	statusCode, err := s.send(ctx, delivery)
+	delivery.LastStatusCode = statusCode
+
+	if err == nil {
+		now := time.Now().UTC()
+		delivery.Status = repositories.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+		return
+	}
+
+	delivery.LastError = err.Error()
+	// a deleted subscription or a blocked target will never accept the delivery
+	if delivery.Attempts >= maxAttempts || errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, ErrWebhookTargetBlocked) {
+		delivery.Status = repositories.DeliveryDead
+		return
+	}
+
+	delivery.NextAttemptAt = time.Now().UTC().Add(webhookBackoff(delivery.Attempts))
+}
+
+func (s *WebhookService) send(ctx context.Context, delivery *repositories.WebhookDelivery) (int, error) {
+	subscription, err := s.webhookRepo.FindSubscription(ctx, delivery.SubscriptionID)
+	if err != nil {
+		return 0, fmt.Errorf("subscription: %w", err)
+	}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Scanner-Event", delivery.Event.Type)
+	req.Header.Set("X-Scanner-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Scanner-Signature", SignWebhook(subscription.Secret, time.Now().Unix(), body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"scanner/internal/repositories"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrInvalidWipeMethod = errors.New("invalid wipe method")
+
+// wipeAcceptPath is the route WipeAccept takes to the wipe queue from each
+// state that isn't accepted yet.
+var wipeAcceptPath = map[repositories.WipeState]repositories.WipeState{
+	repositories.WipeReceived:     repositories.WipePsidVerified,
+	repositories.WipePsidVerified: repositories.WipeQueued,
+	repositories.WipeFailed:       repositories.WipeQueued,
+}
+
+// WipeAccept queues the drive with the given serial number and PSID for
+// wiping, creating the record if it doesn't exist yet. Every intermediate
+// state is recorded so the audit trail has no gaps. Drives that are already
+// queued or further along are left alone.
+func (s *ScanService) WipeAccept(ctx context.Context, serialNumber, psid, actor string) error {
+	hard, err := s.hardRepo.FindByPsid(ctx, repositories.AddHardFilter{
+		SerialNumber: serialNumber,
+		Psid:         psid,
+	})
+
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		newHard := &repositories.Hard{
+			ID:           primitive.NewObjectID(),
+			SerialNumber: serialNumber,
+			Psid:         psid,
+			ExtraFields:  make(map[string]interface{}),
+			WipeState:    repositories.WipeReceived,
+		}
+
+		if err := advanceToWipeQueue(newHard, actor); err != nil {
+			return err
+		}
+
+		existing, created, err := s.hardRepo.Upsert(ctx, newHard)
+		if err != nil {
+			return err
+		}
+
+		if created {
+			return s.recordWipeEvents(ctx, newHard)
+		}
+
+		hard = existing
+	} else if err != nil {
+		return err
+	}
+
+	if hard.WipeState.Accepted() {
+		return nil
+	}
+
+	if err := advanceToWipeQueue(hard, actor); err != nil {
+		return err
+	}
+
+	if err := s.hardRepo.SaveWipeState(ctx, hard); err != nil {
+		return err
+	}
+
+	return s.recordWipeEvents(ctx, hard)
+}
+
+func advanceToWipeQueue(hard *repositories.Hard, actor string) error {
+	for hard.WipeState != repositories.WipeQueued {
+		next, ok := wipeAcceptPath[hard.WipeState]
+		if !ok {
+			return fmt.Errorf("%w: %s drives can't be accepted for wiping", repositories.ErrInvalidWipeTransition, hard.WipeState)
+		}
+
+		if err := hard.Transition(next, "", "wipe accepted", actor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TransitionWipe moves a hard to the next wipe state. The method is required
+// when, and only when, the drive is marked as wiped.
+func (s *ScanService) TransitionWipe(ctx context.Context, hard *repositories.Hard, to repositories.WipeState, method, note, actor string) error {
+	if !to.Valid() {
+		return fmt.Errorf("%w: unknown state %q", repositories.ErrInvalidWipeTransition, to)
+	}
+
+	if to == repositories.WipeWiped && !slices.Contains(repositories.WipeMethods, method) {
+		return fmt.Errorf("%w: expected one of %v", ErrInvalidWipeMethod, repositories.WipeMethods)
+	}
+
+	if to != repositories.WipeWiped && method != "" {
+		return fmt.Errorf("%w: a method is only recorded for the wiped state", ErrInvalidWipeMethod)
+	}
+
+	if err := hard.Transition(to, method, note, actor); err != nil {
+		return err
+	}
+
+	if err := s.hardRepo.SaveWipeState(ctx, hard); err != nil {
+		return err
+	}
+
+	return s.recordWipeEvents(ctx, hard)
+}
+
+// recordWipeEvents appends the transitions of hard that are not in the wipe
+// log yet. It runs after the state was saved, so a failure leaves a transition
+// missing from the log, never a logged one that didn't happen; the next
+// transition of the hard or `wipe-log repair` appends what is missing, and
+// VerifyWipeLog reports it meanwhile.
+func (s *ScanService) recordWipeEvents(ctx context.Context, hard *repositories.Hard) error {
+	logged, err := s.wipeEventRepo.CountByHard(ctx, hard.ID)
+	if err != nil {
+		return err
+	}
+
+	if logged > int64(len(hard.WipeTransitions)) {
+		return fmt.Errorf("wipe log has %d events for the %d transitions of %s", logged, len(hard.WipeTransitions), hard.ID.Hex())
+	}
+
+	for i, transition := range hard.WipeTransitions[logged:] {
+		err := s.wipeEventRepo.Append(ctx, repositories.NewWipeEvent(hard, int(logged)+i, transition))
+		if errors.Is(err, repositories.ErrWipeEventLogged) {
+			// logged meanwhile by a concurrent call for the same hard
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("wipe state of %s saved but not logged: %w", hard.ID.Hex(), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *ScanService) WipeEvents(ctx context.Context, hard *repositories.Hard) ([]repositories.WipeEvent, error) {
+	return s.wipeEventRepo.FindByHard(ctx, hard.ID)
+}
+
+// VerifyWipeLog recomputes the whole wipe log hash chain and checks that the
+// wipe transitions of every hard were logged as they are.
+func (s *ScanService) VerifyWipeLog(ctx context.Context) (*repositories.ChainReport, error) {
+	report, err := s.wipeEventRepo.Verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.hardRepo.EachWithWipeTransitions(ctx, func(hard *repositories.Hard) error {
+		events, err := s.wipeEventRepo.FindByHard(ctx, hard.ID)
+		if err != nil {
+			return err
+		}
+
+		if reason := compareWipeLog(hard.WipeTransitions, events); reason != "" {
+			report.Mismatches = append(report.Mismatches, repositories.TransitionMismatch{
+				HardID:       hard.ID,
+				SerialNumber: hard.SerialNumber,
+				Reason:       reason,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Valid = len(report.Breaks) == 0 && len(report.Mismatches) == 0
+	return report, nil
+}
+
+// RepairWipeLog anchors the head at the end of the intact chain if an append
+// failed to, then appends the transitions missing from the end of the log of
+// each hard and returns how many hards were repaired. Hards whose log
+// disagrees otherwise are left for VerifyWipeLog to report.
+func (s *ScanService) RepairWipeLog(ctx context.Context) (int64, int, error) {
+	anchored, err := s.wipeEventRepo.RepairHead(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	repaired := 0
+	err = s.hardRepo.EachWithWipeTransitions(ctx, func(hard *repositories.Hard) error {
+		events, err := s.wipeEventRepo.FindByHard(ctx, hard.ID)
+		if err != nil {
+			return err
+		}
+
+		if len(events) >= len(hard.WipeTransitions) || compareWipeLog(hard.WipeTransitions[:len(events)], events) != "" {
+			return nil
+		}
+
+		if err := s.recordWipeEvents(ctx, hard); err != nil {
+			return err
+		}
+
+		repaired++
+		return nil
+	})
+
+	return anchored, repaired, err
+}
+
+// compareWipeLog describes the first difference between the transitions of a
+// hard and the events logged for it, or returns "".
+func compareWipeLog(transitions []repositories.WipeTransition, events []repositories.WipeEvent) string {
+	for i, transition := range transitions {
+		if i >= len(events) {
+			return fmt.Sprintf("transitions %d to %d are not in the wipe log", i+1, len(transitions))
+		}
+
+		logged := events[i]
+		if logged.From != transition.From || logged.To != transition.To || logged.Method != transition.Method ||
+			!logged.At.Equal(transition.At.UTC().Truncate(time.Millisecond)) {
+			return fmt.Sprintf("transition %d (%s -> %s) differs from its wipe log event %d", i+1, transition.From, transition.To, logged.Seq)
+		}
+	}
+
+	if len(events) > len(transitions) {
+		return fmt.Sprintf("the wipe log has %d events for %d transitions", len(events), len(transitions))
+	}
+
+	return ""
+}
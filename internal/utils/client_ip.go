@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"log"
+	"net"
+	"scanner/config"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []*net.IPNet
+	untrustedXFFOnce   sync.Once
+)
+
+// ClientIP returns the address of the client that made the request. The
+// X-Forwarded-For header is only read when the connection comes from one of
+// TRUSTED_PROXIES, and then only the hops those proxies appended count: the
+// header is walked from the right and the first address that isn't a trusted
+// proxy is the client, so a client can't pick its IP by sending the header.
+func ClientIP(c *fiber.Ctx) string {
+	remote := c.Context().RemoteIP()
+	if !isTrustedProxy(remote) {
+		if c.Get(fiber.HeaderXForwardedFor) != "" {
+			warnUntrustedXFF(remote)
+		}
+
+		return remote.String()
+	}
+
+	hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+
+		remote = ip
+	}
+
+	// only proxies in the chain, the leftmost one is the closest to a client
+	return remote.String()
+}
+
+// warnUntrustedXFF points out, once, a deployment behind a proxy that isn't
+// in TRUSTED_PROXIES: every client would share the proxy's rate limits and
+// lockout.
+func warnUntrustedXFF(remote net.IP) {
+	untrustedXFFOnce.Do(func() {
+		log.Printf("Warning: ignoring X-Forwarded-For from %s, which is not in TRUSTED_PROXIES; "+
+			"if it is your reverse proxy, add it or all clients share its rate limits and lockout", remote)
+	})
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesOnce.Do(func() {
+		trustedProxies = parseTrustedProxies(config.GetConfig().ServerConfig.TrustedProxies)
+	})
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies reads IPs and CIDR ranges; entries that are neither are
+// skipped.
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, entry := range entries {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			continue
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+
+	return networks
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxiesOnce.Do(func() {})
+	trustedProxies = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "bogus"})
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "203.0.113.7", "", "203.0.113.7"},
+		{"spoofed without proxy", "203.0.113.7", "198.51.100.1", "203.0.113.7"},
+		{"through proxy", "10.0.0.2", "198.51.100.1", "198.51.100.1"},
+		{"spoofed through proxy", "10.0.0.2", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"two proxies", "192.0.2.1", "1.1.1.1, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"garbage hop", "10.0.0.2", "1.1.1.1, nonsense, 10.0.0.3", "10.0.0.3"},
+		{"proxy without header", "10.0.0.2", "", "10.0.0.2"},
+	}
+
+	app := fiber.New()
+	for _, tt := range tests {
+		fctx := &fasthttp.RequestCtx{}
+		fctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 1234}, nil)
+		if tt.forwarded != "" {
+			fctx.Request.Header.Set(fiber.HeaderXForwardedFor, tt.forwarded)
+		}
+
+		c := app.AcquireCtx(fctx)
+		if got := ClientIP(c); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+
+		app.ReleaseCtx(c)
+	}
+}
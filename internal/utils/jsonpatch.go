@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidPatch    = errors.New("invalid patch")
+	ErrPatchTestFailed = errors.New("patch test operation failed")
+)
+
+// PatchOperation is a single RFC 6902 JSON Patch operation.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// ApplyMergePatch applies an RFC 7396 JSON merge patch to a decoded JSON
+// document: objects are merged recursively, null removes a member and any
+// other value replaces the target.
+func ApplyMergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	result := map[string]interface{}{}
+	for key, value := range targetObj {
+		result[key] = value
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+
+		result[key] = ApplyMergePatch(result[key], value)
+	}
+
+	return result
+}
+
+// ApplyJSONPatch applies RFC 6902 operations in order to a decoded JSON
+// document and returns the patched copy. The input document is not modified.
+func ApplyJSONPatch(doc interface{}, operations []PatchOperation) (interface{}, error) {
+	doc = deepCopyJSON(doc)
+	var err error
+	for i, operation := range operations {
+		doc, err = applyOperation(doc, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+		}
+	}
+
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, operation PatchOperation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add":
+		return addValue(doc, path, deepCopyJSON(operation.Value))
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if _, err := getValue(doc, path); err != nil {
+			return nil, err
+		}
+
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+
+		return addValue(doc, path, deepCopyJSON(operation.Value))
+	case "move":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, fmt.Errorf("%w: cannot move a value into one of its children", ErrInvalidPatch)
+		}
+
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+
+		return addValue(doc, path, value)
+	case "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+
+		return addValue(doc, path, deepCopyJSON(value))
+	case "test":
+		value, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !jsonEqual(value, operation.Value) {
+			return nil, ErrPatchTestFailed
+		}
+
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported op %q", ErrInvalidPatch, operation.Op)
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPatch, token)
+	}
+
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+
+	if idx > limit {
+		return 0, fmt.Errorf("%w: array index %d out of bounds", ErrInvalidPatch, idx)
+	}
+
+	return idx, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q does not exist", ErrInvalidPatch, token)
+			}
+
+			current = value
+		case []interface{}:
+			idx, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+
+			current = node[idx]
+		default:
+			return nil, fmt.Errorf("%w: cannot traverse into a scalar at %q", ErrInvalidPatch, token)
+		}
+	}
+
+	return current, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+
+		updated := append(node[:idx:idx], append([]interface{}{value}, node[idx:]...)...)
+		return setValue(doc, path[:len(path)-1], updated)
+	default:
+		return nil, fmt.Errorf("%w: cannot add a member to a scalar", ErrInvalidPatch)
+	}
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: member %q does not exist", ErrInvalidPatch, last)
+		}
+
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value := node[idx]
+		updated := append(node[:idx:idx], node[idx+1:]...)
+		doc, err := setValue(doc, path[:len(path)-1], updated)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("%w: cannot remove a member from a scalar", ErrInvalidPatch)
+	}
+}
+
+// setValue replaces the value at path; used when an array had to be
+// reallocated.
+func setValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		idx, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+
+		node[idx] = value
+	}
+
+	return doc, nil
+}
+
+func deepCopyJSON(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for key, child := range node {
+			copied[key] = deepCopyJSON(child)
+		}
+
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, child := range node {
+			copied[i] = deepCopyJSON(child)
+		}
+
+		return copied
+	default:
+		return value
+	}
+}
+
+// jsonEqual compares two values the way they would compare once serialized,
+// so that 1 and 1.0 are equal.
+func jsonEqual(a, b interface{}) bool {
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	var av, bv interface{}
+	if json.Unmarshal(aj, &av) != nil || json.Unmarshal(bj, &bv) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(av, bv)
+}
@@ -183,3 +183,58 @@ func GetUserInfoFromContext(c *fiber.Ctx) (string, []string) {
 
 	return "", []string{}
 }
+
+// GetActor names the caller for audit records: the OIDC username when the
+// request carries a token, otherwise the X-Actor header sent by webservice
+// integrations, otherwise "webservice".
+func GetActor(c *fiber.Ctx) string {
+	if username := GetUsernameFromContext(c); username != "" {
+		return username
+	}
+
+	if actor := strings.TrimSpace(c.Get("X-Actor")); actor != "" {
+		return actor
+	}
+
+	return "webservice"
+}
+
+const PermissionPsidRead = "psid:read"
+
+// GrantedBy tells how the caller holds permission: "api_key" when the
+// webservice key grants it, "oidc" when the token's permissions claim does,
+// and "" when it doesn't hold it at all.
+func GrantedBy(c *fiber.Ctx, permission string) string {
+	if permissions, ok := c.Locals("key_permissions").([]string); ok {
+		for _, granted := range permissions {
+			if granted == permission {
+				return "api_key"
+			}
+		}
+	}
+
+	if claims, ok := c.Locals("claims").(*TokenClaims); ok {
+		for _, granted := range claims.Permissions {
+			if granted == permission {
+				return "oidc"
+			}
+		}
+	}
+
+	return ""
+}
+
+func HasPermission(c *fiber.Ctx, permission string) bool {
+	return GrantedBy(c, permission) != ""
+}
+
+// MaskPsid hides all but the last 4 characters of a PSID; shorter values are
+// hidden entirely.
+func MaskPsid(psid string) string {
+	runes := []rune(psid)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+
+	return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+}
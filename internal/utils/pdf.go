@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PDF page size in points (A4).
+const (
+	PDFPageWidth  = 595.0
+	PDFPageHeight = 842.0
+)
+
+// PDFDocument is a minimal PDF 1.4 writer: text in the standard Helvetica
+// fonts, lines, filled rectangles and JPEG images, which is all the generated
+// documents need. Coordinates are in points with the origin at the bottom left.
+type PDFDocument struct {
+	pages  []*PDFPage
+	images []pdfImage
+}
+
+type PDFPage struct {
+	content bytes.Buffer
+	images  []int
+}
+
+type pdfImage struct {
+	data          []byte
+	width, height int
+}
+
+func NewPDFDocument() *PDFDocument {
+	return &PDFDocument{}
+}
+
+func (d *PDFDocument) AddPage() *PDFPage {
+	page := &PDFPage{}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// Text draws a single line of text. Characters outside Latin-1 are replaced
+// because the standard fonts can't render them.
+func (p *PDFPage) Text(x, y, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfEscape(text))
+}
+
+func (p *PDFPage) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, y1, x2, y2)
+}
+
+func (p *PDFPage) Rect(x, y, w, h, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f %.2f %.2f re S\n", width, x, y, w, h)
+}
+
+func (p *PDFPage) FillRect(x, y, w, h float64) {
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f re f\n", x, y, w, h)
+}
+
+// JPEG draws a baseline JPEG of width x height pixels into the box at x, y.
+func (d *PDFDocument) JPEG(page *PDFPage, data []byte, width, height int, x, y, w, h float64) {
+	d.images = append(d.images, pdfImage{data: data, width: width, height: height})
+	index := len(d.images) - 1
+	page.images = append(page.images, index)
+	fmt.Fprintf(&page.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, y, index)
+}
+
+// Bytes serializes the document.
+func (d *PDFDocument) Bytes() []byte {
+	var out bytes.Buffer
+	offsets := []int{}
+	object := func(body string, stream []byte) int {
+		offsets = append(offsets, out.Len())
+		id := len(offsets)
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", id, body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+
+		out.WriteString("endobj\n")
+		return id
+	}
+
+	// object ids are fixed up front: catalog, page tree, fonts, then images
+	// and finally every page with its content stream
+	pageCount := len(d.pages)
+	firstImage := 5
+	firstPage := firstImage + len(d.images)
+	kids := []string{}
+	for i := 0; i < pageCount; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pageCount), nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+	for _, image := range d.images {
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>",
+			image.width, image.height, len(image.data)), image.data)
+	}
+
+	for i, page := range d.pages {
+		xobjects := ""
+		for _, index := range page.images {
+			xobjects += fmt.Sprintf(" /Im%d %d 0 R", index, firstImage+index)
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject <<%s >> >> /Contents %d 0 R >>",
+			PDFPageWidth, PDFPageHeight, xobjects, firstPage+2*i+1), nil)
+		object(fmt.Sprintf("<< /Length %d >>", page.content.Len()), page.content.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+func pdfEscape(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r < 32:
+			out.WriteByte(' ')
+		case r < 128:
+			out.WriteRune(r)
+		case r < 256:
+			// Latin-1 matches WinAnsi for the printable range
+			fmt.Fprintf(&out, "\\%03o", r)
+		default:
+			out.WriteByte('?')
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownPsidKey = errors.New("unknown psid key")
+
+// PsidCipher encrypts PSIDs with AES-GCM under one of several named keys and
+// computes the blind index used to look them up without decrypting. The
+// ciphertext uses the same iv.ciphertext.tag token layout that DecryptService
+// reads.
+type PsidCipher struct {
+	keys     map[string]cipher.AEAD
+	active   string
+	indexKey []byte
+}
+
+// NewPsidCipher parses keys given as "id:hexkey" pairs separated by commas or
+// whitespace. Without keys PSIDs are stored in plaintext and the blind index may
+// be an unkeyed hash, which is only acceptable in development. Once keys are
+// set an index key is required, otherwise the index would reveal the PSIDs.
+func NewPsidCipher(keys, activeKey, indexKey string) (*PsidCipher, error) {
+	c := &PsidCipher{keys: map[string]cipher.AEAD{}, active: activeKey}
+	for _, pair := range strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		id, key, ok := strings.Cut(pair, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("psid key %q must look like id:hexkey", pair)
+		}
+
+		secret, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("psid key %s: %w", id, err)
+		}
+
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("psid key %s: %w", id, err)
+		}
+
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("psid key %s: %w", id, err)
+		}
+
+		c.keys[id] = gcm
+	}
+
+	if activeKey == "" && len(c.keys) > 0 {
+		return nil, errors.New("PSID_ACTIVE_KEY must name one of PSID_KEYS")
+	}
+
+	if _, ok := c.keys[activeKey]; activeKey != "" && !ok {
+		return nil, fmt.Errorf("%w: active key %q is not in PSID_KEYS", ErrUnknownPsidKey, activeKey)
+	}
+
+	if indexKey == "" && len(c.keys) > 0 {
+		return nil, errors.New("PSID_INDEX_KEY must be set when PSID_KEYS is")
+	}
+
+	if indexKey != "" {
+		secret, err := hex.DecodeString(indexKey)
+		if err != nil {
+			return nil, fmt.Errorf("psid index key: %w", err)
+		}
+
+		c.indexKey = secret
+	}
+
+	return c, nil
+}
+
+var (
+	psidCipher     = &PsidCipher{keys: map[string]cipher.AEAD{}}
+	psidCipherLock sync.RWMutex
+)
+
+// SetPsidCipher installs the cipher used when hards are read and written.
+func SetPsidCipher(c *PsidCipher) {
+	psidCipherLock.Lock()
+	defer psidCipherLock.Unlock()
+	psidCipher = c
+}
+
+func GetPsidCipher() *PsidCipher {
+	psidCipherLock.RLock()
+	defer psidCipherLock.RUnlock()
+	return psidCipher
+}
+
+// Enabled reports whether new PSIDs are encrypted.
+func (c *PsidCipher) Enabled() bool {
+	return c.active != ""
+}
+
+func (c *PsidCipher) ActiveKeyID() string {
+	return c.active
+}
+
+// Encrypt seals plain with the active key and returns the key id and token.
+func (c *PsidCipher) Encrypt(plain string) (string, string, error) {
+	gcm, ok := c.keys[c.active]
+	if !ok {
+		return "", "", fmt.Errorf("%w: no active key", ErrUnknownPsidKey)
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", "", err
+	}
+
+	sealed := gcm.Seal(nil, iv, []byte(plain), nil)
+	tagStart := len(sealed) - gcm.Overhead()
+	b64u := base64.RawURLEncoding.EncodeToString
+	return c.active, b64u(iv) + "." + b64u(sealed[:tagStart]) + "." + b64u(sealed[tagStart:]), nil
+}
+
+func (c *PsidCipher) Decrypt(keyID, token string) (string, error) {
+	gcm, ok := c.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownPsidKey, keyID)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("invalid psid token")
+	}
+
+	decoded := [3][]byte{}
+	for i, part := range parts {
+		data, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return "", fmt.Errorf("invalid psid token: %w", err)
+		}
+
+		decoded[i] = data
+	}
+
+	plain, err := gcm.Open(nil, decoded[0], append(decoded[1], decoded[2]...), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt psid: %w", err)
+	}
+
+	return string(plain), nil
+}
+
+// BlindIndex is the deterministic HMAC of a value, stored next to the
+// ciphertext so equality lookups work without decrypting. Empty values keep
+// an empty index so serial-only records still compare equal.
+func (c *PsidCipher) BlindIndex(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IndexFingerprint identifies the index key without revealing it, so a
+// database can tell whether its blind indexes were computed under this key.
+func (c *PsidCipher) IndexFingerprint() string {
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte("psid-index-fingerprint"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,553 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+var ErrQRCodeTooLong = errors.New("data too long for a QR code")
+
+// qrBlocks describes the error correction of one version at level M: EC
+// codewords per block and the block counts and data codewords of the two
+// block groups.
+type qrBlocks struct {
+	ec                int
+	blocks1, dataLen1 int
+	blocks2, dataLen2 int
+}
+
+// qrLevelM is ISO/IEC 18004 table 9 for error correction level M, which
+// survives about 15% damage; enough for a printed label on a bench.
+var qrLevelM = [41]qrBlocks{
+	{},
+	{10, 1, 16, 0, 0}, {16, 1, 28, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 32, 0, 0},
+	{24, 2, 43, 0, 0}, {16, 4, 27, 0, 0}, {18, 4, 31, 0, 0}, {22, 2, 38, 2, 39},
+	{22, 3, 36, 2, 37}, {26, 4, 43, 1, 44}, {30, 1, 50, 4, 51}, {22, 6, 36, 2, 37},
+	{22, 8, 37, 1, 38}, {24, 4, 40, 5, 41}, {24, 5, 41, 5, 42}, {28, 7, 45, 3, 46},
+	{28, 10, 46, 1, 47}, {26, 9, 43, 4, 44}, {26, 3, 44, 11, 45}, {26, 3, 41, 13, 42},
+	{26, 17, 42, 0, 0}, {28, 17, 46, 0, 0}, {28, 4, 47, 14, 48}, {28, 6, 45, 14, 46},
+	{28, 8, 47, 13, 48}, {28, 19, 46, 4, 47}, {28, 22, 45, 3, 46}, {28, 3, 45, 23, 46},
+	{28, 21, 45, 7, 46}, {28, 19, 47, 10, 48}, {28, 2, 46, 29, 47}, {28, 10, 46, 23, 47},
+	{28, 14, 46, 21, 47}, {28, 14, 46, 23, 47}, {28, 12, 47, 26, 48}, {28, 6, 47, 34, 48},
+	{28, 29, 46, 14, 47}, {28, 13, 46, 32, 47}, {28, 40, 47, 7, 48}, {28, 18, 47, 31, 48},
+}
+
+func (b qrBlocks) dataCodewords() int {
+	return b.blocks1*b.dataLen1 + b.blocks2*b.dataLen2
+}
+
+// QRCode is a QR code symbol encoding bytes in byte mode at error correction
+// level M.
+type QRCode struct {
+	Version int
+	Size    int
+	modules [][]bool
+	// function marks finder, timing, alignment and format modules, which the
+	// data and mask must not touch.
+	function [][]bool
+}
+
+// NewQRCode encodes data in the smallest version that fits.
+func NewQRCode(data []byte) (*QRCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+
+		if 4+countBits+8*len(data) <= qrLevelM[v].dataCodewords()*8 {
+			version = v
+			break
+		}
+	}
+
+	if version == 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrQRCodeTooLong, len(data))
+	}
+
+	size := version*4 + 17
+	q := &QRCode{Version: version, Size: size}
+	q.modules = make([][]bool, size)
+	q.function = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+
+	q.drawFunctionPatterns()
+	q.drawCodewords(qrCodewords(version, data))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+
+		q.applyMask(mask)
+	}
+
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// Dark reports whether the module in column x, row y is dark.
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y][x]
+}
+
+func (q *QRCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// qrCodewords builds the data codewords of data and interleaves them with
+// their Reed-Solomon error correction codewords.
+func qrCodewords(version int, data []byte) []byte {
+	spec := qrLevelM[version]
+	capacity := spec.dataCodewords() * 8
+
+	bits := &qrBitBuffer{}
+	bits.append(0b0100, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	bits.append(0, min(4, capacity-bits.length))
+	bits.append(0, (8-bits.length%8)%8)
+	for pad := 0xEC; bits.length < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := bits.bytes()
+	divisor := reedSolomonDivisor(spec.ec)
+	blocks := [][]byte{}
+	ecBlocks := [][]byte{}
+	offset := 0
+	for i := 0; i < spec.blocks1+spec.blocks2; i++ {
+		length := spec.dataLen1
+		if i >= spec.blocks1 {
+			length = spec.dataLen2
+		}
+
+		block := codewords[offset : offset+length]
+		offset += length
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(block, divisor))
+	}
+
+	result := []byte{}
+	for i := 0; i < max(spec.dataLen1, spec.dataLen2); i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+
+	for i := 0; i < spec.ec; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+
+	return result
+}
+
+type qrBitBuffer struct {
+	data   []byte
+	length int
+}
+
+func (b *qrBitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if b.length%8 == 0 {
+			b.data = append(b.data, 0)
+		}
+
+		if value>>i&1 == 1 {
+			b.data[b.length/8] |= 0x80 >> (b.length % 8)
+		}
+
+		b.length++
+	}
+}
+
+func (b *qrBitBuffer) bytes() []byte {
+	return b.data
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z <<= 1
+		z ^= carry * 0x1D
+		z ^= (y >> i & 1) * x
+	}
+
+	return z
+}
+
+// reedSolomonDivisor returns the generator polynomial of the given degree,
+// without its leading coefficient.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+
+		root = gfMultiply(root, 0x02)
+	}
+
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+
+	return result
+}
+
+func (q *QRCode) alignmentPositions() []int {
+	if q.Version == 1 {
+		return nil
+	}
+
+	count := q.Version/7 + 2
+	step := (q.Version*4 + count*2 + 1) / (count*2 - 2) * 2
+	if q.Version == 32 {
+		step = 26
+	}
+
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, q.Size-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+
+	return positions
+}
+
+func (q *QRCode) drawFunctionPatterns() {
+	for i := 0; i < q.Size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	for _, center := range [][2]int{{3, 3}, {q.Size - 4, 3}, {3, q.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x < 0 || x >= q.Size || y < 0 || y >= q.Size {
+					continue
+				}
+
+				distance := max(absInt(dx), absInt(dy))
+				q.set(x, y, distance != 2 && distance != 4)
+			}
+		}
+	}
+
+	positions := q.alignmentPositions()
+	last := len(positions) - 1
+	for i, px := range positions {
+		for j, py := range positions {
+			// the three corners hold finder patterns
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(px+dx, py+dy, max(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format areas; drawFormat fills them in
+	q.drawFormat(0)
+
+	if q.Version >= 7 {
+		rem := q.Version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+
+		bits := q.Version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.Size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat writes the level M format bits for mask, both copies.
+func (q *QRCode) drawFormat(mask int) {
+	data := 0b00<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.Size-1-i, 8, bit(i))
+	}
+
+	for i := 8; i < 15; i++ {
+		q.set(8, q.Size-15+i, bit(i))
+	}
+
+	q.set(8, q.Size-8, true)
+}
+
+// drawCodewords places the codewords in the two-module wide zigzag columns
+// from the bottom right, skipping function modules.
+func (q *QRCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if upward {
+					y = q.Size - 1 - vert
+				}
+
+				if q.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+
+				q.modules[y][x] = codewords[i>>3]>>(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask XORs the data modules with mask pattern mask; applying it twice
+// undoes it.
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four rules of ISO/IEC 18004 7.8.3; the
+// mask with the lowest score is the easiest to scan.
+func (q *QRCode) penalty() int {
+	penalty := 0
+	finderLike := []string{"10111010000", "00001011101"}
+
+	lines := make([]string, 0, 2*q.Size)
+	for y := 0; y < q.Size; y++ {
+		var row, column strings.Builder
+		for x := 0; x < q.Size; x++ {
+			row.WriteByte(qrBit(q.modules[y][x]))
+			column.WriteByte(qrBit(q.modules[x][y]))
+		}
+
+		lines = append(lines, row.String(), column.String())
+	}
+
+	for _, line := range lines {
+		run := 1
+		for i := 1; i <= len(line); i++ {
+			if i < len(line) && line[i] == line[i-1] {
+				run++
+				continue
+			}
+
+			if run >= 5 {
+				penalty += run - 2
+			}
+
+			run = 1
+		}
+
+		for _, pattern := range finderLike {
+			penalty += 40 * strings.Count(line, pattern)
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+
+			if x+1 < q.Size && y+1 < q.Size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	percent := dark * 100 / (q.Size * q.Size)
+	penalty += absInt(percent-50) / 5 * 10
+	return penalty
+}
+
+func qrBit(dark bool) byte {
+	if dark {
+		return '1'
+	}
+
+	return '0'
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
+
+// PNG renders the code with scale pixels per module and the four module quiet
+// zone scanners expect.
+func (q *QRCode) PNG(scale int) ([]byte, error) {
+	const border = 4
+	width := (q.Size + 2*border) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+border)*scale+dx, (y+border)*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as a single path in module units, so it scales to any
+// size without blurring.
+func (q *QRCode) SVG() string {
+	const border = 4
+	width := q.Size + 2*border
+	path := &strings.Builder{}
+	q.runs(func(x, y, length int) {
+		fmt.Fprintf(path, "M%d,%dh%dv1h-%dz", x+border, y+border, length, length)
+	})
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`, width, width, path.String())
+}
+
+// runs calls draw for every horizontal run of dark modules.
+func (q *QRCode) runs(draw func(x, y, length int)) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; {
+			if !q.modules[y][x] {
+				x++
+				continue
+			}
+
+			start := x
+			for x < q.Size && q.modules[y][x] {
+				x++
+			}
+
+			draw(start, y, x-start)
+		}
+	}
+}
+
+// DrawQRCode draws the code into the square at x, y (bottom left) of side
+// points, including the quiet zone.
+func (p *PDFPage) DrawQRCode(q *QRCode, x, y, side float64) {
+	const border = 4
+	module := side / float64(q.Size+2*border)
+	q.runs(func(mx, my, length int) {
+		p.FillRect(x+float64(mx+border)*module, y+side-float64(my+border+1)*module, float64(length)*module, module)
+	})
+}
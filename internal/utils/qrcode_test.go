@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// qrFormatM lists the level M format bits of each mask, ISO/IEC 18004 table C.1.
+var qrFormatM = [8]string{
+	"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+	"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+}
+
+// The reference symbols were generated with github.com/skip2/go-qrcode at
+// level M without quiet zone; rows top to bottom, 1 for dark modules.
+var (
+	// "hello, world", version 1, mask 7
+	qrReferenceV1 = []string{
+		"111111100101101111111",
+		"100000100110101000001",
+		"101110100101101011101",
+		"101110100011001011101",
+		"101110100011101011101",
+		"100000101000001000001",
+		"111111101010101111111",
+		"000000000000000000000",
+		"100101101101110100000",
+		"101100011101000010011",
+		"000001100101000101101",
+		"110100010110101101011",
+		"011111101011000010000",
+		"000000001111011100101",
+		"111111100101111011110",
+		"100000101001000100010",
+		"101110100111100110000",
+		"101110101100111111111",
+		"101110100001100010101",
+		"100000100111010000000",
+		"111111101110001101010",
+	}
+
+	// a 116 byte reader URL, version 7, mask 2; SHA-256 of the rows, each
+	// followed by a newline
+	qrReferenceV7Data = "https://scanner.example.com/reader/kid.abcdefghijklmnop.qrstuvwxyzabcdefghijklmnopqrstuvwxyz-abcdefghijklmnopqrstuvw"
+	qrReferenceV7Hash = "d56120fd65bbd4e447f6c9fec2602f825f11ab6ce29af957c0ecae066fb8b978"
+)
+
+func TestReedSolomonDivisor(t *testing.T) {
+	// x^7 + a^87 x^6 + a^229 x^5 + a^146 x^4 + a^149 x^3 + a^238 x^2 + a^102 x + a^21
+	want := []byte{127, 122, 154, 164, 11, 68, 117}
+	if got := reedSolomonDivisor(7); !slices.Equal(got, want) {
+		t.Errorf("degree 7 generator = %v, want %v", got, want)
+	}
+}
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// HELLO WORLD in alphanumeric mode at 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonDivisor(10)); !slices.Equal(got, want) {
+		t.Errorf("error correction = %v, want %v", got, want)
+	}
+}
+
+// formatBits reads both copies of the format information, most significant
+// bit first.
+func formatBits(q *QRCode) (string, string) {
+	first := []bool{}
+	for x := 0; x <= 5; x++ {
+		first = append(first, q.Dark(x, 8))
+	}
+
+	first = append(first, q.Dark(7, 8), q.Dark(8, 8), q.Dark(8, 7))
+	for y := 5; y >= 0; y-- {
+		first = append(first, q.Dark(8, y))
+	}
+
+	second := []bool{}
+	for y := q.Size - 1; y >= q.Size-7; y-- {
+		second = append(second, q.Dark(8, y))
+	}
+
+	for x := q.Size - 8; x < q.Size; x++ {
+		second = append(second, q.Dark(x, 8))
+	}
+
+	return bitString(first), bitString(second)
+}
+
+func bitString(bits []bool) string {
+	var b strings.Builder
+	for _, bit := range bits {
+		if bit {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+
+	return b.String()
+}
+
+// symbolMask returns the mask the format information of q names.
+func symbolMask(t *testing.T, q *QRCode) int {
+	t.Helper()
+
+	first, second := formatBits(q)
+	if first != second {
+		t.Fatalf("format copies differ: %s and %s", first, second)
+	}
+
+	mask := slices.Index(qrFormatM[:], first)
+	if mask < 0 {
+		t.Fatalf("format bits %s are not level M", first)
+	}
+
+	return mask
+}
+
+func TestFormatBits(t *testing.T) {
+	q, err := NewQRCode([]byte("format"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for mask, want := range qrFormatM {
+		q.drawFormat(mask)
+		first, second := formatBits(q)
+		if first != want || second != want {
+			t.Errorf("mask %d: format bits %s and %s, want %s", mask, first, second, want)
+		}
+	}
+}
+
+func TestVersionBits(t *testing.T) {
+	tests := map[int]string{
+		7:  "000111110010010100",
+		8:  "001000010110111100",
+		40: "101000110001101001",
+	}
+
+	for version, want := range tests {
+		q := &QRCode{Version: version, Size: version*4 + 17}
+		q.modules = make([][]bool, q.Size)
+		q.function = make([][]bool, q.Size)
+		for i := range q.modules {
+			q.modules[i] = make([]bool, q.Size)
+			q.function[i] = make([]bool, q.Size)
+		}
+
+		q.drawFunctionPatterns()
+
+		// bit i sits at (Size-11+i%3, i/3) and mirrored
+		upperRight, lowerLeft := make([]bool, 18), make([]bool, 18)
+		for i := 0; i < 18; i++ {
+			upperRight[17-i] = q.Dark(q.Size-11+i%3, i/3)
+			lowerLeft[17-i] = q.Dark(i/3, q.Size-11+i%3)
+		}
+
+		if got := bitString(upperRight); got != want {
+			t.Errorf("version %d: upper right block %s, want %s", version, got, want)
+		}
+
+		if got := bitString(lowerLeft); got != want {
+			t.Errorf("version %d: lower left block %s, want %s", version, got, want)
+		}
+	}
+}
+
+// remask switches q to mask, as the penalty rules of two encoders may choose
+// different masks for the same data.
+func remask(t *testing.T, q *QRCode, mask int) {
+	t.Helper()
+
+	q.applyMask(symbolMask(t, q))
+	q.applyMask(mask)
+	q.drawFormat(mask)
+}
+
+func symbolRows(q *QRCode) []string {
+	rows := []string{}
+	for y := 0; y < q.Size; y++ {
+		row := []bool{}
+		for x := 0; x < q.Size; x++ {
+			row = append(row, q.Dark(x, y))
+		}
+
+		rows = append(rows, bitString(row))
+	}
+
+	return rows
+}
+
+func TestKnownVersion1Symbol(t *testing.T) {
+	q, err := NewQRCode([]byte("hello, world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Version != 1 || q.Size != 21 {
+		t.Fatalf("version %d size %d, want version 1 size 21", q.Version, q.Size)
+	}
+
+	remask(t, q, 7)
+	for y, row := range symbolRows(q) {
+		if row != qrReferenceV1[y] {
+			t.Errorf("row %2d: %s\n   want: %s", y, row, qrReferenceV1[y])
+		}
+	}
+}
+
+func TestKnownVersion7Symbol(t *testing.T) {
+	q, err := NewQRCode([]byte(qrReferenceV7Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Version != 7 || q.Size != 45 {
+		t.Fatalf("version %d size %d, want version 7 size 45", q.Version, q.Size)
+	}
+
+	remask(t, q, 2)
+	sum := sha256.Sum256([]byte(strings.Join(symbolRows(q), "\n") + "\n"))
+	if got := hex.EncodeToString(sum[:]); got != qrReferenceV7Hash {
+		t.Errorf("symbol hash %s, want %s", got, qrReferenceV7Hash)
+	}
+}
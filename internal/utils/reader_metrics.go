@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// Reasons a reader request is rejected, counted in ReaderRejections.
+const (
+	RejectedRateLimitIP    = "rate_limited_ip"
+	RejectedRateLimitToken = "rate_limited_token"
+	RejectedLockedOut      = "locked_out"
+	RejectedInvalidLink    = "invalid_link"
+	RejectedScanLimit      = "scan_limit"
+)
+
+// ReaderRejections counts rejected reader requests by reason since the
+// process started.
+var ReaderRejections = expvar.NewMap("reader_rejections")
+
+func CountReaderRejection(reason string) {
+	ReaderRejections.Add(reason, 1)
+}
+
+// ReaderRejectionCounts returns a snapshot of ReaderRejections.
+func ReaderRejectionCounts() map[string]int64 {
+	counts := map[string]int64{}
+	ReaderRejections.Do(func(kv expvar.KeyValue) {
+		count, _ := strconv.ParseInt(kv.Value.String(), 10, 64)
+		counts[kv.Key] = count
+	})
+
+	return counts
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,3 +48,63 @@ func CheckPasswordHash(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+var capacityRe = regexp.MustCompile(`(?i)([0-9]+(?:[.,][0-9]+)?)\s*([KMGTP])?I?B?`)
+
+// ParseCapacityGB converts a drive capacity label such as "512GB", "1.92 TB" or
+// "480G" into decimal gigabytes. It returns 0 when the label can't be parsed.
+func ParseCapacityGB(s string) float64 {
+	match := capacityRe.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(strings.ReplaceAll(match[1], ",", "."), 64)
+	if err != nil {
+		return 0
+	}
+
+	switch strings.ToUpper(match[2]) {
+	case "K":
+		return value / 1000 / 1000
+	case "M":
+		return value / 1000
+	case "T":
+		return value * 1000
+	case "P":
+		return value * 1000 * 1000
+	default:
+		// drive labels without a unit are almost always gigabytes
+		return value
+	}
+}
+
+// NormalizeSerial upper-cases a serial number and strips everything that is
+// not a letter or digit, so "wd-123 abc" and "WD123ABC" compare equal.
+func NormalizeSerial(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+var ocrConfusions = strings.NewReplacer(
+	"O", "0",
+	"Q", "0",
+	"I", "1",
+	"L", "1",
+	"S", "5",
+	"B", "8",
+	"Z", "2",
+)
+
+// FoldOCR normalizes s and maps characters that OCR commonly confuses onto a
+// single representative (O/0, I/1, S/5, ...). Two labels read from the same
+// sticker fold to the same key even if one of them was misread.
+func FoldOCR(s string) string {
+	return ocrConfusions.Replace(NormalizeSerial(s))
+}
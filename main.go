@@ -4,10 +4,15 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"scanner/config"
 	"scanner/databases"
+	"scanner/internal/commands"
 	"scanner/internal/middlewares"
+	"scanner/internal/migrations"
+	"scanner/internal/repositories"
 	"scanner/internal/routes"
+	"scanner/internal/services"
 	"scanner/internal/utils"
 
 	"github.com/gofiber/fiber/v2"
@@ -20,9 +25,39 @@ func main() {
 	config := config.InitConfig()
 	databases.InitialMongoDB(config)
 	defer databases.CloseMongoDB()
+
+	psidCipher, err := utils.NewPsidCipher(config.PsidEncryption.Keys, config.PsidEncryption.ActiveKey, config.PsidEncryption.IndexKey)
+	if err != nil {
+		log.Fatalf("Failed to initialize PSID encryption: %v", err)
+	}
+
+	utils.SetPsidCipher(psidCipher)
+
+	if len(os.Args) > 1 {
+		if err := commands.Run(context.Background(), config, os.Args[1:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		return
+	}
+
+	if config.MongoDB.AutoMigrate {
+		if err := migrations.Run(context.Background(), databases.DB); err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+	}
+
+	if err := repositories.NewPsidIndexRepository().Check(context.Background()); err != nil {
+		log.Fatalf("Failed to check the PSID index key: %v", err)
+	}
+
+	go services.NewWebhookService().Run(context.Background())
+
 	app := fiber.New(fiber.Config{
-		ProxyHeader: "X-Forwarded-For",
-		BodyLimit:   200 * 1024 * 1024, // 100 MB for large file uploads
+		ProxyHeader:             "X-Forwarded-For",
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          config.ServerConfig.TrustedProxies,
+		BodyLimit:               200 * 1024 * 1024, // 100 MB for large file uploads
 	})
 
 	// Initialize OIDC provider and verifier
@@ -2,9 +2,13 @@
 // Example usage
 try {
     $secret = hex2bin("b2e32f9dd1a8c4e9ef6b339c8c373eab85a9cda934f3dfc2b88d7c5c4bb1e8f0");
+    // key id from READER_TOKEN_KEYS, or "" for a token sealed with SECRET_KEY
+    $kid = "";
     $data = json_encode([
         "inventory_id" => "12345ABC",
-        "serial_number" => "S98765"
+        "serial_numbers" => ["S98765"],
+        "exp" => time() + 72 * 3600,
+        "nonce" => bin2hex(random_bytes(16)),
     ]);
 
     $key = substr($secret, 0, 32);
@@ -22,10 +26,11 @@ try {
     function b64u($d){ return rtrim(strtr(base64_encode($d), '+/', '-_'), '='); }
 
     $token = b64u($iv) . "." . b64u($cipher) . "." . b64u($tag);
+    if ($kid !== "") {
+        $token = $kid . "." . $token;
+    }
 
     echo $token;
 } catch (Exception $e) {
     die("Error initializing CryptoService: " . $e->getMessage());
 }
-
-